@@ -0,0 +1,272 @@
+// Package analyzer inspects captured packets for known signatures of network interference, such as
+// those left by censors. It works on any pcapng file, including the captures exported by a traffic
+// log, and reports what it finds with references to the packets involved.
+//
+// The checks are heuristics; a finding is a lead for the person inspecting the captures, not proof
+// of interference. Only traffic seen from the client side is assumed. Captures stripped of their
+// application-layer data by a mutator cannot be checked for ClientHello stalls or DNS races.
+package analyzer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/flows"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+// Defaults for Options.
+const (
+	DefaultTTLTolerance  = 2
+	DefaultIPIDTolerance = 1000
+	DefaultSYNTimeout    = 3 * time.Second
+	DefaultStallTimeout  = 5 * time.Second
+)
+
+// Kind identifies a type of interference.
+type Kind string
+
+// Kinds of interference which are detected.
+const (
+	// InjectedRST is a TCP reset, purportedly from the server, whose TTL or IPv4 ID is out of line
+	// with the other packets sent by the server in the flow, suggesting it was sent by a middlebox.
+	InjectedRST Kind = "injected-rst"
+
+	// SYNBlackhole is a connection attempt which received no response at all.
+	SYNBlackhole Kind = "syn-blackhole"
+
+	// ClientHelloStall is a TLS handshake in which the server sent nothing after the ClientHello.
+	ClientHelloStall Kind = "client-hello-stall"
+
+	// DNSRace is a DNS query which received differing responses, as when a forged response races
+	// the real answer.
+	DNSRace Kind = "dns-race"
+)
+
+// Finding is a single instance of suspected interference.
+type Finding struct {
+	Kind Kind
+
+	// Time is the time of the packet which best marks the interference.
+	Time time.Time
+
+	// The flow in which the interference was seen. Protocol is "tcp" or "udp". Client and Server
+	// are in the form host:port.
+	Protocol       string
+	Client, Server string
+
+	// Description explains the finding in a sentence.
+	Description string
+
+	// Packets are the packets involved, in the order captured.
+	Packets []PacketRef
+}
+
+// PacketRef refers to a packet in the analyzed pcapng file.
+type PacketRef struct {
+	// Number is the position of the packet in the file, counting from 1 across all sections. This
+	// matches the frame numbers shown by Wireshark.
+	Number int
+
+	Time time.Time
+}
+
+func refTo(p *flows.Packet) PacketRef {
+	return PacketRef{p.Number, p.Time}
+}
+
+// Options configure the analysis. The zero value of each field selects its default.
+type Options struct {
+	// TTLTolerance is the largest difference in TTL between a reset and the preceding packet from
+	// the same host which is not considered an anomaly.
+	TTLTolerance int
+
+	// IPIDTolerance is the largest difference in IPv4 ID between a reset and the preceding packet
+	// from the same host which is not considered an anomaly.
+	IPIDTolerance int
+
+	// SYNTimeout is how long a connection attempt must go unanswered to be reported. Connection
+	// attempts made within this long of the end of the capture containing them are not reported.
+	// Exported captures are not continuous: each section may have been captured by a different
+	// process, and windowed saves, recorded in section comments, cover only their windows. The
+	// capture containing a packet ends with the last packet of its section or, if the packet is in
+	// a saved window, the end of the window.
+	SYNTimeout time.Duration
+
+	// StallTimeout is how long the server must be silent after a ClientHello for the handshake to
+	// be reported. As with SYNTimeout, the capture must extend this far past the ClientHello.
+	StallTimeout time.Duration
+}
+
+func (opts *Options) withDefaults() Options {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.TTLTolerance <= 0 {
+		o.TTLTolerance = DefaultTTLTolerance
+	}
+	if o.IPIDTolerance <= 0 {
+		o.IPIDTolerance = DefaultIPIDTolerance
+	}
+	if o.SYNTimeout <= 0 {
+		o.SYNTimeout = DefaultSYNTimeout
+	}
+	if o.StallTimeout <= 0 {
+		o.StallTimeout = DefaultStallTimeout
+	}
+	return o
+}
+
+// Analyze reads a pcapng file and returns the findings, ordered by time. The options may be nil.
+func Analyze(r io.Reader, opts *Options) ([]Finding, error) {
+	a := newAnalysis(opts.withDefaults())
+	if _, err := flows.ReadSections(r, func(comments []string) error {
+		a.addSection(comments)
+		return nil
+	}, func(p *flows.Packet) error {
+		a.add(p)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return a.findings(), nil
+}
+
+// CaptureSource is a source of pcapng captures. It is implemented by tlproc.TrafficLogProcess and
+// trafficlog.TrafficLog.
+type CaptureSource interface {
+	WritePcapng(w io.Writer) error
+}
+
+// AnalyzeCaptures analyzes the saved captures of a traffic log.
+func AnalyzeCaptures(src CaptureSource, opts *Options) ([]Finding, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.WritePcapng(pw))
+	}()
+	findings, err := Analyze(pr, opts)
+	// Unblock the writer if analysis stopped early.
+	pr.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to analyze captures: %w", err)
+	}
+	return findings, nil
+}
+
+// analysis holds the state accumulated over a single pass through the packets.
+type analysis struct {
+	opts Options
+
+	tcp     map[flows.Key]*tcpFlow
+	tcpKeys []flows.Key
+	dns     *dnsQueries
+
+	sections []*captureSection
+
+	results []Finding
+}
+
+// captureSection describes a section of the captures.
+type captureSection struct {
+	windows []tlapi.SaveWindow
+
+	// The time of the last packet captured in the section.
+	end time.Time
+}
+
+func newAnalysis(opts Options) *analysis {
+	return &analysis{opts: opts, tcp: map[flows.Key]*tcpFlow{}, dns: newDNSQueries()}
+}
+
+func (a *analysis) addSection(comments []string) {
+	section := new(captureSection)
+	for _, c := range comments {
+		if sw, ok := tlapi.ParseSaveWindowComment(c); ok {
+			section.windows = append(section.windows, sw)
+		}
+	}
+	a.sections = append(a.sections, section)
+}
+
+func (a *analysis) add(p *flows.Packet) {
+	for len(a.sections) <= p.Section {
+		a.sections = append(a.sections, new(captureSection))
+	}
+	if section := a.sections[p.Section]; p.Time.After(section.end) {
+		section.end = p.Time
+	}
+	switch {
+	case p.TCP != nil:
+		key := p.Key()
+		f, ok := a.tcp[key]
+		if !ok {
+			f = newTCPFlow()
+			a.tcp[key] = f
+			a.tcpKeys = append(a.tcpKeys, key)
+		}
+		f.section = p.Section
+		a.results = append(a.results, f.add(p, a.opts)...)
+	case p.SrcPort == dnsPort || p.DstPort == dnsPort:
+		a.dns.add(p)
+	}
+}
+
+// Returns the end of the capture containing a packet sent at time t, in the input section, to or
+// from the server. If any windows saved for the server are recorded, only those are considered;
+// otherwise, the windows saved for any address are.
+func (a *analysis) captureEnd(section int, server string, t time.Time) time.Time {
+	s := a.sections[section]
+	forServer := false
+	for _, sw := range s.windows {
+		if containsAddress(sw.Addresses, server) {
+			forServer = true
+			break
+		}
+	}
+	var windowEnd time.Time
+	for _, sw := range s.windows {
+		if forServer && !containsAddress(sw.Addresses, server) {
+			continue
+		}
+		if !t.Before(sw.Start) && !t.After(sw.End) && sw.End.After(windowEnd) {
+			windowEnd = sw.End
+		}
+	}
+	if !windowEnd.IsZero() && windowEnd.Before(s.end) {
+		return windowEnd
+	}
+	return s.end
+}
+
+// Reports whether the addresses include the input address, in the form host:port. Addresses with
+// IP hosts are compared in canonical form.
+func containsAddress(addresses []string, addr string) bool {
+	for _, a := range addresses {
+		if host, port, err := net.SplitHostPort(a); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				a = net.JoinHostPort(ip.String(), port)
+			}
+		}
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *analysis) findings() []Finding {
+	results := append([]Finding{}, a.results...)
+	for _, key := range a.tcpKeys {
+		f := a.tcp[key]
+		server := f.peer(f.endpoint(f.client)).addr
+		end := func(t time.Time) time.Time { return a.captureEnd(f.section, server, t) }
+		results = append(results, f.finish(end, a.opts)...)
+	}
+	results = append(results, a.dns.findings()...)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Time.Before(results[j].Time) })
+	return results
+}
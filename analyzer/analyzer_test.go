@@ -0,0 +1,196 @@
+package analyzer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/pcapng"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+// Returns a ClientHello record as written by crypto/tls.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+
+	hdr := make([]byte, 5)
+	_, err := io.ReadFull(server, hdr)
+	require.NoError(t, err)
+	body := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	_, err = io.ReadFull(server, body)
+	require.NoError(t, err)
+	client.Close()
+	return append(hdr, body...)
+}
+
+func TestAnalyze(t *testing.T) {
+	var (
+		start    = time.Date(2022, 9, 3, 14, 30, 0, 0, time.UTC)
+		at       = func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+		local    = net.IPv4(192, 168, 1, 20)
+		proxy    = net.IPv4(203, 0, 113, 7)
+		resolver = net.IPv4(198, 51, 100, 53)
+		buf      = new(bytes.Buffer)
+	)
+	w, err := pcapgo.NewNgWriter(buf, layers.LinkTypeEthernet)
+	require.NoError(t, err)
+	write := func(ts time.Time, ip *layers.IPv4, transport gopacket.SerializableLayer, payload []byte) {
+		ip.Version = 4
+		eth := &layers.Ethernet{
+			SrcMAC: make(net.HardwareAddr, 6), DstMAC: make(net.HardwareAddr, 6), EthernetType: layers.EthernetTypeIPv4,
+		}
+		b := gopacket.NewSerializeBuffer()
+		require.NoError(t, gopacket.SerializeLayers(b, gopacket.SerializeOptions{FixLengths: true},
+			eth, ip, transport, gopacket.Payload(payload)))
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(b.Bytes()), Length: len(b.Bytes())}
+		require.NoError(t, w.WritePacket(ci, b.Bytes()))
+	}
+	// Writes a TCP packet from the client if ttl is zero, otherwise from the proxy.
+	writeTCP := func(ms int, port uint16, ttl uint8, id uint16, tcp layers.TCP, payload []byte) {
+		ip := &layers.IPv4{TTL: 64, Id: id, Protocol: layers.IPProtocolTCP, SrcIP: local, DstIP: proxy}
+		tcp.SrcPort, tcp.DstPort = layers.TCPPort(port), 443
+		if ttl != 0 {
+			ip.TTL, ip.SrcIP, ip.DstIP = ttl, proxy, local
+			tcp.SrcPort, tcp.DstPort = 443, layers.TCPPort(port)
+		}
+		write(at(ms), ip, &tcp, payload)
+	}
+	writeDNS := func(ms int, ttl uint8, msg *layers.DNS) {
+		ip := &layers.IPv4{TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: local, DstIP: resolver}
+		udp := &layers.UDP{SrcPort: 53000, DstPort: 53}
+		if msg.QR {
+			ip.TTL, ip.SrcIP, ip.DstIP = ttl, resolver, local
+			udp.SrcPort, udp.DstPort = 53, 53000
+		}
+		b := gopacket.NewSerializeBuffer()
+		require.NoError(t, msg.SerializeTo(b, gopacket.SerializeOptions{FixLengths: true}))
+		write(at(ms), ip, udp, b.Bytes())
+	}
+	dnsMsg := func(response bool, answer net.IP) *layers.DNS {
+		msg := &layers.DNS{
+			ID: 7, QR: response, RD: true, RA: response,
+			Questions: []layers.DNSQuestion{{Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN}},
+		}
+		if answer != nil {
+			msg.Answers = []layers.DNSResourceRecord{{
+				Name: []byte("example.com"), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 300, IP: answer,
+			}}
+		}
+		return msg
+	}
+
+	// 1-5: a reset injected by a middlebox.
+	writeTCP(0, 50001, 0, 1, layers.TCP{SYN: true, Seq: 99}, nil)
+	writeTCP(40, 50001, 52, 1000, layers.TCP{SYN: true, ACK: true, Seq: 499, Ack: 100}, nil)
+	writeTCP(41, 50001, 0, 2, layers.TCP{ACK: true, Seq: 100, Ack: 500}, nil)
+	writeTCP(90, 50001, 52, 1001, layers.TCP{ACK: true, Seq: 500, Ack: 100}, []byte("hello"))
+	writeTCP(91, 50001, 45, 40000, layers.TCP{RST: true, Seq: 505}, nil)
+
+	// 6-7: a reset sent by the proxy itself.
+	writeTCP(100, 50002, 0, 1, layers.TCP{SYN: true, Seq: 99}, nil)
+	writeTCP(140, 50002, 52, 2000, layers.TCP{RST: true, ACK: true, Ack: 100}, nil)
+
+	// 8-10: a connection attempt which is never answered.
+	writeTCP(200, 50003, 0, 1, layers.TCP{SYN: true, Seq: 99}, nil)
+	writeTCP(1200, 50003, 0, 2, layers.TCP{SYN: true, Seq: 99}, nil)
+	writeTCP(3200, 50003, 0, 3, layers.TCP{SYN: true, Seq: 99}, nil)
+
+	// 11-15: a handshake which stalls after the ClientHello.
+	hello := clientHello(t, "example.com")
+	writeTCP(300, 50004, 0, 1, layers.TCP{SYN: true, Seq: 99}, nil)
+	writeTCP(340, 50004, 52, 3000, layers.TCP{SYN: true, ACK: true, Seq: 499, Ack: 100}, nil)
+	writeTCP(341, 50004, 0, 2, layers.TCP{ACK: true, Seq: 100, Ack: 500}, nil)
+	writeTCP(342, 50004, 0, 3, layers.TCP{ACK: true, PSH: true, Seq: 100, Ack: 500}, hello)
+	writeTCP(380, 50004, 52, 3001, layers.TCP{ACK: true, Seq: 500, Ack: 100 + uint32(len(hello))}, nil)
+
+	// 16-18: a forged DNS response racing the real one.
+	writeDNS(500, 0, dnsMsg(false, nil))
+	writeDNS(510, 40, dnsMsg(true, net.IPv4(10, 10, 10, 10)))
+	writeDNS(530, 55, dnsMsg(true, net.IPv4(93, 184, 216, 34)))
+
+	// 19-22: a reset sent by the client, which randomizes its IP IDs.
+	writeTCP(4000, 50005, 0, 17, layers.TCP{SYN: true, Seq: 99}, nil)
+	writeTCP(4040, 50005, 52, 4000, layers.TCP{SYN: true, ACK: true, Seq: 499, Ack: 100}, nil)
+	writeTCP(4041, 50005, 0, 30000, layers.TCP{ACK: true, Seq: 100, Ack: 500}, nil)
+	writeTCP(4100, 50005, 0, 61234, layers.TCP{RST: true, Seq: 100}, nil)
+
+	// 23: marks the end of the captures.
+	writeDNS(6000, 0, dnsMsg(false, nil))
+	require.NoError(t, w.Flush())
+
+	findings, err := Analyze(buf, nil)
+	require.NoError(t, err)
+	kinds := []Kind{}
+	for _, f := range findings {
+		kinds = append(kinds, f.Kind)
+	}
+	require.Equal(t, []Kind{InjectedRST, ClientHelloStall, DNSRace, SYNBlackhole}, kinds, "%+v", findings)
+
+	rst := findings[0]
+	require.Equal(t, "192.168.1.20:50001", rst.Client)
+	require.Equal(t, "203.0.113.7:443", rst.Server)
+	require.Equal(t, []int{4, 5}, numbers(rst.Packets))
+	require.Contains(t, rst.Description, "TTL 45, against 52")
+	require.Contains(t, rst.Description, "IP ID 40000, against 1001")
+
+	stall := findings[1]
+	require.Equal(t, "192.168.1.20:50004", stall.Client)
+	require.Equal(t, []int{14}, numbers(stall.Packets))
+	require.Contains(t, stall.Description, "example.com")
+
+	race := findings[2]
+	require.Equal(t, "udp", race.Protocol)
+	require.Equal(t, "198.51.100.53:53", race.Server)
+	require.Equal(t, []int{16, 17, 18}, numbers(race.Packets))
+	require.Contains(t, race.Description, "10.10.10.10 (TTL 40)")
+
+	blackhole := findings[3]
+	require.Equal(t, []int{8, 9, 10}, numbers(blackhole.Packets))
+	require.WithinDuration(t, at(3200), blackhole.Time, 0)
+
+	// Captures which are not continuous. A connection attempt at the end of a saved window, and
+	// one at the end of a section, should not be reported, though later packets were captured.
+	sections := new(bytes.Buffer)
+	writeSection := func(comments ...string) {
+		require.NoError(t, w.Flush())
+		rw := pcapng.Rewriter{SectionComments: comments}
+		require.NoError(t, rw.Rewrite(buf, sections))
+		buf.Reset()
+		w, err = pcapgo.NewNgWriter(buf, layers.LinkTypeEthernet)
+		require.NoError(t, err)
+	}
+	buf.Reset()
+	w, err = pcapgo.NewNgWriter(buf, layers.LinkTypeEthernet)
+	require.NoError(t, err)
+	writeTCP(7900, 50006, 0, 1, layers.TCP{SYN: true, Seq: 99}, nil)
+	writeDNS(20000, 0, dnsMsg(false, nil))
+	writeSection(tlapi.SaveWindow{Addresses: []string{"203.0.113.7:443"}, Start: at(7000), End: at(8000)}.Comment())
+	writeTCP(30000, 50007, 0, 1, layers.TCP{SYN: true, Seq: 99}, nil)
+	writeTCP(30500, 50007, 0, 2, layers.TCP{SYN: true, Seq: 99}, nil)
+	writeSection()
+	writeDNS(60000, 0, dnsMsg(false, nil))
+	writeSection()
+
+	findings, err = Analyze(sections, nil)
+	require.NoError(t, err)
+	require.Empty(t, findings)
+}
+
+func numbers(refs []PacketRef) []int {
+	n := []int{}
+	for _, ref := range refs {
+		n = append(n, ref.Number)
+	}
+	return n
+}
@@ -0,0 +1,135 @@
+package analyzer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/flows"
+)
+
+const dnsPort = 53
+
+// Identifies a DNS query: the client and server, the query ID and the question.
+type dnsQueryKey struct {
+	client, server string
+	id             uint16
+	question       string
+}
+
+type dnsResponse struct {
+	ref PacketRef
+	ttl uint8
+
+	// The response code and answers, formatted for comparison and description.
+	answer string
+}
+
+type dnsQuery struct {
+	key       dnsQueryKey
+	query     *PacketRef
+	responses []dnsResponse
+}
+
+// dnsQueries collects queries and responses sent over UDP.
+type dnsQueries struct {
+	queries map[dnsQueryKey]*dnsQuery
+	order   []*dnsQuery
+}
+
+func newDNSQueries() *dnsQueries {
+	return &dnsQueries{queries: map[dnsQueryKey]*dnsQuery{}}
+}
+
+func (d *dnsQueries) add(p *flows.Packet) {
+	msg := new(layers.DNS)
+	if err := msg.DecodeFromBytes(p.Payload, gopacket.NilDecodeFeedback); err != nil {
+		return
+	}
+	if len(msg.Questions) == 0 {
+		return
+	}
+	q := msg.Questions[0]
+	key := dnsQueryKey{
+		id:       msg.ID,
+		question: fmt.Sprintf("%s query for %s", q.Type, strings.ToLower(string(q.Name))),
+	}
+	if msg.QR {
+		key.client, key.server = p.Destination(), p.Source()
+	} else {
+		key.client, key.server = p.Source(), p.Destination()
+	}
+	query, ok := d.queries[key]
+	if !ok {
+		query = &dnsQuery{key: key}
+		d.queries[key] = query
+		d.order = append(d.order, query)
+	}
+	ref := refTo(p)
+	if !msg.QR {
+		if query.query == nil {
+			query.query = &ref
+		}
+		return
+	}
+	query.responses = append(query.responses, dnsResponse{ref, p.TTL, formatDNSAnswer(msg)})
+}
+
+// Formats the response code and answers of a response. Answers are sorted, as their order may vary.
+func formatDNSAnswer(msg *layers.DNS) string {
+	answers := []string{}
+	for _, rr := range msg.Answers {
+		switch rr.Type {
+		case layers.DNSTypeA, layers.DNSTypeAAAA:
+			answers = append(answers, rr.IP.String())
+		case layers.DNSTypeCNAME:
+			answers = append(answers, "CNAME "+string(rr.CNAME))
+		default:
+			answers = append(answers, rr.Type.String())
+		}
+	}
+	sort.Strings(answers)
+	if msg.ResponseCode != layers.DNSResponseCodeNoErr || len(answers) == 0 {
+		answers = append([]string{msg.ResponseCode.String()}, answers...)
+	}
+	return strings.Join(answers, ", ")
+}
+
+// Reports each query which received differing responses. Identical responses, as when the server
+// retransmits, are not reported.
+func (d *dnsQueries) findings() []Finding {
+	findings := []Finding{}
+	for _, query := range d.order {
+		distinct := map[string]bool{}
+		for _, resp := range query.responses {
+			distinct[resp.answer] = true
+		}
+		if len(distinct) < 2 {
+			continue
+		}
+		refs := []PacketRef{}
+		if query.query != nil {
+			refs = append(refs, *query.query)
+		}
+		descriptions := []string{}
+		for _, resp := range query.responses {
+			refs = append(refs, resp.ref)
+			descriptions = append(descriptions,
+				fmt.Sprintf("packet %d: %s (TTL %d)", resp.ref.Number, resp.answer, resp.ttl))
+		}
+		findings = append(findings, Finding{
+			Kind:     DNSRace,
+			Time:     query.responses[1].ref.Time,
+			Protocol: "udp",
+			Client:   query.key.client,
+			Server:   query.key.server,
+			Description: fmt.Sprintf("%d differing responses to the %s (ID %d): %s",
+				len(query.responses), query.key.question, query.key.id, strings.Join(descriptions, "; ")),
+			Packets: refs,
+		})
+	}
+	return findings
+}
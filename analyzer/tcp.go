@@ -0,0 +1,224 @@
+package analyzer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/flows"
+)
+
+// tcpFlow holds the state of a TCP flow needed by the checks.
+type tcpFlow struct {
+	// The sender of the first SYN, or failing that, of the first packet.
+	client    string
+	clientSYN bool
+
+	endpoints map[string]*tcpEndpoint
+
+	// The section of the captures holding the flow's most recent packet.
+	section int
+}
+
+// The state of one side of a TCP flow, keyed by its address.
+type tcpEndpoint struct {
+	addr    string
+	packets int
+
+	// The most recent packet sent other than a reset, for comparison with resets.
+	last *flows.Packet
+
+	// Resets sent before any other packet, compared with the first packet sent after them.
+	pendingRSTs []*flows.Packet
+
+	// Connection attempts sent.
+	syns []PacketRef
+
+	// The time of the first reset sent, if any.
+	firstRST time.Time
+
+	// The stream of data sent, accumulated in sequence order until a ClientHello is parsed or
+	// cannot be.
+	stream    []byte
+	nextSeq   uint32
+	started   bool
+	helloDone bool
+	hello     *flows.ClientHello
+	helloRefs []PacketRef
+
+	// The time of the last data segment sent.
+	lastData time.Time
+}
+
+func newTCPFlow() *tcpFlow {
+	return &tcpFlow{endpoints: map[string]*tcpEndpoint{}}
+}
+
+func (f *tcpFlow) endpoint(addr string) *tcpEndpoint {
+	ep, ok := f.endpoints[addr]
+	if !ok {
+		ep = &tcpEndpoint{addr: addr}
+		f.endpoints[addr] = ep
+	}
+	return ep
+}
+
+func (f *tcpFlow) peer(ep *tcpEndpoint) *tcpEndpoint {
+	for addr, other := range f.endpoints {
+		if addr != ep.addr {
+			return other
+		}
+	}
+	return &tcpEndpoint{}
+}
+
+// Adds a packet to the flow, returning any resets found to be injected.
+func (f *tcpFlow) add(p *flows.Packet, opts Options) []Finding {
+	src, tcp := p.Source(), p.TCP
+	if f.client == "" {
+		f.client = src
+	}
+	if tcp.SYN && !tcp.ACK && !f.clientSYN {
+		f.clientSYN, f.client = true, src
+	}
+	ep := f.endpoint(src)
+	f.endpoint(p.Destination())
+	ep.packets++
+
+	if tcp.SYN && !tcp.ACK {
+		ep.syns = append(ep.syns, refTo(p))
+	}
+	if p.PayloadLength > 0 {
+		ep.lastData = p.Time
+		ep.addData(p)
+	}
+
+	findings := []Finding{}
+	if tcp.RST {
+		if ep.firstRST.IsZero() {
+			ep.firstRST = p.Time
+		}
+		// Captures are taken on the client, so resets it sends are genuine. Some stacks, such as
+		// macOS, randomize IP IDs, so checking these would only produce false positives.
+		if src == f.client {
+			return findings
+		}
+		if ep.last == nil {
+			ep.pendingRSTs = append(ep.pendingRSTs, p)
+		} else if finding, ok := f.checkRST(p, ep.last, opts); ok {
+			findings = append(findings, finding)
+		}
+		return findings
+	}
+	for _, rst := range ep.pendingRSTs {
+		if finding, ok := f.checkRST(rst, p, opts); ok {
+			findings = append(findings, finding)
+		}
+	}
+	ep.last, ep.pendingRSTs = p, nil
+	return findings
+}
+
+// Compares a reset sent by the server with another packet from the server.
+func (f *tcpFlow) checkRST(rst, ref *flows.Packet, opts Options) (Finding, bool) {
+	anomalies := []string{}
+	if diff := abs(int(rst.TTL) - int(ref.TTL)); diff > opts.TTLTolerance {
+		anomalies = append(anomalies, fmt.Sprintf("TTL %d, against %d", rst.TTL, ref.TTL))
+	}
+	// IP IDs are only set for IPv4.
+	if rst.Src.To4() != nil {
+		if diff := abs(int(int16(rst.IPID - ref.IPID))); diff > opts.IPIDTolerance {
+			anomalies = append(anomalies, fmt.Sprintf("IP ID %d, against %d", rst.IPID, ref.IPID))
+		}
+	}
+	if len(anomalies) == 0 {
+		return Finding{}, false
+	}
+	refs := []PacketRef{refTo(ref), refTo(rst)}
+	if rst.Number < ref.Number {
+		refs[0], refs[1] = refs[1], refs[0]
+	}
+	return f.finding(InjectedRST, rst.Time, refs,
+		"reset from %s has %s in packet %d from the same host",
+		rst.Source(), strings.Join(anomalies, " and "), ref.Number), true
+}
+
+// Accumulates the data sent by the endpoint until a ClientHello is parsed or cannot be. Segments
+// which do not continue the stream, such as retransmissions, are ignored.
+func (ep *tcpEndpoint) addData(p *flows.Packet) {
+	if ep.helloDone {
+		return
+	}
+	if ep.started && p.TCP.Seq != ep.nextSeq {
+		return
+	}
+	ep.started, ep.nextSeq = true, p.TCP.Seq+uint32(p.PayloadLength)
+	ep.stream = append(ep.stream, p.Payload...)
+	ep.helloRefs = append(ep.helloRefs, refTo(p))
+	hello, err := flows.ParseClientHello(ep.stream)
+	switch {
+	case err == nil:
+		ep.hello = hello
+	case errors.Is(err, flows.ErrIncomplete) && len(p.Payload) == p.PayloadLength:
+		return
+	default:
+		ep.helloRefs = nil
+	}
+	ep.stream, ep.helloDone = nil, true
+}
+
+// Checks for connection attempts which went unanswered and handshakes which stalled. captureEnd
+// returns the end of the capture containing a packet of the flow sent at the input time.
+func (f *tcpFlow) finish(captureEnd func(t time.Time) time.Time, opts Options) []Finding {
+	findings := []Finding{}
+	client := f.endpoint(f.client)
+	server := f.peer(client)
+
+	if f.clientSYN && server.packets == 0 && len(client.syns) > 0 {
+		first, last := client.syns[0].Time, client.syns[len(client.syns)-1].Time
+		if end := captureEnd(first); end.Sub(first) >= opts.SYNTimeout {
+			findings = append(findings, f.finding(SYNBlackhole, last, client.syns,
+				"%s did not respond to %d SYN(s) within %v",
+				server.addr, len(client.syns), end.Sub(first).Round(time.Millisecond)))
+		}
+	}
+
+	if client.hello != nil {
+		helloTime := client.helloRefs[len(client.helloRefs)-1].Time
+		// A reset is reported separately, if injected; a server which has reset the connection
+		// has not stalled.
+		silent := !server.lastData.After(helloTime) &&
+			(server.firstRST.IsZero() || !server.firstRST.After(helloTime))
+		if end := captureEnd(helloTime); silent && end.Sub(helloTime) >= opts.StallTimeout {
+			name := client.hello.ServerName
+			if name == "" {
+				name = "no server name"
+			}
+			findings = append(findings, f.finding(ClientHelloStall, helloTime, client.helloRefs,
+				"%s sent no data for at least %v after the ClientHello (%s)",
+				server.addr, end.Sub(helloTime).Round(time.Millisecond), name))
+		}
+	}
+	return findings
+}
+
+func (f *tcpFlow) finding(kind Kind, t time.Time, refs []PacketRef, format string, args ...interface{}) Finding {
+	server := f.peer(f.endpoint(f.client)).addr
+	return Finding{
+		Kind:        kind,
+		Time:        t,
+		Protocol:    "tcp",
+		Client:      f.client,
+		Server:      server,
+		Description: fmt.Sprintf(format, args...),
+		Packets:     refs,
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,247 @@
+// Package anonymize replaces the IP and MAC addresses of the local machine in captured packets with
+// pseudonyms.
+//
+// Pseudonyms are derived from the original address using a keyed hash, so an address is always
+// mapped to the same pseudonym by a given Anonymizer. IPv4 pseudonyms are taken from 10.0.0.0/8,
+// IPv6 pseudonyms from fd00::/8 and MAC pseudonyms are locally administered unicast addresses.
+//
+// Packets are modified in place. Rather than re-serializing packets, which may have been truncated
+// or stripped of their payloads by a mutator, checksums covering the replaced addresses are adjusted
+// incrementally (RFC 1624). Checksums which were valid remain valid; checksums which were not (for
+// example, because they are computed by the network card) remain invalid.
+package anonymize
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+)
+
+// Link types supported by Anonymizer.Packet. See https://www.tcpdump.org/linktypes.html.
+const (
+	LinkTypeNull     = 0
+	LinkTypeEthernet = 1
+	LinkTypeRaw      = 101
+	LinkTypeLoop     = 108
+)
+
+// IP protocol numbers.
+const (
+	protoICMPv6 = 58
+	protoTCP    = 6
+	protoUDP    = 17
+)
+
+// Anonymizer replaces addresses with pseudonyms.
+type Anonymizer struct {
+	key  []byte
+	keep func(net.IP) bool
+}
+
+// New creates an Anonymizer which derives pseudonyms using the input key. IP addresses for which
+// keep returns true, such as those of the proxies being captured, are left alone. The keep function
+// may be nil.
+func New(key []byte, keep func(net.IP) bool) *Anonymizer {
+	if keep == nil {
+		keep = func(net.IP) bool { return false }
+	}
+	return &Anonymizer{append([]byte{}, key...), keep}
+}
+
+// AlsoKeeping returns an Anonymizer which derives the same pseudonyms as a, but which also leaves
+// alone the IP addresses for which keep returns true.
+func (a *Anonymizer) AlsoKeeping(keep func(net.IP) bool) *Anonymizer {
+	return &Anonymizer{a.key, func(ip net.IP) bool { return a.keep(ip) || keep(ip) }}
+}
+
+func (a *Anonymizer) hash(kind byte, addr []byte) []byte {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte{kind})
+	mac.Write(addr)
+	return mac.Sum(nil)
+}
+
+// IP returns the pseudonym for the input address, or the address itself if it should be kept.
+func (a *Anonymizer) IP(ip net.IP) net.IP {
+	if a.keep(ip) {
+		return ip
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		h := a.hash(4, ip4)
+		return net.IPv4(10, h[0], h[1], h[2]).To4()
+	}
+	h := a.hash(6, ip)
+	pseudonym := make(net.IP, net.IPv6len)
+	pseudonym[0] = 0xfd
+	copy(pseudonym[1:], h)
+	return pseudonym
+}
+
+// MAC returns the pseudonym for the input address. Broadcast and multicast addresses are returned as
+// they are.
+func (a *Anonymizer) MAC(hw net.HardwareAddr) net.HardwareAddr {
+	if len(hw) == 0 || hw[0]&0x01 != 0 {
+		return hw
+	}
+	h := a.hash('m', hw)
+	pseudonym := make(net.HardwareAddr, len(hw))
+	copy(pseudonym, h)
+	// Locally administered, unicast.
+	pseudonym[0] = pseudonym[0]&0xfc | 0x02
+	return pseudonym
+}
+
+// Packet replaces the addresses in the packet, which has the input link type. Only IPv4 and IPv6
+// packets are modified; other packets, and packets of unsupported link types, are left alone. A
+// packet which is too short to hold a header is modified as far as possible.
+func (a *Anonymizer) Packet(data []byte, linkType uint16) {
+	var (
+		etherType uint16
+		ipData    []byte
+	)
+	switch linkType {
+	case LinkTypeEthernet:
+		if len(data) < 14 {
+			return
+		}
+		a.replaceMAC(data[0:6])
+		a.replaceMAC(data[6:12])
+		etherType, ipData = binary.BigEndian.Uint16(data[12:14]), data[14:]
+		// Skip any VLAN tags.
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(ipData) >= 4 {
+			etherType, ipData = binary.BigEndian.Uint16(ipData[2:4]), ipData[4:]
+		}
+	case LinkTypeNull, LinkTypeLoop:
+		// A 4-byte address family in host or network byte order; the IP version suffices.
+		if len(data) < 4 {
+			return
+		}
+		ipData = data[4:]
+	case LinkTypeRaw:
+		ipData = data
+	default:
+		return
+	}
+	if len(ipData) == 0 {
+		return
+	}
+	switch {
+	case ipData[0]>>4 == 4 && (etherType == 0 || etherType == 0x0800):
+		a.ipv4(ipData)
+	case ipData[0]>>4 == 6 && (etherType == 0 || etherType == 0x86dd):
+		a.ipv6(ipData)
+	}
+}
+
+func (a *Anonymizer) replaceMAC(b []byte) {
+	copy(b, a.MAC(net.HardwareAddr(b)))
+}
+
+func (a *Anonymizer) ipv4(b []byte) {
+	if len(b) < 20 {
+		return
+	}
+	headerLen := int(b[0]&0x0f) * 4
+	src, dst := b[12:16], b[16:20]
+	newSrc, newDst := a.IP(net.IP(src)).To4(), a.IP(net.IP(dst)).To4()
+	// The header checksum covers the addresses.
+	adjustChecksum(b[10:12], src, newSrc, false)
+	adjustChecksum(b[10:12], dst, newDst, false)
+
+	// Only the first fragment holds the transport header.
+	fragmentOffset := binary.BigEndian.Uint16(b[6:8]) & 0x1fff
+	if fragmentOffset == 0 && headerLen >= 20 && len(b) > headerLen {
+		a.transport(b[9], b[headerLen:], src, newSrc, dst, newDst)
+	}
+	copy(src, newSrc)
+	copy(dst, newDst)
+}
+
+func (a *Anonymizer) ipv6(b []byte) {
+	if len(b) < 40 {
+		return
+	}
+	src, dst := b[8:24], b[24:40]
+	newSrc, newDst := a.IP(net.IP(src)), a.IP(net.IP(dst))
+
+	// Walk any extension headers to find the transport header.
+	nextHeader, payload := b[6], b[40:]
+	for {
+		switch nextHeader {
+		case 0, 43, 60: // hop-by-hop, routing, destination options
+			if len(payload) < 8 {
+				payload = nil
+				break
+			}
+			extLen := (int(payload[1]) + 1) * 8
+			if len(payload) < extLen {
+				payload = nil
+				break
+			}
+			nextHeader, payload = payload[0], payload[extLen:]
+			continue
+		case 44: // fragment
+			if len(payload) < 8 || binary.BigEndian.Uint16(payload[2:4])&0xfff8 != 0 {
+				// Only the first fragment holds the transport header.
+				payload = nil
+				break
+			}
+			nextHeader, payload = payload[0], payload[8:]
+			continue
+		}
+		break
+	}
+	if len(payload) > 0 {
+		a.transport(nextHeader, payload, src, newSrc, dst, newDst)
+	}
+	copy(src, newSrc)
+	copy(dst, newDst)
+}
+
+// Adjusts the checksum of the transport header, which covers the addresses via a pseudo-header.
+func (a *Anonymizer) transport(protocol byte, b, src, newSrc, dst, newDst []byte) {
+	var (
+		offset int
+		isUDP  bool
+	)
+	switch {
+	case protocol == protoTCP:
+		offset = 16
+	case protocol == protoUDP:
+		offset, isUDP = 6, true
+	case protocol == protoICMPv6 && len(src) == net.IPv6len:
+		offset = 2
+	default:
+		return
+	}
+	if len(b) < offset+2 {
+		return
+	}
+	checksum := b[offset : offset+2]
+	if isUDP && len(src) == net.IPv4len && checksum[0] == 0 && checksum[1] == 0 {
+		// No checksum.
+		return
+	}
+	adjustChecksum(checksum, src, newSrc, isUDP)
+	adjustChecksum(checksum, dst, newDst, isUDP)
+}
+
+// Adjusts the Internet checksum in place to account for old being replaced. Both must be of
+// the same, even length. For UDP, a computed checksum of zero is transmitted as all ones.
+func adjustChecksum(checksum, old, replacement []byte, isUDP bool) {
+	// RFC 1624, equation 3: HC' = ~(~HC + ~m + m').
+	sum := uint32(^binary.BigEndian.Uint16(checksum))
+	for i := 0; i+1 < len(old); i += 2 {
+		sum += uint32(^binary.BigEndian.Uint16(old[i:]))
+		sum += uint32(binary.BigEndian.Uint16(replacement[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	result := ^uint16(sum)
+	if isUDP && result == 0 {
+		result = 0xffff
+	}
+	binary.BigEndian.PutUint16(checksum, result)
+}
@@ -0,0 +1,120 @@
+package anonymize
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	localMAC   = net.HardwareAddr{0x3c, 0x22, 0xfb, 0x01, 0x02, 0x03}
+	gatewayMAC = net.HardwareAddr{0x3c, 0x22, 0xfb, 0x04, 0x05, 0x06}
+)
+
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, ls...))
+	return append([]byte{}, buf.Bytes()...)
+}
+
+// Re-serializes the packet with freshly computed checksums. If the anonymized checksums are valid,
+// the result is identical to the input.
+func reserialize(t *testing.T, data []byte) []byte {
+	t.Helper()
+	pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	require.Nil(t, pkt.ErrorLayer())
+	ls := []gopacket.SerializableLayer{}
+	for _, l := range pkt.Layers() {
+		if sl, ok := l.(gopacket.SerializableLayer); ok {
+			ls = append(ls, sl)
+		}
+	}
+	if tcp := pkt.Layer(layers.LayerTypeTCP); tcp != nil {
+		tcp.(*layers.TCP).SetNetworkLayerForChecksum(pkt.NetworkLayer())
+	}
+	if udp := pkt.Layer(layers.LayerTypeUDP); udp != nil {
+		udp.(*layers.UDP).SetNetworkLayerForChecksum(pkt.NetworkLayer())
+	}
+	return serialize(t, ls...)
+}
+
+func TestPacket(t *testing.T) {
+	local4, proxy4 := net.IPv4(192, 168, 1, 20).To4(), net.IPv4(203, 0, 113, 7).To4()
+	local6, proxy6 := net.ParseIP("2001:db8::20"), net.ParseIP("2001:db8:ffff::7")
+	a := New([]byte("test key"), func(ip net.IP) bool { return ip.Equal(proxy4) || ip.Equal(proxy6) })
+
+	t.Run("IPv4/TCP", func(t *testing.T) {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: local4, DstIP: proxy4}
+		tcp := &layers.TCP{SrcPort: 50000, DstPort: 443, Seq: 1, SYN: true, Window: 65535}
+		tcp.SetNetworkLayerForChecksum(ip)
+		data := serialize(t,
+			&layers.Ethernet{SrcMAC: localMAC, DstMAC: gatewayMAC, EthernetType: layers.EthernetTypeIPv4},
+			ip, tcp, gopacket.Payload("hello"))
+
+		a.Packet(data, LinkTypeEthernet)
+		require.Equal(t, reserialize(t, data), data)
+
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		eth := pkt.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+		require.Equal(t, a.MAC(localMAC), eth.SrcMAC)
+		require.Equal(t, a.MAC(gatewayMAC), eth.DstMAC)
+		require.NotEqual(t, localMAC, eth.SrcMAC)
+		ipv4 := pkt.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		require.True(t, ipv4.SrcIP.Equal(a.IP(local4)))
+		require.Equal(t, byte(10), ipv4.SrcIP[0])
+		require.True(t, ipv4.DstIP.Equal(proxy4))
+	})
+
+	t.Run("IPv6/UDP", func(t *testing.T) {
+		ip := &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: layers.IPProtocolUDP, SrcIP: proxy6, DstIP: local6}
+		udp := &layers.UDP{SrcPort: 443, DstPort: 50000}
+		udp.SetNetworkLayerForChecksum(ip)
+		data := serialize(t,
+			&layers.Ethernet{SrcMAC: gatewayMAC, DstMAC: localMAC, EthernetType: layers.EthernetTypeIPv6},
+			ip, udp, gopacket.Payload("hello"))
+
+		a.Packet(data, LinkTypeEthernet)
+		require.Equal(t, reserialize(t, data), data)
+
+		pkt := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		ipv6 := pkt.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
+		require.True(t, ipv6.SrcIP.Equal(proxy6))
+		require.True(t, ipv6.DstIP.Equal(a.IP(local6)))
+		require.Equal(t, byte(0xfd), ipv6.DstIP[0])
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: local4, DstIP: proxy4}
+		tcp := &layers.TCP{SrcPort: 50000, DstPort: 443}
+		tcp.SetNetworkLayerForChecksum(ip)
+		data := serialize(t,
+			&layers.Ethernet{SrcMAC: localMAC, DstMAC: gatewayMAC, EthernetType: layers.EthernetTypeIPv4},
+			ip, tcp)
+		for n := 0; n < len(data); n++ {
+			truncated := append([]byte{}, data[:n]...)
+			require.NotPanics(t, func() { a.Packet(truncated, LinkTypeEthernet) })
+		}
+	})
+}
+
+func TestConsistency(t *testing.T) {
+	a, b := New([]byte("key a"), nil), New([]byte("key b"), nil)
+	ip := net.IPv4(192, 168, 1, 20)
+	require.Equal(t, a.IP(ip), a.IP(ip))
+	require.NotEqual(t, a.IP(ip), b.IP(ip))
+	require.NotEqual(t, a.IP(ip), a.IP(net.IPv4(192, 168, 1, 21)))
+
+	kept := net.IPv4(192, 168, 1, 21)
+	c := a.AlsoKeeping(func(other net.IP) bool { return other.Equal(kept) })
+	require.Equal(t, a.IP(ip), c.IP(ip))
+	require.Equal(t, kept, c.IP(kept))
+
+	broadcast := net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	require.Equal(t, broadcast, a.MAC(broadcast))
+	require.Equal(t, byte(0x02), a.MAC(localMAC)[0]&0x03)
+}
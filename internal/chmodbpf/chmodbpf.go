@@ -0,0 +1,150 @@
+// Package chmodbpf detects other utilities which configure the BPF devices on macOS, most notably
+// Wireshark's ChmodBPF launch daemon. config-bpf is modelled on ChmodBPF; if both assign the BPF
+// devices to different groups, each will undo the other's work on every boot. This package allows
+// tlconfig and config-bpf to notice this and either share the other utility's group or report the
+// conflict.
+package chmodbpf
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strconv"
+	"syscall"
+)
+
+// A Daemon is a known utility which configures the BPF devices.
+type Daemon struct {
+	// Name is a human-readable name for the daemon.
+	Name string
+
+	// Plist is the path to the daemon's launchd plist file. The daemon is considered installed if
+	// this file exists.
+	Plist string
+
+	// Group is the group to which the daemon assigns the BPF devices.
+	Group string
+}
+
+func (d Daemon) String() string {
+	return fmt.Sprintf("%s (%s)", d.Name, d.Plist)
+}
+
+// KnownDaemons are the utilities we check for.
+var KnownDaemons = []Daemon{
+	{"Wireshark ChmodBPF", "/Library/LaunchDaemons/org.wireshark.ChmodBPF.plist", "access_bpf"},
+	{"Wireshark ChmodBPF (startup item)", "/Library/StartupItems/ChmodBPF", "access_bpf"},
+}
+
+// Groups with names matching this expression are assumed to have been created to grant access to
+// the BPF devices. We only consider adopting such groups; an arbitrary group found on the devices
+// (e.g. admin) is not something we want to assign to tlserver.
+var bpfGroupRegexp = regexp.MustCompile("(?i)bpf")
+
+// The device used to determine which group currently owns the BPF devices. This device always
+// exists when any BPF devices exist. Overridden in tests.
+var referenceDevice = "/dev/bpf0"
+
+// Policy determines how conflicts are handled.
+type Policy string
+
+const (
+	// Adopt the conflicting group: the BPF devices and tlserver are assigned to the group used by
+	// the other utility.
+	Adopt Policy = "adopt"
+
+	// Report the conflict, but leave devices assigned to the other utility's group alone.
+	Report Policy = "report"
+)
+
+// ParsePolicy parses a policy provided as a command-line flag.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case Adopt, Report:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown policy '%s'; expected %s or %s", s, Adopt, Report)
+	}
+}
+
+// A Conflict describes another utility assigning the BPF devices to a group other than ours.
+type Conflict struct {
+	// Daemon is the conflicting utility. This is nil if we could not identify the utility, but
+	// found the BPF devices assigned to a BPF-like group.
+	Daemon *Daemon
+
+	// Group is the group used by the other utility. This group is known to exist.
+	Group *user.Group
+}
+
+func (c Conflict) String() string {
+	if c.Daemon == nil {
+		return fmt.Sprintf("BPF devices are assigned to %s by an unknown utility", c.Group.Name)
+	}
+	return fmt.Sprintf("%v assigns BPF devices to %s", *c.Daemon, c.Group.Name)
+}
+
+// Detect looks for utilities assigning the BPF devices to a group other than ours. The conflict is
+// nil if no such utility is found. Known daemons installed and using our group are not conflicts,
+// but are returned as shared so that they can be reported: such a daemon also configures the
+// devices, and uninstalling it may affect tlserver.
+func Detect(ourGroup string) (conflict *Conflict, shared []Daemon, err error) {
+	shared = []Daemon{}
+	for i, d := range KnownDaemons {
+		if _, err := os.Stat(d.Plist); err != nil {
+			continue
+		}
+		if d.Group == ourGroup {
+			shared = append(shared, d)
+			continue
+		}
+		if conflict != nil {
+			continue
+		}
+		g, err := user.LookupGroup(d.Group)
+		if err != nil {
+			// The daemon is installed, but its group is not. It cannot be assigning the devices.
+			continue
+		}
+		conflict = &Conflict{&KnownDaemons[i], g}
+	}
+	if conflict != nil {
+		return conflict, shared, nil
+	}
+
+	info, err := os.Stat(referenceDevice)
+	if os.IsNotExist(err) {
+		return nil, shared, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to stat %s: %w", referenceDevice, err)
+	}
+	statT, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, nil, fmt.Errorf("failed to obtain detailed stat info for %s", referenceDevice)
+	}
+	if statT.Gid == 0 {
+		return nil, shared, nil
+	}
+	g, err := user.LookupGroupId(strconv.Itoa(int(statT.Gid)))
+	if err != nil {
+		// Not a group we can do anything with.
+		return nil, shared, nil
+	}
+	if g.Name == ourGroup || !bpfGroupRegexp.MatchString(g.Name) {
+		return nil, shared, nil
+	}
+	return &Conflict{nil, g}, shared, nil
+}
+
+// Installed returns the known daemons installed on this machine, regardless of the group they use.
+func Installed() []Daemon {
+	installed := []Daemon{}
+	for _, d := range KnownDaemons {
+		if _, err := os.Stat(d.Plist); err == nil {
+			installed = append(installed, d)
+		}
+	}
+	return installed
+}
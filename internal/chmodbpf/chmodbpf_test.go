@@ -0,0 +1,65 @@
+package chmodbpf
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetect(t *testing.T) {
+	dir := t.TempDir()
+	oldDaemons, oldDevice := KnownDaemons, referenceDevice
+	t.Cleanup(func() { KnownDaemons, referenceDevice = oldDaemons, oldDevice })
+
+	// The daemons' groups must exist, so we use our own group as the foreign group.
+	foreign, err := user.LookupGroupId(strconv.Itoa(os.Getgid()))
+	require.NoError(t, err)
+	const ourGroup = "access_bpf"
+
+	shared := Daemon{"Shared", filepath.Join(dir, "shared.plist"), ourGroup}
+	conflicting := Daemon{"Conflicting", filepath.Join(dir, "conflicting.plist"), foreign.Name}
+	KnownDaemons = []Daemon{shared, conflicting}
+	referenceDevice = filepath.Join(dir, "bpf0")
+
+	// Nothing installed.
+	conflict, sharing, err := Detect(ourGroup)
+	require.NoError(t, err)
+	require.Nil(t, conflict)
+	require.Empty(t, sharing)
+
+	// A daemon sharing our group is reported, but is not a conflict.
+	require.NoError(t, ioutil.WriteFile(shared.Plist, nil, 0644))
+	conflict, sharing, err = Detect(ourGroup)
+	require.NoError(t, err)
+	require.Nil(t, conflict)
+	require.Equal(t, []Daemon{shared}, sharing)
+
+	require.NoError(t, ioutil.WriteFile(conflicting.Plist, nil, 0644))
+	conflict, sharing, err = Detect(ourGroup)
+	require.NoError(t, err)
+	require.NotNil(t, conflict)
+	require.Equal(t, conflicting, *conflict.Daemon)
+	require.Equal(t, foreign.Gid, conflict.Group.Gid)
+	require.Equal(t, []Daemon{shared}, sharing)
+
+	// Having adopted the foreign group, the other daemon is no longer a conflict.
+	require.NoError(t, os.Remove(shared.Plist))
+	conflict, sharing, err = Detect(foreign.Name)
+	require.NoError(t, err)
+	require.Nil(t, conflict)
+	require.Equal(t, []Daemon{conflicting}, sharing)
+
+	// Devices in a group unrelated to BPF are not attributed to an unknown utility.
+	require.NoError(t, os.Remove(conflicting.Plist))
+	require.NoError(t, ioutil.WriteFile(referenceDevice, nil, 0644))
+	conflict, _, err = Detect(ourGroup)
+	require.NoError(t, err)
+	if !bpfGroupRegexp.MatchString(foreign.Name) {
+		require.Nil(t, conflict)
+	}
+}
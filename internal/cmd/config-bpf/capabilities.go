@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/exitcodes"
+)
+
+// On Linux, there are no BPF devices to configure. Instead, tlserver needs the capabilities below
+// to open capture handles. These are granted as file capabilities, which are lost whenever the
+// binary is replaced.
+const tlserverCapabilities = "cap_net_admin,cap_net_raw=eip"
+
+// Ensures that the tlserver binary has the capabilities needed for packet capture. In test mode, no
+// changes are made and an exitcodes.FailedCheckError is returned if the capabilities are missing.
+func configureCapabilities(tlserverPath string, testMode bool) error {
+	if tlserverPath == "" {
+		return exitcodes.ErrorBadInput("-tlserver must be provided on this platform", nil)
+	}
+	out, err := exec.Command("getcap", tlserverPath).Output()
+	if err != nil {
+		return fmt.Errorf("failed to run getcap: %w", err)
+	}
+	// getcap output looks like "/path/to/tlserver cap_net_admin,cap_net_raw=eip" (older versions
+	// use " = " as the separator).
+	current := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(out)), tlserverPath))
+	current = strings.TrimSpace(strings.TrimPrefix(current, "="))
+	if strings.ReplaceAll(current, " ", "") == tlserverCapabilities {
+		return nil
+	}
+	if testMode {
+		return exitcodes.ErrorFailedCheckf("%s does not have capabilities %s", tlserverPath, tlserverCapabilities)
+	}
+	out, err = exec.Command("setcap", tlserverCapabilities, tlserverPath).CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return fmt.Errorf("setcap failed: %s", strings.TrimSpace(string(out)))
+		}
+		return fmt.Errorf("failed to run setcap: %w", err)
+	}
+	fmt.Fprintf(os.Stdout, "assigned capabilities %s to %s\n", tlserverCapabilities, tlserverPath)
+	return nil
+}
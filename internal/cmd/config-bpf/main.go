@@ -1,5 +1,6 @@
-// Command config-bpf is used to configure the BPF devices on a machine. It is macOS-specific. In
-// the case of an error, the last line printed to stderr will describe the cause.
+// Command config-bpf is used to configure the BPF devices on a machine. On Linux, where there are no
+// BPF devices, it instead restores the file capabilities tlserver needs for packet capture. In the
+// case of an error, the last line printed to stderr will describe the cause.
 //
 // For context, tlserver needs access to the BPF devices to perform packet capture. We can configure
 // these devices accordingly, but this configuration is reset when the host restarts. Thus, this
@@ -10,22 +11,46 @@
 // the files should be provided to this utility as well so that we can manage their size. Otherwise,
 // launchd will allow them to grow unbounded.
 //
-// Much of the logic and reasoning is based on Wireshark's ChmodBPF utility.
+// Devices created by macOS after config-bpf runs (for instance, once the pre-created devices are
+// exhausted) will not have the expected group and permissions. Other tools may also reset the
+// configuration of existing devices. To handle this, config-bpf can be run with -watch, in which
+// case it keeps running after the initial configuration, periodically re-checking the devices and
+// correcting any drift. A check can also be triggered by sending SIGHUP. Each correction is logged
+// to stdout.
+//
+// If a state file is provided via -state, config-bpf records the original owner, group and mode of
+// each device before changing it. The file must be in a directory owned by root and writable only
+// by root. Running with -revert restores the recorded attributes and removes
+// the state file. This also happens automatically upon self-removal (see -sentinel).
+//
+// Much of the logic and reasoning is based on Wireshark's ChmodBPF utility. The devices are assigned
+// to the group given by -group, which must be the group assigned to tlserver. If ChmodBPF (or a
+// similar utility) is found assigning the devices to a different group, the conflict is reported
+// and devices assigned to the other group are left alone rather than fought over. config-bpf never
+// adopts the other group itself, as tlserver's group would not change with it; tlconfig does so on
+// install, if so configured, and passes the adopted group to config-bpf. Known utilities sharing
+// our group are reported for information.
 package main
 
 import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/getlantern/trafficlog-flashlight/internal/chmodbpf"
 	"github.com/getlantern/trafficlog-flashlight/internal/exitcodes"
 )
 
@@ -34,6 +59,11 @@ const (
 
 	// The maximum number of BPF devices we will create, subject to system constraints.
 	maxCreatedDevices = 256
+
+	// In watch mode, the stdout and stderr files are truncated when they grow beyond this size.
+	maxLogFileSize = 1024 * 1024
+
+	defaultWatchInterval = time.Minute
 )
 
 var (
@@ -41,7 +71,17 @@ var (
 	stdoutFile = flag.String("stdout", "", "path to the launchd stdout file for this utility")
 	stderrFile = flag.String("stderr", "", "path to the launchd stderr file for this utility")
 	plistFile  = flag.String("plist", "", "path to the launchd plist file")
-	sentinel   = flag.String("sentinel", "", "if sentinel does not exist and plist was provided, config-bpf removes itself")
+	unitFile   = flag.String("unit", "", "path to the systemd unit file (Linux only)")
+	sentinel   = flag.String("sentinel", "", "if sentinel does not exist and plist or unit was provided, config-bpf removes itself")
+	tlserver   = flag.String("tlserver", "", "path to the tlserver binary; used to restore capabilities on Linux")
+
+	stateFile  = flag.String("state", "", "file in which to record original device attributes, for use by -revert; the directory must be writable only by root")
+	revertMode = flag.Bool("revert", false, "restore devices to the attributes recorded in the state file, then exit")
+
+	group = flag.String("group", bpfGroup, "group to which the devices are assigned; must be tlserver's group")
+
+	watchMode     = flag.Bool("watch", false, "keep running, correcting device configuration as it drifts")
+	watchInterval = flag.Duration("watch-interval", defaultWatchInterval, "time between checks in watch mode")
 
 	bpfDeviceRegexp = regexp.MustCompile("^/dev/bpf([0-9]+)$")
 )
@@ -73,49 +113,13 @@ func triggerNextBPFDevice(currentDevice int) error {
 	return nil
 }
 
-func main() {
-	flag.Parse()
-
-	// If the stdout and stderr files have been provided, clear old data by truncating.
-	if *stderrFile != "" {
-		if _, err := os.Create(*stderrFile); err != nil {
-			fmt.Fprintln(os.Stderr, "failed to truncate stderr file")
-		}
-	}
-	if *stdoutFile != "" {
-		if _, err := os.Create(*stdoutFile); err != nil {
-			fmt.Fprintln(os.Stderr, "failed to truncate stdout file")
-		}
-	}
-
-	if *sentinel != "" && *plistFile != "" {
-		if _, err := os.Stat(*sentinel); os.IsNotExist(err) {
-			fmt.Fprintln(os.Stderr, "sentinel missing; performing self-removal and deleting plist file")
-			if err := os.Remove(*plistFile); err != nil {
-				fmt.Fprintln(os.Stderr, "failed to remove plist file:", err)
-			}
-			if err := os.Remove(os.Args[0]); err != nil {
-				fmt.Fprintln(os.Stderr, "failed to remove self:", err)
-			}
-			os.Exit(0)
-		}
-	}
-
-	g, err := user.LookupGroup(bpfGroup)
-	if err != nil {
-		exitcodes.ExitWith(fmt.Errorf("failed to look up %s: %w", bpfGroup, err))
-	}
-	bpfGID, err := strconv.Atoi(g.Gid)
-	if err != nil {
-		exitcodes.ExitWith(fmt.Errorf("failed to parse %s GID: %v", bpfGroup, err))
-	}
-
-	// Pre-create BPF devices so that we can assign the group and permissions we'd like. The logic
-	// and reasoning is based on Wireshark's ChmodBPF utility.
-	//
-	// We create devices on a best-effort basis, ignoring most errors that we might come across.
+// Pre-create BPF devices so that we can assign the group and permissions we'd like. The logic and
+// reasoning is based on Wireshark's ChmodBPF utility.
+//
+// We create devices on a best-effort basis, ignoring most errors that we might come across.
+func createDevices() error {
 	startDevice := 0
-	err = filepath.Walk("/dev", func(path string, info os.FileInfo, err error) error {
+	err := filepath.Walk("/dev", func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
@@ -131,27 +135,24 @@ func main() {
 		return nil
 	})
 	if err != nil {
-		exitcodes.ExitWith(fmt.Errorf("failed to walk /dev: %w", err))
+		return fmt.Errorf("failed to walk /dev: %w", err)
 	}
 	endDevice, err := getMaxBPFDevices()
 	if err != nil {
-		exitcodes.ExitWith(fmt.Errorf("unable to determine max BPF devices: %w", err))
+		return fmt.Errorf("unable to determine max BPF devices: %w", err)
 	}
-	if !*testMode {
-		// Note that we don't check the number of devices in test mode. A failed check may trigger a
-		// re-install, which in turn prompts the user. Thus we want to avoid returning failed check
-		// codes unless we have to, and it is not strictly required that all of these devices exist.
-		for i := startDevice; i < endDevice-1; i++ {
-			if err := triggerNextBPFDevice(i); err != nil {
-				// This error does not mean we should abandon the configuration process, but it does
-				// mean that attempts to create further devices will also fail.
-				fmt.Fprintf(os.Stderr, "failed to create device %d: %v\n", i+1, err)
-				break
-			}
+	for i := startDevice; i < endDevice-1; i++ {
+		if err := triggerNextBPFDevice(i); err != nil {
+			// This error does not mean we should abandon the configuration process, but it does
+			// mean that attempts to create further devices will also fail.
+			fmt.Fprintf(os.Stderr, "failed to create device %d: %v\n", i+1, err)
+			break
 		}
 	}
+	return nil
+}
 
-	// Assign all BPF devices to the BPF group and ensure that all have group read permissions.
+func listDevices() ([]string, error) {
 	bpfDevices := []string{}
 	walkFn := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
@@ -166,36 +167,293 @@ func main() {
 		return nil
 	}
 	if err := filepath.Walk("/dev", walkFn); err != nil {
-		exitcodes.ExitWith(fmt.Errorf("failed to walk /dev: %w", err))
+		return nil, fmt.Errorf("failed to walk /dev: %w", err)
 	}
 	if len(bpfDevices) == 0 {
-		exitcodes.ExitWith(errors.New("found no BPF devices"))
+		return nil, errors.New("found no BPF devices")
+	}
+	return bpfDevices, nil
+}
+
+// deviceGroup describes the group to which BPF devices are assigned.
+type deviceGroup struct {
+	name string
+	gid  int
+
+	// Devices assigned to this group are left alone. This is -1 unless we have found a conflicting
+	// utility.
+	foreignGID int
+
+	// Describe the conflict and any known utilities sharing the group, one per line.
+	conflict, shared string
+}
+
+// Reports the conflict and the known utilities sharing the group, if any.
+func (g deviceGroup) report(w io.Writer) {
+	for _, s := range []string{g.conflict, g.shared} {
+		if s != "" {
+			fmt.Fprintln(w, s)
+		}
+	}
+}
+
+// Determines how the BPF devices should be assigned to the named group. If another utility (like
+// Wireshark's ChmodBPF) is assigning the devices to a different group, the devices it manages are
+// left alone.
+func resolveGroup(name string) (*deviceGroup, error) {
+	conflict, shared, err := chmodbpf.Detect(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for conflicting BPF utilities: %w", err)
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up %s: %w", name, err)
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s GID: %v", g.Name, err)
+	}
+	dg := &deviceGroup{name: g.Name, gid: gid, foreignGID: -1}
+	if conflict != nil {
+		dg.conflict = fmt.Sprintf("conflict: %v; leaving devices in %s unchanged", conflict, conflict.Group.Name)
+		if dg.foreignGID, err = strconv.Atoi(conflict.Group.Gid); err != nil {
+			return nil, fmt.Errorf("failed to parse %s GID: %v", conflict.Group.Name, err)
+		}
+	}
+	sharedDescs := []string{}
+	for _, d := range shared {
+		sharedDescs = append(sharedDescs, fmt.Sprintf("%v also assigns BPF devices to %s", d, d.Group))
+	}
+	dg.shared = strings.Join(sharedDescs, "\n")
+	return dg, nil
+}
+
+// Assign all BPF devices to the BPF group and ensure that all have group read permissions. A
+// description of each change made is returned. In test mode, no changes are made and the first
+// device found to be misconfigured results in an exitcodes.FailedCheckError.
+//
+// If state is non-nil, the original attributes of each device are recorded before it is changed.
+func configureDevices(g deviceGroup, state *deviceState, testMode bool) (corrections []string, err error) {
+	bpfDevices, err := listDevices()
+	if err != nil {
+		return nil, err
+	}
+	if state != nil && !testMode {
+		for _, dev := range bpfDevices {
+			devInfo, err := os.Stat(dev)
+			if err != nil {
+				return nil, fmt.Errorf("failed to stat %s: %w", dev, err)
+			}
+			if err := state.record(dev, devInfo); err != nil {
+				return nil, fmt.Errorf("failed to record state of %s: %w", dev, err)
+			}
+		}
+		if err := state.save(); err != nil {
+			return nil, err
+		}
 	}
 	for _, dev := range bpfDevices {
 		devInfo, err := os.Stat(dev)
 		if err != nil {
-			exitcodes.ExitWith(fmt.Errorf("failed to stat %s: %w", dev, err))
+			return corrections, fmt.Errorf("failed to stat %s: %w", dev, err)
 		}
 		devStatT, ok := devInfo.Sys().(*syscall.Stat_t)
 		if !ok {
-			exitcodes.ExitWith(fmt.Errorf("failed to obtain detailed stat info for %v", dev))
+			return corrections, fmt.Errorf("failed to obtain detailed stat info for %v", dev)
+		}
+		if g.foreignGID >= 0 && int(devStatT.Gid) == g.foreignGID {
+			// Assigned to a conflicting utility's group, which we have been told to leave alone.
+			continue
 		}
-		if int(devStatT.Gid) != bpfGID {
-			if *testMode {
-				exitcodes.ExitWith(exitcodes.ErrorFailedCheckf("%s not owned by %s", dev, bpfGroup))
+		if int(devStatT.Gid) != g.gid {
+			if testMode {
+				return nil, exitcodes.ErrorFailedCheckf("%s not owned by %s", dev, g.name)
 			}
-			if err := os.Chown(dev, -1, bpfGID); err != nil {
-				exitcodes.ExitWith(fmt.Errorf("failed to assign %s to %s: %w", dev, bpfGroup, err))
+			if err := os.Chown(dev, -1, g.gid); err != nil {
+				return corrections, fmt.Errorf("failed to assign %s to %s: %w", dev, g.name, err)
 			}
+			corrections = append(corrections,
+				fmt.Sprintf("changed group of %s from %d to %s (%d)", dev, devStatT.Gid, g.name, g.gid))
 		}
 		var groupRead os.FileMode = 0b100000
 		if devInfo.Mode()&groupRead != groupRead {
-			if *testMode {
-				exitcodes.ExitWith(exitcodes.ErrorFailedCheckf("%s does not have group read", dev))
+			if testMode {
+				return nil, exitcodes.ErrorFailedCheckf("%s does not have group read", dev)
 			}
 			if err := os.Chmod(dev, devInfo.Mode()|groupRead); err != nil {
-				exitcodes.ExitWith(fmt.Errorf("failed to assign group read to %s: %w", dev, err))
+				return corrections, fmt.Errorf("failed to assign group read to %s: %w", dev, err)
+			}
+			corrections = append(corrections,
+				fmt.Sprintf("changed mode of %s from %v to %v", dev, devInfo.Mode(), devInfo.Mode()|groupRead))
+		}
+	}
+	return corrections, nil
+}
+
+// If the sentinel file is missing, reverts the BPF devices, removes the plist (or unit) file and
+// this binary, then exits.
+func checkSentinel() {
+	if *sentinel == "" || (*plistFile == "" && *unitFile == "") {
+		return
+	}
+	if _, err := os.Stat(*sentinel); os.IsNotExist(err) {
+		fmt.Fprintln(os.Stderr, "sentinel missing; performing self-removal")
+		if err := revertDevices(); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to revert BPF devices:", err)
+		}
+		if *plistFile != "" {
+			if err := os.Remove(*plistFile); err != nil {
+				fmt.Fprintln(os.Stderr, "failed to remove plist file:", err)
 			}
 		}
+		if *unitFile != "" {
+			// Removes the symlinks created when the unit was enabled.
+			exec.Command("systemctl", "disable", filepath.Base(*unitFile)).Run()
+			if err := os.Remove(*unitFile); err != nil {
+				fmt.Fprintln(os.Stderr, "failed to remove unit file:", err)
+			}
+		}
+		if err := os.Remove(os.Args[0]); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to remove self:", err)
+		}
+		os.Exit(0)
+	}
+}
+
+// Restores the BPF devices to the state recorded in the state file, if one was provided.
+func revertDevices() error {
+	if *stateFile == "" {
+		return nil
+	}
+	state, err := loadState(*stateFile)
+	if err != nil {
+		return err
+	}
+	return state.revert()
+}
+
+// Truncates the file if it has grown beyond maxLogFileSize. Used to keep the launchd stdout and
+// stderr files bounded when running in watch mode.
+func capLogFile(path string) {
+	if path == "" {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() <= maxLogFileSize {
+		return
+	}
+	if err := os.Truncate(path, 0); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to truncate %s: %v\n", path, err)
+	}
+}
+
+// Re-checks the BPF devices every watchInterval, or immediately upon SIGHUP. Any drift from the
+// expected configuration is corrected and logged. Errors are logged, but do not stop the watch.
+// Conflicts with other utilities are logged as they arise.
+func watch(g deviceGroup, state *deviceState) {
+	logger := log.New(os.Stdout, "", log.LstdFlags)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(*watchInterval)
+	defer ticker.Stop()
+	logger.Printf("watching BPF devices; checking every %v", *watchInterval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-hup:
+			logger.Println("received SIGHUP; re-checking BPF devices")
+		}
+		checkSentinel()
+		capLogFile(*stdoutFile)
+		capLogFile(*stderrFile)
+
+		// Another utility may have been installed (or removed) since the last check.
+		newG, err := resolveGroup(g.name)
+		if err != nil {
+			logger.Println("failed to determine BPF group:", err)
+			continue
+		}
+		if *newG != g {
+			if newG.conflict == "" && g.conflict != "" {
+				logger.Println("conflict resolved:", g.conflict)
+			}
+			newG.report(logger.Writer())
+			g = *newG
+		}
+
+		corrections, err := configureDevices(g, state, false)
+		for _, c := range corrections {
+			logger.Println(c)
+		}
+		if err != nil {
+			logger.Println("failed to configure BPF devices:", err)
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
+
+	// If the stdout and stderr files have been provided, clear old data by truncating.
+	if *stderrFile != "" {
+		if _, err := os.Create(*stderrFile); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to truncate stderr file")
+		}
+	}
+	if *stdoutFile != "" {
+		if _, err := os.Create(*stdoutFile); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to truncate stdout file")
+		}
+	}
+
+	if *revertMode {
+		if *stateFile == "" {
+			exitcodes.ExitWith(exitcodes.ErrorBadInput("-revert requires -state", nil))
+		}
+		if err := revertDevices(); err != nil {
+			exitcodes.ExitWith(fmt.Errorf("failed to revert BPF devices: %w", err))
+		}
+		return
+	}
+
+	checkSentinel()
+
+	if runtime.GOOS == "linux" {
+		if err := configureCapabilities(*tlserver, *testMode); err != nil {
+			exitcodes.ExitWith(err)
+		}
+		return
+	}
+
+	var state *deviceState
+	if *stateFile != "" && !*testMode {
+		var err error
+		if state, err = loadState(*stateFile); err != nil {
+			exitcodes.ExitWith(fmt.Errorf("failed to load state: %w", err))
+		}
+	}
+
+	g, err := resolveGroup(*group)
+	if err != nil {
+		exitcodes.ExitWith(err)
+	}
+	// Reported on stdout so that it appears in tlconfig's output without being mistaken for the
+	// cause of a failure.
+	g.report(os.Stdout)
+
+	if !*testMode {
+		// Note that we don't check the number of devices in test mode. A failed check may trigger a
+		// re-install, which in turn prompts the user. Thus we want to avoid returning failed check
+		// codes unless we have to, and it is not strictly required that all of these devices exist.
+		if err := createDevices(); err != nil {
+			exitcodes.ExitWith(err)
+		}
+	}
+	if _, err := configureDevices(*g, state, *testMode); err != nil {
+		exitcodes.ExitWith(err)
+	}
+	if *watchMode && !*testMode {
+		watch(*g, state)
 	}
 }
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// deviceAttrs are the attributes of a BPF device which config-bpf may change.
+type deviceAttrs struct {
+	UID, GID int
+	Mode     os.FileMode
+}
+
+func attrsOf(info os.FileInfo) (*deviceAttrs, error) {
+	statT, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, errors.New("failed to obtain detailed stat info")
+	}
+	return &deviceAttrs{int(statT.Uid), int(statT.Gid), info.Mode()}, nil
+}
+
+// deviceState records the attributes of each BPF device as they were before config-bpf first
+// changed them. This allows the devices to be returned to their original state on uninstall.
+//
+// The state file is only written by config-bpf, running as root. Because the revert mode changes
+// device ownership based on the contents of this file, it must be kept in a directory owned by root
+// and writable only by root. The file is opened without following symbolic links, and we refuse to
+// use a file which is not owned by root or which can be written by anyone else.
+type deviceState struct {
+	Devices map[string]deviceAttrs
+
+	path    string
+	changed bool
+}
+
+// Checks that the directory containing the state file is owned by root and writable only by root.
+func checkStateDir(path string) error {
+	dir := filepath.Dir(path)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to stat state file directory: %w", err)
+	}
+	attrs, err := attrsOf(info)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() || attrs.UID != 0 || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("refusing to use state file directory %s: must be owned by root and writable only by root", dir)
+	}
+	return nil
+}
+
+// Checks that the opened state file is a regular file owned by root and writable only by root.
+func checkStateFile(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat state file: %w", err)
+	}
+	attrs, err := attrsOf(info)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || attrs.UID != 0 || info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("refusing to use state file %s: must be a regular file owned by root and writable only by root", f.Name())
+	}
+	return nil
+}
+
+// loadState loads the state file at the input path. If the file does not exist, an empty state is
+// returned.
+func loadState(path string) (*deviceState, error) {
+	s := &deviceState{Devices: map[string]deviceAttrs{}, path: path}
+	if err := checkStateDir(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state file: %w", err)
+	}
+	defer f.Close()
+	if err := checkStateFile(f); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("failed to decode state file: %w", err)
+	}
+	for dev := range s.Devices {
+		if !bpfDeviceRegexp.MatchString(dev) {
+			return nil, fmt.Errorf("state file contains unexpected path %s", dev)
+		}
+	}
+	return s, nil
+}
+
+// record the attributes of the device, unless attributes have already been recorded for it.
+func (s *deviceState) record(dev string, info os.FileInfo) error {
+	if _, ok := s.Devices[dev]; ok {
+		return nil
+	}
+	attrs, err := attrsOf(info)
+	if err != nil {
+		return err
+	}
+	s.Devices[dev] = *attrs
+	s.changed = true
+	return nil
+}
+
+// save the state file if anything new has been recorded.
+func (s *deviceState) save() error {
+	if !s.changed {
+		return nil
+	}
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	if err := checkStateDir(s.path); err != nil {
+		return err
+	}
+	// The file is only truncated once we know it is ours.
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|syscall.O_NOFOLLOW, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open state file: %w", err)
+	}
+	if err := checkStateFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to truncate state file: %w", err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	s.changed = false
+	return nil
+}
+
+// revert each recorded device to its original attributes, then delete the state file. Devices
+// which no longer exist are skipped; devices created by config-bpf cannot be removed, but are
+// returned to the attributes they had on creation.
+func (s *deviceState) revert() error {
+	devs := make([]string, 0, len(s.Devices))
+	for dev := range s.Devices {
+		devs = append(devs, dev)
+	}
+	sort.Strings(devs)
+
+	var numErrors int
+	for _, dev := range devs {
+		attrs := s.Devices[dev]
+		if _, err := os.Stat(dev); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Chown(dev, attrs.UID, attrs.GID); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to restore ownership of %s: %v\n", dev, err)
+			numErrors++
+			continue
+		}
+		if err := os.Chmod(dev, attrs.Mode); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to restore mode of %s: %v\n", dev, err)
+			numErrors++
+		}
+	}
+	if numErrors > 0 {
+		return fmt.Errorf("failed to revert %d devices", numErrors)
+	}
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove state file: %w", err)
+	}
+	return nil
+}
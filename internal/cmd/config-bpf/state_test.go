@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceState(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("state files must be owned by root")
+	}
+	dir := filepath.Join(t.TempDir(), "state")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	path := filepath.Join(dir, "config-bpf.state")
+
+	s, err := loadState(path)
+	require.NoError(t, err)
+	require.Empty(t, s.Devices)
+
+	// Devices are recorded once, as they were before the first change.
+	dev := filepath.Join(dir, "bpf0")
+	require.NoError(t, ioutil.WriteFile(dev, nil, 0600))
+	info, err := os.Stat(dev)
+	require.NoError(t, err)
+	require.NoError(t, s.record(dev, info))
+	require.NoError(t, os.Chmod(dev, 0660))
+	info, err = os.Stat(dev)
+	require.NoError(t, err)
+	require.NoError(t, s.record(dev, info))
+	require.Equal(t, os.FileMode(0600), s.Devices[dev].Mode)
+	require.NoError(t, s.save())
+
+	require.NoError(t, s.revert())
+	info, err = os.Stat(dev)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	// Only /dev/bpf* devices are accepted on load.
+	s.changed = true
+	require.NoError(t, s.save())
+	_, err = loadState(path)
+	require.Error(t, err)
+	s.Devices = map[string]deviceAttrs{"/dev/bpf1": {0, 0, 0600}}
+	s.changed = true
+	require.NoError(t, s.save())
+	loaded, err := loadState(path)
+	require.NoError(t, err)
+	require.Equal(t, s.Devices, loaded.Devices)
+
+	// State files which others could have written are refused, as are symbolic links.
+	require.NoError(t, os.Chmod(path, 0666))
+	_, err = loadState(path)
+	require.Error(t, err)
+	require.NoError(t, os.Chmod(path, 0644))
+
+	link := filepath.Join(dir, "link.state")
+	require.NoError(t, os.Symlink(path, link))
+	_, err = loadState(link)
+	require.Error(t, err)
+	s.path, s.changed = link, true
+	require.Error(t, s.save())
+
+	require.NoError(t, os.Chmod(dir, 0777))
+	_, err = loadState(path)
+	require.Error(t, err)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/exitcodes"
+	"github.com/getlantern/trafficlog-flashlight/internal/plist"
+)
+
+// The config-bpf utility is installed as a global daemon. The job is defined according to arguments
+// provided at runtime, then written to a plist file in configBPFPlistDir.
+//
+// config-bpf runs in watch mode, correcting devices as they drift from the expected configuration.
+// launchd restarts it if it dies, but not if it exits cleanly, as it does upon self-removal.
+func configBPFLaunchdJob(configBPFAbsPath, plistFile, sentinel, outDir, group string) plist.Dict {
+	stdout := filepath.Join(outDir, "config-bpf.stdout")
+	stderr := filepath.Join(outDir, "config-bpf.stderr")
+	return plist.Dict{
+		"Label": configBPFLaunchdLabel,
+		"ProgramArguments": []string{
+			configBPFAbsPath,
+			"-stdout", stdout,
+			"-stderr", stderr,
+			"-plist", plistFile,
+			"-sentinel", sentinel,
+			"-state", configBPFStateFile,
+			"-group", group,
+			"-watch",
+		},
+		"RunAtLoad":         true,
+		"KeepAlive":         plist.Dict{"SuccessfulExit": false},
+		"StandardOutPath":   stdout,
+		"StandardErrorPath": stderr,
+	}
+}
+
+// Writes (or, in test mode, checks) config-bpf's launchd plist file in plistDir.
+func registerLaunchdJob(configBPFAbsPath, plistDir, sentinel, installDir, group string, testMode bool) error {
+	plistFile := fmt.Sprintf("%s/%s.plist", plistDir, configBPFLaunchdLabel)
+	job := configBPFLaunchdJob(configBPFAbsPath, plistFile, sentinel, installDir, group)
+	if testMode {
+		return checkLaunchdJob(plistFile, job)
+	}
+	if err := writeLaunchdJob(plistFile, job); err != nil {
+		return fmt.Errorf("failed to write config-bpf's launchd file: %w", err)
+	}
+	// Start (or restart) the watcher now rather than waiting for the next boot. This is only done
+	// for the default plist directory; other directories are used for testing and we do not want to
+	// register test daemons with launchd.
+	if plistDir == configBPFPlistDirDefault {
+		if err := loadLaunchdJob(plistFile); err != nil {
+			return fmt.Errorf("failed to load config-bpf's launchd file: %w", err)
+		}
+	}
+	return nil
+}
+
+func writeLaunchdJob(plistFile string, job plist.Dict) error {
+	b, err := plist.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to encode plist: %w", err)
+	}
+	return ioutil.WriteFile(plistFile, b, 0644)
+}
+
+// Checks the existing plist file against the expected job definition. The comparison is semantic:
+// formatting and key order are ignored, as are differences between equivalent paths. A
+// FailedCheckError naming the first differing key is returned if the job definitions differ.
+func checkLaunchdJob(plistFile string, expected plist.Dict) error {
+	b, err := ioutil.ReadFile(plistFile)
+	if os.IsNotExist(err) {
+		return exitcodes.ErrorFailedCheck("no launchd file found for config-bpf")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read existing launchd file for config-bpf: %w", err)
+	}
+	decoded, err := plist.Unmarshal(b)
+	if err != nil {
+		return exitcodes.ErrorFailedCheckf("failed to parse existing launchd file for config-bpf: %v", err)
+	}
+	actual, ok := decoded.(plist.Dict)
+	if !ok {
+		return exitcodes.ErrorFailedCheck("existing launchd file for config-bpf is not a dictionary")
+	}
+	if err := compareDicts(expected, actual); err != nil {
+		return exitcodes.ErrorFailedCheckf("existing launchd file for config-bpf differs from expected: %v", err)
+	}
+	return nil
+}
+
+// Compares the dictionaries key by key, returning an error describing the first difference.
+func compareDicts(expected, actual plist.Dict) error {
+	keys := []string{}
+	for k := range expected {
+		keys = append(keys, k)
+	}
+	for k := range actual {
+		if _, ok := expected[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		e, inExpected := expected[k]
+		a, inActual := actual[k]
+		switch {
+		case !inActual:
+			return fmt.Errorf("missing key %s", k)
+		case !inExpected:
+			return fmt.Errorf("unexpected key %s", k)
+		case !reflect.DeepEqual(normalizePlistValue(e), normalizePlistValue(a)):
+			return fmt.Errorf("%s: expected %v, found %v", k, e, a)
+		}
+	}
+	return nil
+}
+
+// Normalizes values for comparison: integers are widened, string arrays are converted to generic
+// arrays (as produced by plist.Unmarshal) and absolute paths are cleaned.
+func normalizePlistValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, "/") {
+			return filepath.Clean(v)
+		}
+		return v
+	case int:
+		return int64(v)
+	case []string:
+		normalized := make([]interface{}, len(v))
+		for i, s := range v {
+			normalized[i] = normalizePlistValue(s)
+		}
+		return normalized
+	case []interface{}:
+		normalized := make([]interface{}, len(v))
+		for i, elem := range v {
+			normalized[i] = normalizePlistValue(elem)
+		}
+		return normalized
+	case plist.Dict:
+		normalized := plist.Dict{}
+		for k, elem := range v {
+			normalized[k] = normalizePlistValue(elem)
+		}
+		return normalized
+	case map[string]interface{}:
+		return normalizePlistValue(plist.Dict(v))
+	default:
+		return v
+	}
+}
+
+// Loads the job defined by the plist file, replacing any running instance.
+func loadLaunchdJob(plistFile string) error {
+	// Unloading fails if the job is not loaded; this is expected on first install.
+	exec.Command("launchctl", "unload", plistFile).Run()
+	if _, err := exec.Command("launchctl", "load", "-w", plistFile).Output(); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/exitcodes"
+	"github.com/getlantern/trafficlog-flashlight/internal/plist"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckLaunchdJob(t *testing.T) {
+	dir := t.TempDir()
+	plistFile := filepath.Join(dir, configBPFLaunchdLabel+".plist")
+	job := configBPFLaunchdJob("/install/config-bpf", plistFile, "/sentinel", "/install", "access_bpf")
+
+	require.IsType(t, &exitcodes.FailedCheckError{}, checkLaunchdJob(plistFile, job))
+
+	require.NoError(t, writeLaunchdJob(plistFile, job))
+	require.NoError(t, checkLaunchdJob(plistFile, job))
+
+	// Equivalent paths and different formatting should not fail the check.
+	equivalent := configBPFLaunchdJob("/install//config-bpf", plistFile, "/sentinel/", "/install/.", "access_bpf")
+	b, err := plist.Marshal(equivalent)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(plistFile, b, 0644))
+	require.NoError(t, checkLaunchdJob(plistFile, job))
+
+	different := configBPFLaunchdJob("/install/config-bpf", plistFile, "/sentinel", "/install", "other_bpf")
+	err = checkLaunchdJob(plistFile, different)
+	require.IsType(t, &exitcodes.FailedCheckError{}, err)
+	require.Contains(t, err.Error(), "ProgramArguments")
+}
@@ -2,7 +2,8 @@
 // configured for packet capture. This includes:
 //	- Configuring proper ownership and permissions for the tlserver and config-bpf binaries.
 //	- Running config-bpf.
-//	- Setting up config-bpf as a launchd global daemon so that it will run on startup as root.
+//	- Setting up config-bpf as a launchd global daemon so that it will run on startup as root and
+//	  keep watching the BPF devices thereafter.
 //
 // Three arguments are expected:
 //  1) The path to the installation directory.
@@ -12,8 +13,16 @@
 //     itself and its plist file on its next run.
 //  4) The user for which tlserver is being installed.
 //
-// Currently macOS only. In the case of an error, the last line printed to stderr will describe the
-// cause. Root permissions are required.
+// If another utility, such as Wireshark's ChmodBPF, is found assigning the BPF devices to a different
+// group, tlconfig adopts that group for tlserver by default. See the -on-conflict flag.
+//
+// On Linux, config-bpf is instead registered as a systemd oneshot service, run at boot to restore
+// tlserver's packet-capture capabilities. tlproc.Install does not support Linux, so tlconfig must be
+// run directly, for example from a package's install script. tlconfig also writes the allow list
+// used by tlserver to authenticate peers, which requires the -peer-executable flag.
+//
+// In the case of an error, the last line printed to stderr will describe the cause. Root
+// permissions are required.
 package main
 
 import (
@@ -26,10 +35,12 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
 
+	"github.com/getlantern/trafficlog-flashlight/internal/chmodbpf"
 	"github.com/getlantern/trafficlog-flashlight/internal/exitcodes"
 	"github.com/getlantern/trafficlog-flashlight/internal/tlinstall"
 )
@@ -50,11 +61,20 @@ const (
 	configBPFPlistDirDefault = "/Library/LaunchDaemons"
 
 	configBPFLaunchdLabel = "org.getlantern.config-bpf"
+
+	// On Linux, config-bpf is installed as a systemd system service. As above, overriding the unit
+	// directory is useful for testing.
+	configBPFUnitDirDefault = "/etc/systemd/system"
+
+	configBPFSystemdUnitName = "org.getlantern.config-bpf.service"
 )
 
 var (
 	testMode          = flag.Bool("test", false, "make no changes, just check the current installation")
 	configBPFPlistDir = flag.String("config-bpf-plist-dir", configBPFPlistDirDefault, "directory containing the plist file")
+	configBPFUnitDir  = flag.String("config-bpf-unit-dir", configBPFUnitDirDefault, "directory containing the systemd unit file (Linux only)")
+	onConflict        = flag.String("on-conflict", string(chmodbpf.Adopt), "if another utility (e.g. Wireshark's ChmodBPF) manages the BPF devices: 'adopt' its group or 'report' the conflict")
+	peerExecutable    = flag.String("peer-executable", "", "executable allowed to connect to tlserver (required on Linux)")
 )
 
 func init() {
@@ -67,50 +87,27 @@ func init() {
 	}
 }
 
-// The config-bpf utility is installed as a global daemon. This template is filled according to
-// arguments provided at runtime, then placed in configBPFPlistDir.
-const configBPFLaunchdTmpl = `<?xml version="1.0" encoding="UTF-8"?>
-<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
-<plist version="1.0">
-	<dict>
-		<key>Label</key>
-		<string>%s</string>
-		<key>ProgramArguments</key>
-		<array>
-			<string>%s</string>
-			<string>-stdout</string>
-			<string>%s/config-bpf.stdout</string>
-			<string>-stderr</string>
-			<string>%s/config-bpf.stderr</string>
-			<string>-plist</string>
-			<string>%s</string>
-			<string>-sentinel</string>
-			<string>%s</string>
-		</array>
-		<key>RunAtLoad</key>
-		<true/>
-		<key>StandardOutPath</key>
-		<string>%s/config-bpf.stdout</string>
-		<key>StandardErrorPath</key>
-		<string>%s/config-bpf.stderr</string>
-	</dict>
-</plist>`
-
-func configBPFLaunchdPlistData(configBPFAbsPath, plist, sentinel, outDir string) []byte {
-	return []byte(fmt.Sprintf(configBPFLaunchdTmpl,
-		configBPFLaunchdLabel, configBPFAbsPath, outDir, outDir, plist, sentinel, outDir, outDir,
-	))
-}
+// config-bpf records the original state of the BPF devices in this file so that they can be
+// restored on uninstall. As config-bpf changes device ownership based on the file's contents, it
+// is kept in a root-owned directory rather than the install directory, which the user owns.
+const configBPFStateFile = "/var/db/org.getlantern.config-bpf.state"
 
 func createGroup(name string) (*user.Group, error) {
 	cmd := exec.Command("dseditgroup", "-o", "create", "-r", name, name)
+	if runtime.GOOS == "linux" {
+		cmd = exec.Command("groupadd", "--system", name)
+	}
 	// We use cmd.Output over cmd.Run to populate err.Stderr.
 	if _, err := cmd.Output(); err != nil {
 		return nil, err
 	}
 	g, err := user.LookupGroup(name)
 	if err != nil {
-		exec.Command("dseditgroup", "-o", "delete", name).Run()
+		if runtime.GOOS == "linux" {
+			exec.Command("groupdel", name).Run()
+		} else {
+			exec.Command("dseditgroup", "-o", "delete", name).Run()
+		}
 		return nil, fmt.Errorf("look up failed: %w", err)
 	}
 	return g, nil
@@ -247,7 +244,11 @@ func configureFile(info fileInfo, u user.User, g user.Group, perm os.FileMode, t
 	return nil
 }
 
-func configure(installDir, resourcesDir, plistDir, sentinel, username string, testMode bool) error {
+// The daemonDir is the directory in which config-bpf's launchd plist file (macOS) or systemd unit
+// file (Linux) is placed.
+//
+// On Linux, the peerExecutable is added to tlserver's peer allow list.
+func configure(installDir, resourcesDir, daemonDir, sentinel, username, peerExecutable string, policy chmodbpf.Policy, testMode bool) error {
 	rDir, err := tlinstall.NewResourcesDir(resourcesDir)
 	if err != nil {
 		return fmt.Errorf("failed to create resources dir reference: %w", err)
@@ -278,9 +279,28 @@ func configure(installDir, resourcesDir, plistDir, sentinel, username string, te
 		return fmt.Errorf("failed to look up superuser group (GID 0): %w", err)
 	}
 
+	// If another utility (like Wireshark's ChmodBPF) assigns the BPF devices to its own group, we
+	// either adopt that group or report the conflict. The group is adopted only here, where
+	// tlserver is assigned to it; config-bpf is given the resulting group and only reports
+	// conflicts arising later.
+	conflict, shared, err := chmodbpf.Detect(bpfGroup)
+	if err != nil {
+		return fmt.Errorf("failed to check for conflicting BPF utilities: %w", err)
+	}
+	if conflict != nil && policy == chmodbpf.Adopt {
+		fmt.Fprintf(os.Stdout, "%v; adopting %s\n", conflict, conflict.Group.Name)
+	} else if conflict != nil {
+		fmt.Fprintf(os.Stdout, "conflict: %v; tlserver may be unable to capture\n", conflict)
+	}
+	for _, d := range shared {
+		fmt.Fprintf(os.Stdout, "%v also assigns BPF devices to %s\n", d, d.Group)
+	}
+
 	// Create the BPF group.
 	g, err := user.LookupGroup(bpfGroup)
 	switch {
+	case conflict != nil && policy == chmodbpf.Adopt:
+		g = conflict.Group
 	case err == nil:
 		// Nothing to do.
 	case !errors.As(err, new(user.UnknownGroupError)):
@@ -351,38 +371,42 @@ func configure(installDir, resourcesDir, plistDir, sentinel, username string, te
 	// Run config-bpf. Though we will be registering this to run on login, we want the system to be
 	// properly configured when tlconfig completes.
 	var exitErr *exec.ExitError
-	path, args := configBPFInfo.path, []string{}
+	path, args := configBPFInfo.path, []string{"-state", configBPFStateFile}
 	if testMode {
 		// In test mode, we use the binary in the resources dir as we may not have executable
 		// permissions on the "standard" one.
 		path, args = rDir.ConfigBPF(), []string{"-test"}
 	}
+	args = append(args, "-group", g.Name)
+	if runtime.GOOS == "linux" {
+		args = append(args, "-tlserver", tlserverInfo.path)
+	}
 	out, err := exec.Command(path, args...).CombinedOutput()
+	if err == nil && len(out) > 0 {
+		// config-bpf reports conflicts with other utilities on stdout.
+		os.Stdout.Write(out)
+	}
 	if err != nil && errors.As(err, &exitErr) {
 		return exitcodes.ErrorFromCode(exitErr.ExitCode(), string(lastLine(out)))
 	} else if err != nil {
 		return fmt.Errorf("failed to run config-bpf: %w", err)
 	}
 
-	plistDir = strings.Replace(plistDir, "~", u.HomeDir, -1)
-	plistFilename := fmt.Sprintf("%s/%s.plist", plistDir, configBPFLaunchdLabel)
-	plistData := configBPFLaunchdPlistData(
-		configBPFInfo.path, plistFilename, sentinelInfo.path, installDir)
-	if testMode {
-		actualData, err := ioutil.ReadFile(plistFilename)
-		if os.IsNotExist(err) {
-			return exitcodes.ErrorFailedCheck("no launchd file found for config-bpf")
-		}
+	daemonDir = strings.Replace(daemonDir, "~", u.HomeDir, -1)
+	switch runtime.GOOS {
+	case "linux":
+		err = configurePeerAllowList(installDir, *u, peerExecutable, testMode)
 		if err != nil {
-			return fmt.Errorf("failed to read existing launchd file for config-bpf: %w", err)
-		}
-		if !bytes.Equal(plistData, actualData) {
-			return exitcodes.ErrorFailedCheck("existing launchd file for config-bpf differs from expected")
-		}
-	} else {
-		if err := ioutil.WriteFile(plistFilename, plistData, 0644); err != nil {
-			return fmt.Errorf("failed to write config-bpf's launchd file: %w", err)
+			return err
 		}
+		err = registerSystemdUnit(
+			configBPFInfo.path, tlserverInfo.path, daemonDir, sentinelInfo.path, testMode)
+	default:
+		err = registerLaunchdJob(
+			configBPFInfo.path, daemonDir, sentinelInfo.path, installDir, g.Name, testMode)
+	}
+	if err != nil {
+		return err
 	}
 
 	if outdatedErr != nil {
@@ -402,8 +426,25 @@ func main() {
 	if *configBPFPlistDir == "" {
 		*configBPFPlistDir = configBPFPlistDirDefault
 	}
+	if *configBPFUnitDir == "" {
+		*configBPFUnitDir = configBPFUnitDirDefault
+	}
+	daemonDir := *configBPFPlistDir
+	if runtime.GOOS == "linux" {
+		daemonDir = *configBPFUnitDir
+	}
+
+	policy, err := chmodbpf.ParsePolicy(*onConflict)
+	if err != nil {
+		exitcodes.ExitWith(exitcodes.ErrorBadInput("bad value for -on-conflict", err))
+	}
+	if runtime.GOOS == "linux" && *peerExecutable == "" {
+		// With no executable allowed, tlserver would reject every peer.
+		exitcodes.ExitWith(exitcodes.ErrorBadInput("-peer-executable is required on Linux", nil))
+	}
 
-	err := configure(installDir, resourcesDir, *configBPFPlistDir, sentinel, username, *testMode)
+	err = configure(
+		installDir, resourcesDir, daemonDir, sentinel, username, *peerExecutable, policy, *testMode)
 	if err != nil {
 		var exitErr *exec.ExitError
 		if errors.As(err, &exitErr) {
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/exitcodes"
+	"github.com/getlantern/trafficlog-flashlight/internal/peercred"
+)
+
+// On Linux, tlserver authenticates peers against an allow list in the install directory: peers
+// must be running as the installing user, from the peer executable. The allow list is owned by
+// root so that it cannot be altered by the user.
+//
+// The install directory is owned by the user, who may have left anything at the allow list's path.
+// The existing file is opened without following symbolic links and is only used if
+// peercred.CheckFile accepts it. Otherwise, a new file is created under a temporary name and
+// renamed into place, replacing whatever was there.
+func configurePeerAllowList(installDir string, u user.User, peerExecutable string, testMode bool) error {
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("failed to parse UID: %w", err)
+	}
+	hash, err := peercred.HashFile(peerExecutable)
+	if err != nil {
+		return exitcodes.ErrorBadInput("failed to hash peer executable", err)
+	}
+	allow := peercred.AllowList{UID: uid, SHA256: []string{hash}}
+	expected, err := allow.Encode()
+	if err != nil {
+		return err
+	}
+
+	path := peercred.Path(installDir)
+	checkErr := checkPeerAllowList(path, expected)
+	if testMode || checkErr == nil {
+		return checkErr
+	}
+	if failedCheckErr := new(exitcodes.FailedCheckError); !errors.As(checkErr, &failedCheckErr) {
+		return checkErr
+	}
+
+	// TempFile creates the file exclusively, so it cannot be a link planted by the user.
+	f, err := ioutil.TempFile(installDir, peercred.FileName+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create peer allow list: %w", err)
+	}
+	err = f.Chmod(0644)
+	if err == nil {
+		_, err = f.Write(expected)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write peer allow list: %w", err)
+	}
+	return nil
+}
+
+// Returns a FailedCheckError if the allow list at the input path is missing, unsafe to use or
+// differs from the expected contents.
+func checkPeerAllowList(path string, expected []byte) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if os.IsNotExist(err) {
+		return exitcodes.ErrorFailedCheckf("%s does not exist", path)
+	}
+	if errors.Is(err, syscall.ELOOP) {
+		return exitcodes.ErrorFailedCheckf("%s is a symbolic link", path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open peer allow list: %w", err)
+	}
+	defer f.Close()
+	if err := peercred.CheckFile(f); err != nil {
+		return exitcodes.ErrorFailedCheckf("%v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat peer allow list: %w", err)
+	}
+	if info.Mode().Perm() != 0644 {
+		return exitcodes.ErrorFailedCheckf("%s must have mode 0644", path)
+	}
+	current, err := ioutil.ReadAll(f)
+	if err != nil {
+		return fmt.Errorf("failed to read peer allow list: %w", err)
+	}
+	if !bytes.Equal(current, expected) {
+		return exitcodes.ErrorFailedCheckf("%s does not match the expected allow list", path)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/exitcodes"
+	"github.com/getlantern/trafficlog-flashlight/internal/peercred"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigurePeerAllowList(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the allow list must be owned by root")
+	}
+	dir := t.TempDir()
+	u, err := user.Current()
+	require.NoError(t, err)
+	exe, err := os.Executable()
+	require.NoError(t, err)
+
+	// A link planted at the allow list's path is replaced, not followed.
+	target := filepath.Join(dir, "target")
+	require.NoError(t, ioutil.WriteFile(target, []byte("target"), 0600))
+	path := peercred.Path(dir)
+	require.NoError(t, os.Symlink(target, path))
+	err = configurePeerAllowList(dir, *u, exe, true)
+	require.IsType(t, &exitcodes.FailedCheckError{}, err)
+
+	require.NoError(t, configurePeerAllowList(dir, *u, exe, false))
+	require.NoError(t, configurePeerAllowList(dir, *u, exe, true))
+	b, err := ioutil.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "target", string(b))
+	info, err := os.Lstat(path)
+	require.NoError(t, err)
+	require.True(t, info.Mode().IsRegular())
+	require.Equal(t, os.FileMode(0644), info.Mode().Perm())
+	_, err = peercred.Load(path)
+	require.NoError(t, err)
+
+	// As is a hard link.
+	require.NoError(t, os.Remove(path))
+	require.NoError(t, os.Link(target, path))
+	_, err = peercred.Load(path)
+	require.Error(t, err)
+	require.NoError(t, configurePeerAllowList(dir, *u, exe, false))
+	require.NoError(t, configurePeerAllowList(dir, *u, exe, true))
+	b, err = ioutil.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "target", string(b))
+}
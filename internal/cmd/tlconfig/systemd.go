@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/exitcodes"
+)
+
+// A systemdUnit is the content of a systemd unit file. Section and key order are preserved when
+// encoding, but ignored when comparing.
+type systemdUnit []unitSection
+
+type unitSection struct {
+	name    string
+	entries []unitEntry
+}
+
+type unitEntry struct {
+	key, value string
+}
+
+// The config-bpf utility is installed as a systemd service on Linux. Like the launchd job on macOS,
+// the service is defined according to arguments provided at runtime, then written to a unit file in
+// configBPFUnitDir.
+//
+// On Linux, config-bpf restores the capabilities tlserver needs for packet capture. The service is
+// a oneshot, run once at boot. As on macOS, it removes itself if the sentinel file disappears.
+func configBPFSystemdUnit(configBPFAbsPath, tlserverAbsPath, unitFile, sentinel string) systemdUnit {
+	execStart := joinExecArgs([]string{
+		configBPFAbsPath,
+		"-unit", unitFile,
+		"-sentinel", sentinel,
+		"-tlserver", tlserverAbsPath,
+	})
+	return systemdUnit{
+		{"Unit", []unitEntry{
+			{"Description", "Configures the host for packet capture by the Lantern traffic log"},
+			{"After", "local-fs.target"},
+		}},
+		{"Service", []unitEntry{
+			{"Type", "oneshot"},
+			{"ExecStart", execStart},
+		}},
+		{"Install", []unitEntry{
+			{"WantedBy", "multi-user.target"},
+		}},
+	}
+}
+
+func (u systemdUnit) encode() []byte {
+	buf := new(bytes.Buffer)
+	for i, section := range u {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		fmt.Fprintf(buf, "[%s]\n", section.name)
+		for _, e := range section.entries {
+			fmt.Fprintf(buf, "%s=%s\n", e.key, e.value)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Parses a unit file. Comments and blank lines are dropped; line continuations are not supported.
+func parseSystemdUnit(b []byte) (systemdUnit, error) {
+	u := systemdUnit{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", strings.HasPrefix(line, "#"), strings.HasPrefix(line, ";"):
+			continue
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			u = append(u, unitSection{name: strings.TrimSpace(line[1 : len(line)-1])})
+		case len(u) == 0:
+			return nil, fmt.Errorf("line %d: entry outside of section", lineNum)
+		default:
+			splits := strings.SplitN(line, "=", 2)
+			if len(splits) != 2 {
+				return nil, fmt.Errorf("line %d: expected key=value", lineNum)
+			}
+			section := &u[len(u)-1]
+			section.entries = append(section.entries, unitEntry{
+				strings.TrimSpace(splits[0]), strings.TrimSpace(splits[1]),
+			})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Keys whose values are command lines. These are compared as lists of arguments.
+var execKeys = map[string]bool{"ExecStart": true}
+
+// Flattens the unit into "[Section] Key" -> normalized value(s). Keys may appear multiple times
+// (e.g. After=), so values are accumulated in order.
+func (u systemdUnit) flatten() (map[string][]string, error) {
+	m := map[string][]string{}
+	for _, section := range u {
+		for _, e := range section.entries {
+			k := fmt.Sprintf("[%s] %s", section.name, e.key)
+			v, err := normalizeUnitValue(e.key, e.value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			m[k] = append(m[k], v)
+		}
+	}
+	return m, nil
+}
+
+// Collapses whitespace so that equivalent values compare equal. Command lines are split into
+// arguments, absolute paths among them are cleaned, and the arguments are quoted again.
+func normalizeUnitValue(key, v string) (string, error) {
+	if !execKeys[key] {
+		return strings.Join(strings.Fields(v), " "), nil
+	}
+	args, err := splitExecArgs(v)
+	if err != nil {
+		return "", err
+	}
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "/") {
+			args[i] = filepath.Clean(arg)
+		}
+	}
+	return joinExecArgs(args), nil
+}
+
+// Escapes special characters in command line arguments, as described in systemd.service(5):
+// backslashes and double quotes are escaped within the quotes, and specifiers and environment
+// variable references are escaped by doubling the % and $ characters.
+var execArgEscaper = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, "\n", `\n`, "\t", `\t`, "%", "%%", "$", "$$",
+)
+
+// Quotes each argument and joins them into a command line for use in an Exec key.
+func joinExecArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = `"` + execArgEscaper.Replace(arg) + `"`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// Splits a command line from an Exec key into its arguments, undoing quoting and escaping. Only
+// the escaping used by joinExecArgs is supported; specifiers and environment variable references
+// are rejected, as they cannot be compared without expanding them.
+func splitExecArgs(v string) ([]string, error) {
+	var (
+		args  = []string{}
+		arg   strings.Builder
+		inArg bool
+		quote rune
+	)
+	runes := []rune(v)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case c == '\\':
+			if i+1 == len(runes) {
+				return nil, errors.New("trailing backslash in command line")
+			}
+			i++
+			switch runes[i] {
+			case 'n':
+				arg.WriteRune('\n')
+			case 't':
+				arg.WriteRune('\t')
+			default:
+				arg.WriteRune(runes[i])
+			}
+			inArg = true
+		case c == '%' || c == '$':
+			if i+1 == len(runes) || runes[i+1] != c {
+				return nil, fmt.Errorf("unsupported %c expansion in command line", c)
+			}
+			i++
+			arg.WriteRune(c)
+			inArg = true
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+			inArg = true
+		case quote == 0 && unicode.IsSpace(c):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote in command line")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// Compares the units key by key, returning an error describing the first difference.
+func compareSystemdUnits(expected, actual systemdUnit) error {
+	e, err := expected.flatten()
+	if err != nil {
+		return err
+	}
+	a, err := actual.flatten()
+	if err != nil {
+		return err
+	}
+	for _, section := range expected {
+		for _, entry := range section.entries {
+			k := fmt.Sprintf("[%s] %s", section.name, entry.key)
+			if _, ok := a[k]; !ok {
+				return fmt.Errorf("missing key %s", k)
+			}
+			if strings.Join(e[k], "\n") != strings.Join(a[k], "\n") {
+				return fmt.Errorf("%s: expected %q, found %q", k, e[k], a[k])
+			}
+		}
+	}
+	for _, section := range actual {
+		for _, entry := range section.entries {
+			k := fmt.Sprintf("[%s] %s", section.name, entry.key)
+			if _, ok := e[k]; !ok {
+				return fmt.Errorf("unexpected key %s", k)
+			}
+		}
+	}
+	return nil
+}
+
+// Checks the existing unit file against the expected unit. As with the launchd plist file, the
+// comparison is semantic. A FailedCheckError naming the first differing key is returned if the
+// units differ.
+func checkSystemdUnit(unitFile string, expected systemdUnit) error {
+	b, err := ioutil.ReadFile(unitFile)
+	if os.IsNotExist(err) {
+		return exitcodes.ErrorFailedCheck("no systemd unit file found for config-bpf")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read existing systemd unit file for config-bpf: %w", err)
+	}
+	actual, err := parseSystemdUnit(b)
+	if err != nil {
+		return exitcodes.ErrorFailedCheckf("failed to parse existing systemd unit file for config-bpf: %v", err)
+	}
+	if err := compareSystemdUnits(expected, actual); err != nil {
+		return exitcodes.ErrorFailedCheckf("existing systemd unit file for config-bpf differs from expected: %v", err)
+	}
+	return nil
+}
+
+// Writes (or, in test mode, checks) config-bpf's systemd unit file in unitDir.
+func registerSystemdUnit(configBPFAbsPath, tlserverAbsPath, unitDir, sentinel string, testMode bool) error {
+	unitFile := filepath.Join(unitDir, configBPFSystemdUnitName)
+	unit := configBPFSystemdUnit(configBPFAbsPath, tlserverAbsPath, unitFile, sentinel)
+	if testMode {
+		return checkSystemdUnit(unitFile, unit)
+	}
+	if err := ioutil.WriteFile(unitFile, unit.encode(), 0644); err != nil {
+		return fmt.Errorf("failed to write config-bpf's systemd unit file: %w", err)
+	}
+	// As with launchd, we only register the service with systemd when using the default directory.
+	if unitDir == configBPFUnitDirDefault {
+		if _, err := exec.Command("systemctl", "daemon-reload").Output(); err != nil {
+			return fmt.Errorf("failed to reload systemd: %w", err)
+		}
+		if _, err := exec.Command("systemctl", "enable", configBPFSystemdUnitName).Output(); err != nil {
+			return fmt.Errorf("failed to enable config-bpf's systemd unit: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/exitcodes"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterSystemdUnit(t *testing.T) {
+	const configBPF, tlserver, sentinel = "/install/config-bpf", "/Lantern 100% \"beta\"/tlserver", "/sentinel"
+
+	dir := t.TempDir()
+	err := registerSystemdUnit(configBPF, tlserver, dir, sentinel, true)
+	require.IsType(t, &exitcodes.FailedCheckError{}, err)
+
+	require.NoError(t, registerSystemdUnit(configBPF, tlserver, dir, sentinel, false))
+	require.NoError(t, registerSystemdUnit(configBPF, tlserver, dir, sentinel, true))
+
+	// Comments, whitespace and equivalent paths should not fail the check.
+	unitFile := filepath.Join(dir, configBPFSystemdUnitName)
+	b, err := ioutil.ReadFile(unitFile)
+	require.NoError(t, err)
+	edited := "# Generated by tlconfig\n" + strings.Replace(
+		string(b), `ExecStart="`+configBPF+`"`, "ExecStart =  /install/./config-bpf ", 1)
+	require.NoError(t, ioutil.WriteFile(unitFile, []byte(edited), 0644))
+	require.NoError(t, registerSystemdUnit(configBPF, tlserver, dir, sentinel, true))
+
+	err = registerSystemdUnit(configBPF, tlserver, dir, "/other-sentinel", true)
+	require.IsType(t, &exitcodes.FailedCheckError{}, err)
+	require.Contains(t, err.Error(), "[Service] ExecStart")
+}
+
+func TestSplitExecArgs(t *testing.T) {
+	args := []string{"/bin/true", "", "two words", `"quoted" \ 'single'`, "100%", "$HOME", "line\nbreak"}
+	split, err := splitExecArgs(joinExecArgs(args))
+	require.NoError(t, err)
+	require.Equal(t, args, split)
+
+	split, err = splitExecArgs(`/bin/true  plain 'single quoted' "a"'b'c \"`)
+	require.NoError(t, err)
+	require.Equal(t, []string{"/bin/true", "plain", "single quoted", "abc", `"`}, split)
+
+	for _, bad := range []string{`/bin/true "unterminated`, `/bin/true %n`, `/bin/true $HOME`, `/bin/true \`} {
+		_, err := splitExecArgs(bad)
+		require.Error(t, err, bad)
+	}
+}
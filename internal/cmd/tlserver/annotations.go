@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/pcapng"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+// Only the most recent annotations are kept.
+const maxAnnotations = 1000
+
+// annotations made by the client, describing events such as dial failures.
+type annotations struct {
+	mx   sync.Mutex
+	list []tlapi.Annotation
+}
+
+func (a *annotations) add(ann tlapi.Annotation) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	a.list = append(a.list, ann)
+	if len(a.list) > maxAnnotations {
+		a.list = a.list[len(a.list)-maxAnnotations:]
+	}
+}
+
+// Returns the annotations, sorted by time.
+func (a *annotations) snapshot() []tlapi.Annotation {
+	a.mx.Lock()
+	list := append([]tlapi.Annotation{}, a.list...)
+	a.mx.Unlock()
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	return list
+}
+
+func (s *server) annotate(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ann := new(tlapi.Annotation)
+	if err := json.NewDecoder(req.Body).Decode(ann); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to decode request: %v", err))
+		return
+	}
+	if err := ann.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	s.annotations.add(*ann)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type pendingAnnotation struct {
+	tlapi.Annotation
+
+	// Parsed from the address. The IP is nil and the port zero if they could not be parsed.
+	ip   net.IP
+	port uint16
+}
+
+// annotator records annotations in an exported pcapng file. Every annotation is recorded as a
+// section comment. Additionally, each annotation is recorded as a comment on the first packet
+// captured at or after its time, to or from its address. Wireshark displays packet comments
+// alongside the packets, so this allows a capture to be read together with the client's view of
+// events.
+type annotator struct {
+	all     []tlapi.Annotation
+	pending []pendingAnnotation
+}
+
+func newAnnotator(anns []tlapi.Annotation) *annotator {
+	a := &annotator{all: anns}
+	for _, ann := range anns {
+		pending := pendingAnnotation{Annotation: ann}
+		if host, port, err := net.SplitHostPort(ann.Address); err == nil {
+			pending.ip = net.ParseIP(host)
+			if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+				pending.port = uint16(p)
+			}
+		}
+		a.pending = append(a.pending, pending)
+	}
+	return a
+}
+
+func (a *annotator) annotate(p *pcapng.Packet, iface pcapng.Interface) {
+	if len(a.pending) == 0 {
+		return
+	}
+	ts := p.Time(iface)
+	var ep *packetEndpoints
+	remaining := a.pending[:0]
+	for _, pending := range a.pending {
+		if ts.Before(pending.Time) {
+			remaining = append(remaining, pending)
+			continue
+		}
+		if pending.ip != nil {
+			if ep == nil {
+				ep = endpointsOf(p.Data, iface.LinkType)
+			}
+			if !ep.match(pending.ip, pending.port) {
+				remaining = append(remaining, pending)
+				continue
+			}
+		}
+		p.AddComment("annotation: " + pending.Message)
+	}
+	a.pending = remaining
+}
+
+func (a *annotator) sectionComments() []string {
+	comments := make([]string, 0, len(a.all))
+	for _, ann := range a.all {
+		comments = append(comments, formatAnnotation(ann))
+	}
+	return comments
+}
+
+func formatAnnotation(ann tlapi.Annotation) string {
+	ts := ann.Time.UTC().Format(time.RFC3339Nano)
+	if ann.Address == "" {
+		return fmt.Sprintf("annotation at %s: %s", ts, ann.Message)
+	}
+	return fmt.Sprintf("annotation at %s for %s: %s", ts, ann.Address, ann.Message)
+}
+
+// The network and transport endpoints of a packet. Ports are zero for protocols other than TCP and
+// UDP.
+type packetEndpoints struct {
+	srcIP, dstIP     net.IP
+	srcPort, dstPort uint16
+}
+
+func (ep *packetEndpoints) match(ip net.IP, port uint16) bool {
+	if ep.srcIP == nil {
+		return false
+	}
+	switch {
+	case ip.Equal(ep.srcIP):
+		return port == 0 || port == ep.srcPort
+	case ip.Equal(ep.dstIP):
+		return port == 0 || port == ep.dstPort
+	}
+	return false
+}
+
+// Decodes the endpoints of the packet. The result is empty if the packet could not be decoded.
+func endpointsOf(data []byte, linkType uint16) *packetEndpoints {
+	var first gopacket.LayerType
+	switch layers.LinkType(linkType) {
+	case layers.LinkTypeEthernet:
+		first = layers.LayerTypeEthernet
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		first = layers.LayerTypeLoopback
+	case layers.LinkTypeRaw:
+		if len(data) > 0 && data[0]>>4 == 6 {
+			first = layers.LayerTypeIPv6
+		} else {
+			first = layers.LayerTypeIPv4
+		}
+	default:
+		return &packetEndpoints{}
+	}
+	pkt := gopacket.NewPacket(data, first, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+	ep := &packetEndpoints{}
+	if nl := pkt.NetworkLayer(); nl != nil {
+		src, dst := nl.NetworkFlow().Endpoints()
+		ep.srcIP, ep.dstIP = net.IP(src.Raw()), net.IP(dst.Raw())
+	}
+	if tl := pkt.TransportLayer(); tl != nil {
+		src, dst := tl.TransportFlow().Endpoints()
+		if len(src.Raw()) == 2 && len(dst.Raw()) == 2 {
+			ep.srcPort, ep.dstPort = binary.BigEndian.Uint16(src.Raw()), binary.BigEndian.Uint16(dst.Raw())
+		}
+	}
+	return ep
+}
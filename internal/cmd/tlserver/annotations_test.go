@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/pcapng"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+func TestAnnotator(t *testing.T) {
+	var (
+		start  = time.Date(2022, 9, 3, 14, 30, 0, 0, time.UTC)
+		local  = net.IPv4(192, 168, 1, 20)
+		proxyA = net.IPv4(203, 0, 113, 7)
+		proxyB = net.IPv4(203, 0, 113, 8)
+	)
+
+	src := new(bytes.Buffer)
+	w, err := pcapgo.NewNgWriter(src, layers.LinkTypeEthernet)
+	require.NoError(t, err)
+	for i, dst := range []net.IP{proxyA, proxyB, proxyB} {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: local, DstIP: dst}
+		tcp := &layers.TCP{SrcPort: 50000, DstPort: 443}
+		require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+		buf := gopacket.NewSerializeBuffer()
+		require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+			&layers.Ethernet{SrcMAC: make(net.HardwareAddr, 6), DstMAC: make(net.HardwareAddr, 6), EthernetType: layers.EthernetTypeIPv4},
+			ip, tcp))
+		ci := gopacket.CaptureInfo{
+			Timestamp:     start.Add(time.Duration(i) * time.Second),
+			CaptureLength: len(buf.Bytes()),
+			Length:        len(buf.Bytes()),
+		}
+		require.NoError(t, w.WritePacket(ci, buf.Bytes()))
+	}
+	require.NoError(t, w.Flush())
+
+	anns := []tlapi.Annotation{
+		// Should be attached to the first packet, which is the first packet after this time.
+		{Time: start.Add(-time.Second), Message: "proxy switch"},
+		// Should skip the first packet, which is to the wrong address.
+		{Address: "203.0.113.8:443", Time: start, Message: "dial failed"},
+		// Should not be attached to any packet as it is after all of them.
+		{Address: "203.0.113.8:443", Time: start.Add(time.Minute), Message: "timeout"},
+	}
+	a := newAnnotator(anns)
+	var comments [][]string
+	rw := pcapng.Rewriter{
+		SectionComments: a.sectionComments(),
+		Packet: func(p *pcapng.Packet, iface pcapng.Interface) (bool, error) {
+			a.annotate(p, iface)
+			comments = append(comments, p.Comments())
+			return true, nil
+		},
+	}
+	dst := new(bytes.Buffer)
+	require.NoError(t, rw.Rewrite(src, dst))
+	require.Equal(t, [][]string{
+		{"annotation: proxy switch"},
+		{"annotation: dial failed"},
+		{},
+	}, comments)
+
+	r, err := pcapgo.NewNgReader(dst, pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+	require.Contains(t, r.SectionInfo().Comment, "annotation at 2022-09-03T14:31:00Z for 203.0.113.8:443: timeout")
+}
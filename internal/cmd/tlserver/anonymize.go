@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/rand"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/anonymize"
+)
+
+const (
+	anonymizedComment = "local IP and MAC addresses have been replaced with pseudonyms"
+
+	// Persisted files record the hosts captured by the writing process in a section comment
+	// starting with this prefix, so that their addresses are kept when the file is anonymized.
+	capturedHostsPrefix = "captured hosts: "
+)
+
+// Creates an anonymizer which leaves the addresses of captured hosts alone. Pseudonyms are
+// consistent for the lifetime of the process, but unrelated to those of any other process.
+func (s *server) newAnonymizer() *anonymize.Anonymizer {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		// This should never happen. Without a key, pseudonyms could be reversed by brute force.
+		panic("failed to generate anonymization key: " + err.Error())
+	}
+	return anonymize.New(key, func(ip net.IP) bool {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+		return s.capturedIPs[ip.String()]
+	})
+}
+
+// Records the IPs of the hosts in the input addresses. These are never forgotten as packets for
+// hosts no longer being captured may remain in the buffers. Host names are resolved as they are by
+// the traffic log.
+func (s *server) addCapturedHosts(addresses []string) {
+	ips := []net.IP{}
+	for _, addr := range addresses {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		resolved, err := net.LookupIP(host)
+		if err != nil {
+			logError("failed to resolve captured host:", err)
+			continue
+		}
+		ips = append(ips, resolved...)
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for _, ip := range ips {
+		s.capturedIPs[ip.String()] = true
+	}
+}
+
+// Returns a section comment listing the IPs of the hosts captured so far.
+func (s *server) capturedHostsComment() string {
+	s.mx.Lock()
+	ips := make([]string, 0, len(s.capturedIPs))
+	for ip := range s.capturedIPs {
+		ips = append(ips, ip)
+	}
+	s.mx.Unlock()
+	sort.Strings(ips)
+	return capturedHostsPrefix + strings.Join(ips, ", ")
+}
+
+// Returns the IPs listed by any captured hosts comment among the input section comments.
+func parseCapturedHosts(comments []string) map[string]bool {
+	ips := map[string]bool{}
+	for _, c := range comments {
+		if !strings.HasPrefix(c, capturedHostsPrefix) {
+			continue
+		}
+		for _, host := range strings.Split(strings.TrimPrefix(c, capturedHostsPrefix), ", ") {
+			if ip := net.ParseIP(host); ip != nil {
+				ips[ip.String()] = true
+			}
+		}
+	}
+	return ips
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+const (
+	// When the audit log exceeds this size, it is rotated. At most two files are kept, so the audit
+	// trail occupies no more than twice this size on disk.
+	maxAuditLogSize = 1024 * 1024
+
+	// Request bodies larger than this are truncated in the audit log.
+	maxAuditParamsSize = 4096
+)
+
+// auditLog records requests and authentication failures to a size-bounded file. A nil *auditLog
+// discards all entries.
+type auditLog struct {
+	mx   sync.Mutex
+	path string
+	f    *os.File
+	size int64
+}
+
+// Opens the audit log in the install directory, alongside this binary.
+func openAuditLog() (*auditLog, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate install directory: %w", err)
+	}
+	path := filepath.Join(filepath.Dir(self), tlapi.AuditLogFileName)
+	a := &auditLog{path: path}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+	a.f, a.size = f, info.Size()
+	return nil
+}
+
+func (a *auditLog) rotate() error {
+	a.f.Close()
+	// Entries are dropped, rather than written to the closed file, unless the log is reopened.
+	a.f = nil
+	if err := os.Rename(a.path, a.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	return a.open()
+}
+
+// record the entry. Failures are logged, but otherwise ignored.
+func (a *auditLog) record(e tlapi.AuditEntry) {
+	if a == nil {
+		return
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		logError("failed to encode audit log entry:", err)
+		return
+	}
+	b = append(b, '\n')
+
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	if a.f == nil {
+		// A previous rotation failed.
+		return
+	}
+	if a.size+int64(len(b)) > maxAuditLogSize && a.size > 0 {
+		if err := a.rotate(); err != nil {
+			logError(err)
+			return
+		}
+	}
+	n, err := a.f.Write(b)
+	a.size += int64(n)
+	if err != nil {
+		logError("failed to write audit log entry:", err)
+	}
+}
+
+// Returns the request body as recorded in the audit log.
+func auditParams(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if len(body) > maxAuditParamsSize || !json.Valid(body) {
+		if len(body) > maxAuditParamsSize {
+			body = body[:maxAuditParamsSize]
+		}
+		b, _ := json.Marshal(string(body))
+		return b
+	}
+	return body
+}
+
+// Returns the elements of b not in a and the elements of a not in b.
+func diffAddresses(a, b []string) (added, removed []string) {
+	inA, inB := map[string]bool{}, map[string]bool{}
+	for _, addr := range a {
+		inA[addr] = true
+	}
+	for _, addr := range b {
+		inB[addr] = true
+		if !inA[addr] {
+			added = append(added, addr)
+		}
+	}
+	for _, addr := range a {
+		if !inB[addr] {
+			removed = append(removed, addr)
+		}
+	}
+	return
+}
+
+type peerContextKey struct{}
+
+// connContext is used as the http.Server's ConnContext, attaching the identity of the peer to each
+// request's context.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	pid, exe := identifyPeer(c)
+	return context.WithValue(ctx, peerContextKey{}, peerInfo{pid, exe})
+}
+
+type peerInfo struct {
+	pid        int
+	executable string
+}
+
+func peerFromContext(ctx context.Context) peerInfo {
+	p, _ := ctx.Value(peerContextKey{}).(peerInfo)
+	return p
+}
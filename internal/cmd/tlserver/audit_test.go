@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlserver-audit-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	a := &auditLog{path: filepath.Join(dir, tlapi.AuditLogFileName)}
+	require.NoError(t, a.open())
+
+	// Each entry is a little over 1 KiB, so we should rotate after roughly 1000 entries.
+	entry := tlapi.AuditEntry{Time: time.Now(), Path: "/status", Error: strings.Repeat("x", 1024)}
+	const numEntries = 1500
+	for i := 0; i < numEntries; i++ {
+		a.record(entry)
+	}
+
+	for _, path := range tlapi.AuditLogPaths(dir) {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.LessOrEqual(t, info.Size(), int64(maxAuditLogSize))
+	}
+	entries, err := tlapi.ReadAuditLog(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, numEntries)
+	require.Equal(t, "/status", entries[numEntries-1].Path)
+
+	// If rotation fails, later entries should be dropped rather than written to the closed file.
+	require.NoError(t, os.RemoveAll(dir))
+	a.size = maxAuditLogSize
+	a.record(entry)
+	require.Nil(t, a.f)
+	a.record(entry)
+}
+
+func TestDiffAddresses(t *testing.T) {
+	added, removed := diffAddresses([]string{"a:1", "b:2"}, []string{"b:2", "c:3"})
+	require.Equal(t, []string{"c:3"}, added)
+	require.Equal(t, []string{"a:1"}, removed)
+}
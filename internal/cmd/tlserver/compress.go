@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcapgo"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+// Bounds on the uncompressed size of a block. Blocks are evicted whole and the open block is held
+// uncompressed, so blocks are kept small relative to the buffer.
+const (
+	maxCompressionBlockBytes = 64 * 1024
+	minCompressionBlockBytes = 4 * 1024
+)
+
+type compressedBlock struct {
+	data         []byte
+	packets      int
+	logicalBytes int64
+
+	// The latest capture time of the block's packets, in Unix nanoseconds.
+	latest int64
+}
+
+// compressedBuffer holds saved packets compressed, in blocks. Packets are added to the open block,
+// which is compressed once full. When the buffer is full, the oldest block is evicted.
+//
+// The traffic log's save buffer is used as a staging area: after each save, newly saved packets
+// are added to the compressed buffer. The traffic log does not allow its save buffer to be cleared,
+// so staged packets remain in memory until evicted by later saves. The staging buffer is therefore
+// given the size of the compressed buffer, bounding the memory used for saves at twice the save
+// buffer size. As without compression, a single save stores at most a save buffer's worth of
+// packets.
+type compressedBuffer struct {
+	mx  sync.Mutex
+	cap int
+
+	interfaces []pcapgo.NgInterface
+	ifaceIDs   map[interfaceKey]int
+
+	sealed          []compressedBlock
+	compressedBytes int
+
+	// Packet records, uncompressed.
+	open             bytes.Buffer
+	openPackets      int
+	openLogicalBytes int64
+	openLatest       int64
+
+	// The latest capture time of the packets evicted by the current call to add.
+	evictedThrough int64
+}
+
+func newCompressedBuffer(cap int) *compressedBuffer {
+	return &compressedBuffer{
+		cap:      cap,
+		ifaceIDs: map[interfaceKey]int{},
+	}
+}
+
+// The new capacity takes effect when packets are next added.
+func (b *compressedBuffer) setCap(cap int) {
+	b.mx.Lock()
+	b.cap = cap
+	b.mx.Unlock()
+}
+
+func (b *compressedBuffer) blockBytes() int {
+	n := b.cap / 16
+	if n > maxCompressionBlockBytes {
+		return maxCompressionBlockBytes
+	}
+	if n < minCompressionBlockBytes {
+		return minCompressionBlockBytes
+	}
+	return n
+}
+
+// add compresses the packets, returning the latest capture time of any packets evicted to make
+// room for them, or the zero time if none were.
+func (b *compressedBuffer) add(packets []savedPacket) (time.Time, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.evictedThrough = 0
+	var err error
+	for _, p := range packets {
+		if err = b.addRecord(p); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		b.evict()
+	}
+	if b.evictedThrough == 0 {
+		return time.Time{}, err
+	}
+	return time.Unix(0, b.evictedThrough), err
+}
+
+// Appends a packet record to the open block. Records are the interface ID, the timestamp in Unix
+// nanoseconds, the original length and the length of the captured data as varints, followed by
+// the captured data. Must be called with b.mx held.
+func (b *compressedBuffer) addRecord(p savedPacket) error {
+	key := keyOf(p.iface)
+	id, ok := b.ifaceIDs[key]
+	if !ok {
+		id = len(b.interfaces)
+		b.ifaceIDs[key] = id
+		b.interfaces = append(b.interfaces, p.iface)
+	}
+	var hdr [4 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(hdr[:], uint64(id))
+	n += binary.PutVarint(hdr[n:], p.ci.Timestamp.UnixNano())
+	n += binary.PutUvarint(hdr[n:], uint64(p.ci.Length))
+	n += binary.PutUvarint(hdr[n:], uint64(len(p.data)))
+	b.open.Write(hdr[:n])
+	b.open.Write(p.data)
+	b.openPackets++
+	b.openLogicalBytes += int64(len(p.data))
+	if ts := p.ci.Timestamp.UnixNano(); ts > b.openLatest {
+		b.openLatest = ts
+	}
+	if b.open.Len() < b.blockBytes() {
+		return nil
+	}
+	return b.seal()
+}
+
+// Compresses the open block, evicting old blocks as needed. Must be called with b.mx held.
+func (b *compressedBuffer) seal() error {
+	compressed := new(bytes.Buffer)
+	fw, err := flate.NewWriter(compressed, flate.DefaultCompression)
+	if err != nil {
+		return fmt.Errorf("failed to create compressor: %w", err)
+	}
+	if _, err := fw.Write(b.open.Bytes()); err != nil {
+		return fmt.Errorf("failed to compress block: %w", err)
+	}
+	if err := fw.Close(); err != nil {
+		return fmt.Errorf("failed to compress block: %w", err)
+	}
+	// Copy the data so that the compressor's slack is not retained.
+	block := compressedBlock{
+		data:         append([]byte{}, compressed.Bytes()...),
+		packets:      b.openPackets,
+		logicalBytes: b.openLogicalBytes,
+		latest:       b.openLatest,
+	}
+	b.sealed = append(b.sealed, block)
+	b.compressedBytes += len(block.data)
+	b.open.Reset()
+	b.openPackets, b.openLogicalBytes, b.openLatest = 0, 0, 0
+	b.evict()
+	return nil
+}
+
+// Evicts the oldest blocks until the buffer is within its capacity. The open block is never
+// evicted. Must be called with b.mx held.
+func (b *compressedBuffer) evict() {
+	for len(b.sealed) > 0 && b.compressedBytes+b.open.Len() > b.cap {
+		b.compressedBytes -= len(b.sealed[0].data)
+		if b.sealed[0].latest > b.evictedThrough {
+			b.evictedThrough = b.sealed[0].latest
+		}
+		b.sealed[0] = compressedBlock{}
+		b.sealed = b.sealed[1:]
+	}
+}
+
+func (b *compressedBuffer) stats() tlapi.SaveBufferStats {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	stats := tlapi.SaveBufferStats{
+		Packets:         b.openPackets,
+		LogicalBytes:    b.openLogicalBytes,
+		CompressedBytes: int64(b.compressedBytes + b.open.Len()),
+	}
+	for _, block := range b.sealed {
+		stats.Packets += block.packets
+		stats.LogicalBytes += block.logicalBytes
+	}
+	return stats
+}
+
+// writePcapng decompresses the buffered packets and writes them in pcapng format, as the traffic
+// log would.
+func (b *compressedBuffer) writePcapng(w io.Writer) error {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	pw, err := newSavedPacketWriter(w)
+	if err != nil {
+		return err
+	}
+	writeRecords := func(records []byte) error {
+		r := bytes.NewReader(records)
+		for r.Len() > 0 {
+			id, ci, data, err := readRecord(r)
+			if err != nil {
+				return err
+			}
+			if id >= len(b.interfaces) {
+				return fmt.Errorf("bad interface ID %d", id)
+			}
+			if err := pw.write(savedPacket{b.interfaces[id], ci, data}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, block := range b.sealed {
+		records, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(block.data)))
+		if err != nil {
+			return fmt.Errorf("failed to decompress block: %w", err)
+		}
+		if err := writeRecords(records); err != nil {
+			return err
+		}
+	}
+	if err := writeRecords(b.open.Bytes()); err != nil {
+		return err
+	}
+	return pw.flush()
+}
+
+func readRecord(r *bytes.Reader) (id int, ci gopacket.CaptureInfo, data []byte, err error) {
+	bad := func(err error) (int, gopacket.CaptureInfo, []byte, error) {
+		return 0, gopacket.CaptureInfo{}, nil, fmt.Errorf("bad packet record: %w", err)
+	}
+	iface, err := binary.ReadUvarint(r)
+	if err != nil {
+		return bad(err)
+	}
+	ts, err := binary.ReadVarint(r)
+	if err != nil {
+		return bad(err)
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return bad(err)
+	}
+	dataLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return bad(err)
+	}
+	if dataLen > uint64(r.Len()) {
+		return bad(io.ErrUnexpectedEOF)
+	}
+	data = make([]byte, dataLen)
+	r.Read(data)
+	ci = gopacket.CaptureInfo{
+		Timestamp:     time.Unix(0, ts),
+		CaptureLength: len(data),
+		Length:        int(length),
+	}
+	return int(iface), ci, data, nil
+}
+
+func (s *server) saveBufferStats() *tlapi.SaveBufferStats {
+	if s.compressed == nil {
+		return nil
+	}
+	stats := s.compressed.stats()
+	stagedPackets, stagedBytes := s.newlySaved.held()
+	stats.ResidentBytes = stats.CompressedBytes + int64(stagedBytes+stagedPackets*packetOverheadBytes)
+	return &stats
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+)
+
+type testPacket struct {
+	ts   time.Time
+	data []byte
+}
+
+// Writes packets as the traffic log would, on a single interface following the placeholder.
+func writeStaged(packets []testPacket) func(io.Writer) error {
+	return func(w io.Writer) error {
+		pw, err := pcapgo.NewNgWriter(w, layers.LinkTypeEthernet)
+		if err != nil {
+			return err
+		}
+		id, err := pw.AddInterface(pcapgo.NgInterface{Name: "en0", LinkType: layers.LinkTypeEthernet, SnapLength: 1500})
+		if err != nil {
+			return err
+		}
+		for _, p := range packets {
+			ci := gopacket.CaptureInfo{
+				Timestamp: p.ts, CaptureLength: len(p.data), Length: len(p.data) + 10, InterfaceIndex: id,
+			}
+			if err := pw.WritePacket(ci, p.data); err != nil {
+				return err
+			}
+		}
+		return pw.Flush()
+	}
+}
+
+func readPackets(t *testing.T, r io.Reader) []testPacket {
+	t.Helper()
+	pr, err := pcapgo.NewNgReader(r, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+	require.NoError(t, err)
+	packets := []testPacket{}
+	for {
+		data, ci, err := pr.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			return packets
+		}
+		require.NoError(t, err)
+		require.Equal(t, len(data)+10, ci.Length)
+		iface, err := pr.Interface(ci.InterfaceIndex)
+		require.NoError(t, err)
+		require.Equal(t, "en0", iface.Name)
+		packets = append(packets, testPacket{ci.Timestamp, data})
+	}
+}
+
+func TestCompressedBuffer(t *testing.T) {
+	start := time.Date(2022, 9, 3, 14, 30, 0, 0, time.UTC)
+	packets := make([]testPacket, 2000)
+	for i := range packets {
+		// Mostly headers, as when the application layer is stripped.
+		data := bytes.Repeat([]byte{0x45, 0, 0, 0x28, 0, 0, 0x40, 0, 0x40, 6}, 6)
+		data = append(data, []byte(fmt.Sprintf("payload %d", i))...)
+		packets[i] = testPacket{start.Add(time.Duration(i) * time.Millisecond), data}
+	}
+
+	b, staged := newCompressedBuffer(256*1024), newNewlySaved()
+	add := func(packets []testPacket) (stagingEvicted *evictedPackets, evicted time.Time) {
+		newPackets, stagingEvicted, err := staged.read(writeStaged(packets), 1024*1024)
+		require.NoError(t, err)
+		evicted, err = b.add(newPackets)
+		require.NoError(t, err)
+		return stagingEvicted, evicted
+	}
+	add(packets[:1500])
+	// Packets still staged from the last read should not be added again.
+	stagingEvicted, evicted := add(packets[500:])
+	require.Equal(t, packets[499].ts.UnixNano(), stagingEvicted.through.UnixNano())
+	require.False(t, stagingEvicted.unread)
+	require.True(t, evicted.IsZero())
+
+	stats := b.stats()
+	require.Equal(t, len(packets), stats.Packets)
+	var logical int64
+	for _, p := range packets {
+		logical += int64(len(p.data))
+	}
+	require.Equal(t, logical, stats.LogicalBytes)
+	require.Less(t, stats.CompressedBytes*3, stats.LogicalBytes)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, b.writePcapng(buf))
+	require.Equal(t, packets, readPackets(t, buf))
+
+	// Shrinking the buffer should evict the oldest packets.
+	b.setCap(8 * 1024)
+	_, evicted = add(nil)
+	stats = b.stats()
+	require.LessOrEqual(t, stats.CompressedBytes, int64(8*1024))
+	require.Less(t, stats.Packets, len(packets))
+
+	buf.Reset()
+	require.NoError(t, b.writePcapng(buf))
+	retained := readPackets(t, buf)
+	require.Len(t, retained, stats.Packets)
+	require.Equal(t, packets[len(packets)-len(retained):], retained)
+	require.Equal(t, packets[len(packets)-len(retained)-1].ts.UnixNano(), evicted.UnixNano())
+
+	// A full buffer holding none of the packets read before may have evicted packets never read.
+	_, stagingEvicted, err := newNewlySaved().read(writeStaged(packets[:10]), 1000)
+	require.NoError(t, err)
+	require.True(t, stagingEvicted.unread)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/flows"
+	"github.com/getlantern/trafficlog-flashlight/internal/pcapng"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+// Path of the tlhttp endpoint for retrieving captures, which the server replaces.
+const pathGetCaptures = "/captures"
+
+// Replaces the tlhttp endpoint. See export.
+func (s *server) getCaptures(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	anonymize, err := parseAnonymize(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	exported, err := s.export(anonymize)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// This matches the response body of the tlhttp endpoint.
+	writeJSON(w, http.StatusOK, struct{ Pcapng []byte }{exported})
+}
+
+// Summarizes the captures which would be returned by the captures endpoint.
+func (s *server) summary(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	anonymize, err := parseAnonymize(req)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	exported, err := s.export(anonymize)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	summary, err := flows.Summarize(bytes.NewReader(exported))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("failed to summarize captures: %v", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
+
+func parseAnonymize(req *http.Request) (bool, error) {
+	v := req.URL.Query().Get(tlapi.QueryAnonymize)
+	if v == "" {
+		return false, nil
+	}
+	anonymize, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("bad value for %s: %w", tlapi.QueryAnonymize, err)
+	}
+	return anonymize, nil
+}
+
+// Exports the saved captures as pcapng. On the way out, duplicate packets and packets outside the
+// saved windows are dropped; the mutator applied to each packet, save labels and any annotations are
+// recorded as comments; packets captured by filters are appended; and, if requested, local
+// addresses are replaced with pseudonyms. Captures persisted by previous processes follow in
+// sections of their own.
+func (s *server) export(anonymize bool) ([]byte, error) {
+	raw := new(bytes.Buffer)
+	if err := s.writeSaved(raw); err != nil {
+		return nil, err
+	}
+
+	saveFilter := s.saves.exportFilter()
+	annotator := newAnnotator(s.annotations.snapshot())
+	rw := pcapng.Rewriter{
+		Packet: func(p *pcapng.Packet, iface pcapng.Interface) (bool, error) {
+			if !saveFilter.filter(p, iface) {
+				return false, nil
+			}
+			p.AddComment("mutator: " + s.mutator.labelAt(p.Time(iface)))
+			// Annotations are matched to packets by address, so this must precede anonymization.
+			annotator.annotate(p, iface)
+			if anonymize {
+				s.anonymizer.Packet(p.Data, iface.LinkType)
+			}
+			return true, nil
+		},
+		Append: s.exportFilters(),
+	}
+	if anonymize {
+		rw.SectionComments = append(rw.SectionComments, anonymizedComment)
+		for _, iface := range rw.Append {
+			for _, p := range iface.Packets {
+				s.anonymizer.Packet(p.Data, iface.LinkType)
+			}
+		}
+	}
+	rw.SectionComments = append(rw.SectionComments, saveFilter.sectionComments()...)
+	rw.SectionComments = append(rw.SectionComments, annotator.sectionComments()...)
+
+	annotated := new(bytes.Buffer)
+	if err := rw.Rewrite(raw, annotated); err != nil {
+		return nil, fmt.Errorf("failed to annotate captures: %w", err)
+	}
+	// Buffers cannot fail to write.
+	s.writeRecovered(annotated, anonymize)
+	return annotated.Bytes(), nil
+}
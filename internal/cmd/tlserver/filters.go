@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+
+	"github.com/getlantern/trafficlog"
+	"github.com/getlantern/trafficlog-flashlight/internal/pcapng"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+const (
+	filterSnapLen     = 65535
+	filterReadTimeout = 250 * time.Millisecond
+
+	// Interval at which drop counts are read from the capture handle.
+	filterStatsInterval = time.Second
+)
+
+type filteredPacket struct {
+	timestamp      time.Time
+	originalLength int
+	data           []byte
+}
+
+// filterCapture captures packets matching a named BPF filter. These are captured in addition to the
+// packets captured by the traffic log, but are held separately: the most recent packets are kept,
+// up to the filter's buffer size, and are included in every export.
+type filterCapture struct {
+	// The filter with defaults applied.
+	tlapi.Filter
+
+	// The filter as requested.
+	requested tlapi.Filter
+
+	handle   *pcap.Handle
+	linkType layers.LinkType
+	mutate   trafficlog.PacketMutator
+	onError  func(error)
+	stopC    chan struct{}
+	doneC    chan struct{}
+
+	mx                sync.Mutex
+	packets           []filteredPacket
+	size              int
+	received, dropped uint64
+}
+
+// Opens a capture handle for the filter. Opening the handle validates the filter expression against
+// the link type of the interface, so nothing is captured unless the filter is valid.
+func startFilterCapture(f tlapi.Filter, mutator trafficlog.MutatorFactory, onError func(error)) (*filterCapture, error) {
+	requested := f
+	if f.Interface == "" {
+		iface, err := defaultInterface()
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine default interface: %w", err)
+		}
+		f.Interface = iface
+	}
+	if f.BufferBytes == 0 {
+		f.BufferBytes = tlapi.DefaultFilterBufferBytes
+	}
+	handle, err := pcap.OpenLive(f.Interface, filterSnapLen, false, filterReadTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture handle: %w", err)
+	}
+	// The mutator must be applied to these packets as it is to all others.
+	var lt trafficlog.LinkType
+	switch handle.LinkType() {
+	case layers.LinkTypeEthernet:
+		lt = trafficlog.LinkTypeEthernet
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		lt = trafficlog.LinkTypeLoopback
+	default:
+		handle.Close()
+		return nil, fmt.Errorf("unsupported link type %v on %s", handle.LinkType(), f.Interface)
+	}
+	if err := handle.SetBPFFilter(f.Expression); err != nil {
+		handle.Close()
+		return nil, fmt.Errorf("bad filter expression: %w", err)
+	}
+	fc := &filterCapture{
+		Filter:    f,
+		requested: requested,
+		handle:    handle,
+		linkType:  handle.LinkType(),
+		mutate:    mutator.MutatorFor(lt),
+		onError:   onError,
+		stopC:     make(chan struct{}),
+		doneC:     make(chan struct{}),
+	}
+	go fc.run()
+	return fc, nil
+}
+
+// Finds the pcap device holding the address used to reach the Internet.
+func defaultInterface() (string, error) {
+	// Nothing is sent; this just selects a route.
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(8, 8, 8, 8), Port: 53})
+	if err != nil {
+		return "", err
+	}
+	localIP := conn.LocalAddr().(*net.UDPAddr).IP
+	conn.Close()
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return "", fmt.Errorf("failed to list devices: %w", err)
+	}
+	for _, dev := range devs {
+		for _, addr := range dev.Addresses {
+			if addr.IP.Equal(localIP) {
+				return dev.Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no device has address %v", localIP)
+}
+
+func (fc *filterCapture) run() {
+	defer close(fc.doneC)
+	lastStats := time.Now()
+	for {
+		select {
+		case <-fc.stopC:
+			return
+		default:
+		}
+		if time.Since(lastStats) > filterStatsInterval {
+			if stats, err := fc.handle.Stats(); err == nil {
+				fc.mx.Lock()
+				fc.dropped = uint64(stats.PacketsDropped + stats.PacketsIfDropped)
+				fc.mx.Unlock()
+			}
+			lastStats = time.Now()
+		}
+		data, ci, err := fc.handle.ReadPacketData()
+		if err != nil {
+			var nextErr pcap.NextError
+			if errors.As(err, &nextErr) && nextErr == pcap.NextErrorTimeoutExpired {
+				continue
+			}
+			fc.onError(fmt.Errorf("filter %s: read error: %w", fc.Name, err))
+			return
+		}
+		mutated := new(bytes.Buffer)
+		if err := fc.mutate(data, mutated); err != nil {
+			fc.onError(fmt.Errorf("filter %s: failed to mutate packet: %w", fc.Name, err))
+			continue
+		}
+		fc.add(filteredPacket{ci.Timestamp, ci.Length, mutated.Bytes()})
+	}
+}
+
+// Adds the packet, evicting the oldest packets as necessary to stay within the buffer size.
+func (fc *filterCapture) add(pkt filteredPacket) {
+	fc.mx.Lock()
+	defer fc.mx.Unlock()
+	fc.received++
+	fc.packets = append(fc.packets, pkt)
+	fc.size += len(pkt.data)
+	evict := 0
+	for fc.size > fc.BufferBytes && evict < len(fc.packets) {
+		fc.size -= len(fc.packets[evict].data)
+		evict++
+	}
+	fc.packets = fc.packets[evict:]
+}
+
+func (fc *filterCapture) stats() tlapi.FilterStats {
+	fc.mx.Lock()
+	defer fc.mx.Unlock()
+	return tlapi.FilterStats{Received: fc.received, Dropped: fc.dropped}
+}
+
+// Returns the buffered packets as an interface to be appended to an exported pcapng file.
+func (fc *filterCapture) export(labelAt func(time.Time) string) pcapng.AppendedInterface {
+	fc.mx.Lock()
+	defer fc.mx.Unlock()
+	iface := pcapng.AppendedInterface{
+		LinkType: uint16(fc.linkType),
+		Options: []pcapng.Option{
+			{Code: pcapng.OptionInterfaceName, Value: []byte(fc.Interface)},
+			{Code: pcapng.OptionComment, Value: []byte(fmt.Sprintf("filter %s: %s", fc.Name, fc.Expression))},
+		},
+	}
+	for _, pkt := range fc.packets {
+		p := pcapng.Packet{
+			Timestamp:      pcapng.MicrosecondTimestamp(pkt.timestamp),
+			OriginalLength: uint32(pkt.originalLength),
+			Data:           append([]byte{}, pkt.data...),
+		}
+		p.AddComment("filter: " + fc.Name)
+		p.AddComment("mutator: " + labelAt(pkt.timestamp))
+		iface.Packets = append(iface.Packets, p)
+	}
+	return iface
+}
+
+func (fc *filterCapture) stop() {
+	close(fc.stopC)
+	<-fc.doneC
+	fc.handle.Close()
+}
+
+// Replaces the set of filters. New and changed filters are started before anything is replaced, so
+// if any filter fails to start, the existing filters remain in place.
+func (s *server) updateFilters(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	update := new(tlapi.FilterUpdate)
+	if err := json.NewDecoder(req.Body).Decode(update); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to decode request: %v", err))
+		return
+	}
+	if err := tlapi.ValidateFilters(update.Filters); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.filtersMx.Lock()
+	defer s.filtersMx.Unlock()
+	var (
+		next    = map[string]*filterCapture{}
+		started = []*filterCapture{}
+	)
+	for _, f := range update.Filters {
+		if existing, ok := s.filters[f.Name]; ok && existing.requested == f {
+			next[f.Name] = existing
+			continue
+		}
+		fc, err := startFilterCapture(f, s.mutator, s.captureError)
+		if err != nil {
+			for _, fc := range started {
+				fc.stop()
+			}
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("filter %s: %v", f.Name, err))
+			return
+		}
+		next[f.Name] = fc
+		started = append(started, fc)
+	}
+	for name, fc := range s.filters {
+		if next[name] != fc {
+			fc.stop()
+		}
+	}
+	s.filters = next
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) captureError(err error) {
+	s.mx.Lock()
+	errorPrefix := s.cfg.ErrorPrefix
+	s.mx.Unlock()
+	fmt.Fprintf(os.Stderr, "%s%v\n", errorPrefix, err)
+}
+
+func (s *server) filterStats() map[string]tlapi.FilterStats {
+	s.filtersMx.Lock()
+	defer s.filtersMx.Unlock()
+	if len(s.filters) == 0 {
+		return nil
+	}
+	stats := map[string]tlapi.FilterStats{}
+	for name, fc := range s.filters {
+		stats[name] = fc.stats()
+	}
+	return stats
+}
+
+// Returns the filters with defaults applied, sorted by name.
+func (s *server) currentFilters() []tlapi.Filter {
+	s.filtersMx.Lock()
+	defer s.filtersMx.Unlock()
+	filters := []tlapi.Filter{}
+	for _, fc := range s.sortedFilters() {
+		filters = append(filters, fc.Filter)
+	}
+	return filters
+}
+
+func (s *server) exportFilters() []pcapng.AppendedInterface {
+	s.filtersMx.Lock()
+	defer s.filtersMx.Unlock()
+	ifaces := []pcapng.AppendedInterface{}
+	for _, fc := range s.sortedFilters() {
+		ifaces = append(ifaces, fc.export(s.mutator.labelAt))
+	}
+	return ifaces
+}
+
+// Must be called with filtersMx held.
+func (s *server) sortedFilters() []*filterCapture {
+	filters := make([]*filterCapture, 0, len(s.filters))
+	for _, fc := range s.filters {
+		filters = append(filters, fc)
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].Name < filters[j].Name })
+	return filters
+}
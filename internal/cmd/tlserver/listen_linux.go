@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/peercred"
+)
+
+// Peers must be running as the installing user, from an allow-listed executable. The allow list is
+// written to the install directory (alongside this binary) by tlconfig. Authentication failures are
+// passed to onAuthFailure.
+func listen(socketFile string, onAuthFailure func(error)) (net.Listener, error) {
+	if debugBuild {
+		return net.Listen("unix", socketFile)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate install directory: %w", err)
+	}
+	allow, err := peercred.Load(peercred.Path(filepath.Dir(self)))
+	if err != nil {
+		return nil, err
+	}
+	l, err := peercred.Listen(socketFile, *allow, onAuthFailure)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start listener: %w", err)
+	}
+	return l, nil
+}
@@ -0,0 +1,72 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/getlantern/authipc"
+)
+
+// Peers must be running code signed with the Lantern developer certificate. This is hard-coded as
+// otherwise someone could simply run the server with a common name of their choosing.
+const lanternCertCommonName = "Developer ID Application: Innovate Labs LLC (4FYC28AXA2)"
+
+// Authentication failures are passed to onAuthFailure, once per connection.
+func listen(socketFile string, onAuthFailure func(error)) (net.Listener, error) {
+	v := authipc.NewSignerVerifier(lanternCertCommonName)
+	if debugBuild {
+		v = func(_ authipc.ProcessInfo) error { return nil }
+	}
+	l, err := authipc.Listen(socketFile, v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start authipc listener: %w", err)
+	}
+	return loggingListener{l, onAuthFailure}, nil
+}
+
+type loggingConn struct {
+	*authipc.Conn
+	onAuthFailure      func(error)
+	logAuthFailureOnce sync.Once
+}
+
+func (lc *loggingConn) Read(b []byte) (n int, err error) {
+	n, err = lc.Conn.Read(b)
+	if err != nil && errors.As(err, new(authipc.AuthError)) {
+		lc.logAuthFailureOnce.Do(func() { lc.onAuthFailure(err) })
+	}
+	return
+}
+
+func (lc *loggingConn) Write(b []byte) (n int, err error) {
+	n, err = lc.Conn.Write(b)
+	if err != nil && errors.As(err, new(authipc.AuthError)) {
+		lc.logAuthFailureOnce.Do(func() { lc.onAuthFailure(err) })
+	}
+	return
+}
+
+type loggingListener struct {
+	net.Listener
+	onAuthFailure func(error)
+}
+
+func (l loggingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	if authConn, ok := c.(*authipc.Conn); ok {
+		return &loggingConn{Conn: authConn, onAuthFailure: l.onAuthFailure}, nil
+	}
+	return c, err
+}
+
+// NetConn returns the wrapped connection.
+func (lc *loggingConn) NetConn() net.Conn {
+	return lc.Conn
+}
@@ -1,42 +1,46 @@
 // Command tlserver starts a traffic log server. This server uses HTTP over Unix domain sockets and
 // authenticates peers using authipc. Specifically, peer processes must be running code signed with
 // the Lantern Developer ID Application certificate. See the tlproc package doc for more details.
+//
+// On Linux, where code signatures are unavailable, peers are instead authenticated using
+// SO_PEERCRED. See the peercred package for details.
+//
+// tlserver is configured by a JSON document (see tlapi.Config) provided as a single line on stdin.
+// Before doing anything else, tlserver replies on stdout with a tlapi.ConfigResponse, accepting or
+// rejecting the config. A config is rejected if it is invalid or contains fields tlserver does not
+// understand; in this case, tlserver exits.
+//
+// If so configured, tlserver begins capture and then drops its group privileges before serving any
+// requests. This prevents a compromised request handler from opening new capture devices.
+//
+// tlserver shuts down, removing its socket, when it receives SIGINT or SIGTERM, when the parent
+// process named in the config exits, or when no requests have been received within the configured
+// idle timeout.
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
-	"flag"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"runtime"
+	"syscall"
+	"time"
 
-	"github.com/getlantern/authipc"
 	"github.com/getlantern/trafficlog"
-	"github.com/getlantern/trafficlog/tlhttp"
+	"github.com/getlantern/trafficlog-flashlight/internal/mutators"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
 )
 
-// Peers must be running code signed with the Lantern developer certificate. This is hard-coded as
-// otherwise someone could simply run the server with a common name of their choosing.
-const lanternCertCommonName = "Developer ID Application: Innovate Labs LLC (4FYC28AXA2)"
+// Maximum time to wait for in-flight requests on shutdown.
+const shutdownTimeout = 5 * time.Second
 
 // Set to true or build with '-tags debug' to disable peer authentication.
 var debugBuild = false
 
-var (
-	socketFile    = flag.String("socket-file", "", "file to listen on; should not exist")
-	captureBytes  = flag.Int("capture-bytes", 0, "size of the capture buffer")
-	saveBytes     = flag.Int("save-bytes", 0, "size of the save buffer")
-	statsInterval = flag.Duration("stats-interval", trafficlog.DefaultStatsInterval, "print stats at this rate")
-	stripAppLayer = flag.Bool("strip-app-layer", false, "strip application-layer data")
-	errorPrefix   = flag.String("error-prefix", "", "prefix for error logs")
-	statsPrefix   = flag.String("stats-prefix", "", "prefix for stat logs")
-)
-
 func logError(a ...interface{}) {
 	fmt.Fprintln(os.Stderr, a...)
 }
@@ -46,97 +50,145 @@ func fail(a ...interface{}) {
 	os.Exit(1)
 }
 
-type loggingConn struct {
-	*authipc.Conn
-	logAuthFailureOnce sync.Once
-}
-
-func (lc *loggingConn) Read(b []byte) (n int, err error) {
-	n, err = lc.Conn.Read(b)
-	if err != nil && errors.As(err, new(authipc.AuthError)) {
-		lc.logAuthFailureOnce.Do(func() { fmt.Fprintln(os.Stderr, err) })
+// Reads the config from stdin and replies on stdout. Exits if the config is rejected. The mutator
+// factory named in the config is returned alongside it.
+func readConfig() (*tlapi.Config, trafficlog.MutatorFactory) {
+	reject := func(resp tlapi.ConfigResponse) {
+		if err := tlapi.WriteConfigResponse(os.Stdout, resp); err != nil {
+			logError("failed to write config response:", err)
+		}
+		fail("config rejected:", resp.Error)
 	}
-	return
-}
 
-func (lc *loggingConn) Write(b []byte) (n int, err error) {
-	n, err = lc.Conn.Write(b)
-	if err != nil && errors.As(err, new(authipc.AuthError)) {
-		lc.logAuthFailureOnce.Do(func() { fmt.Fprint(os.Stderr, err) })
+	cfg, unknownFields, err := tlapi.ReadConfig(os.Stdin)
+	if err != nil {
+		reject(tlapi.ConfigResponse{Error: err.Error()})
 	}
-	return
-}
-
-type loggingListener struct {
-	net.Listener
-}
-
-func (l loggingListener) Accept() (net.Conn, error) {
-	c, err := l.Listener.Accept()
+	if len(unknownFields) > 0 {
+		reject(tlapi.ConfigResponse{Error: "unknown fields in config", UnknownFields: unknownFields})
+	}
+	if err := cfg.Validate(); err != nil {
+		reject(tlapi.ConfigResponse{Error: err.Error()})
+	}
+	if cfg.DropPrivileges && runtime.GOOS == "linux" {
+		// Other threads, including those started by libpcap, would keep the capabilities.
+		reject(tlapi.ConfigResponse{
+			Error: "DropPrivileges is not supported on Linux, where capture privileges are file capabilities",
+		})
+	}
+	mutator, err := mutators.New(cfg.Mutator, cfg.MutatorParams)
 	if err != nil {
-		return c, err
+		reject(tlapi.ConfigResponse{Error: err.Error()})
 	}
-	if authConn, ok := c.(*authipc.Conn); ok {
-		return &loggingConn{Conn: authConn}, nil
+	if err := tlapi.WriteConfigResponse(os.Stdout, tlapi.ConfigResponse{Accepted: true}); err != nil {
+		fail("failed to write config response:", err)
 	}
-	return c, err
+	return cfg, mutator
 }
 
 func main() {
-	flag.Parse()
-	if *captureBytes == 0 {
-		fail("capture-bytes must be provided")
-	}
-	if *saveBytes == 0 {
-		fail("save-bytes must be provided")
+	cfg, mutator := readConfig()
+
+	mutatorSwitch := newMutatorSwitch(cfg.Mutator, cfg.MutatorParams, mutator)
+	meter := newCaptureMeter(cfg.CaptureBytes)
+	// If saves are compressed, the traffic log's save buffer is only for staging. See
+	// compressedBuffer.
+	tl := trafficlog.New(cfg.CaptureBytes, cfg.SaveBytes, &trafficlog.Options{
+		// Stats are published at the configured interval, which may change. See server.publishStats.
+		StatsInterval:  trafficlog.MinimumStatsInterval,
+		MutatorFactory: meter.factory(mutatorSwitch),
+	})
+	audit, err := openAuditLog()
+	if err != nil {
+		// We continue without the audit log rather than leave the parent without a traffic log.
+		fmt.Fprintf(os.Stderr, "%sno audit log: %v\n", cfg.ErrorPrefix, err)
 	}
-
-	var mutator trafficlog.MutatorFactory = new(trafficlog.NoOpFactory)
-	if *stripAppLayer {
-		mutator = new(trafficlog.AppStripperFactory)
+	var persisted *persistedCaptures
+	if cfg.PersistBytes > 0 {
+		if persisted, err = openPersisted(cfg); err != nil {
+			// As with the audit log, we continue without.
+			fmt.Fprintf(os.Stderr, "%sno persisted captures: %v\n", cfg.ErrorPrefix, err)
+		} else {
+			go persisted.expire()
+		}
 	}
-
-	tl := trafficlog.New(*captureBytes, *saveBytes, &trafficlog.Options{
-		StatsInterval:  *statsInterval,
-		MutatorFactory: mutator,
-	})
+	srv := newServer(tl, *cfg, mutatorSwitch, meter, audit, persisted)
 	go func() {
 		for {
 			select {
 			case err := <-tl.Errors():
-				fmt.Fprintf(os.Stderr, "%s%v\n", *errorPrefix, err)
+				fmt.Fprintf(os.Stderr, "%s%v\n", cfg.ErrorPrefix, err)
 			case stats := <-tl.Stats():
-				b, err := json.Marshal(stats)
-				if err != nil {
-					err := fmt.Errorf("failed to marshal stats: %w", err)
-					fmt.Fprintf(os.Stderr, "%s%v\n", *errorPrefix, err)
-					continue
-				}
-				fmt.Fprintf(os.Stderr, "%s%s\n", *statsPrefix, string(b))
+				srv.recordStats(stats)
 			}
 		}
 	}()
+	go srv.publishStats()
+
+	// Capture handles are opened before we serve any requests so that we can drop privileges.
+	if len(cfg.Addresses) > 0 {
+		if err := tl.UpdateAddresses(cfg.Addresses); err != nil {
+			fail("failed to capture initial addresses:", err)
+		}
+	}
+	if cfg.DropPrivileges {
+		err := dropPrivileges()
+		switch {
+		case errors.Is(err, errPrivilegedGroupHeld):
+			// Dropping privileges is not possible, but tlserver is no more privileged than the user.
+			logError("not dropping privileges:", err)
+			srv.privilegesNotDropped = err.Error()
+		case err != nil:
+			fail("failed to drop privileges:", err)
+		default:
+			srv.privilegesDropped = true
+		}
+	}
 
 	// Note that we do not need to set an address as we are communicating over Unix domain sockets.
-	s := http.Server{Handler: tlhttp.RequestHandler(tl, os.Stderr)}
-	v := authipc.NewSignerVerifier(lanternCertCommonName)
+	s := http.Server{Handler: srv, ConnContext: connContext}
 	if debugBuild {
 		fmt.Fprintln(os.Stdout, "WARNING: this is a debug build; peer authentication is disabled")
-		v = func(_ authipc.ProcessInfo) error { return nil }
 	}
-	l, err := authipc.Listen(*socketFile, v)
+	l, err := listen(cfg.SocketFile, srv.authFailed)
 	if err != nil {
-		fail("failed to start authipc listener:", err)
+		fail(err)
 	}
-	defer l.Close()
 
-	sigC := make(chan os.Signal)
+	// On shutdown, we stop serving, close the traffic log and remove the socket. The reason is
+	// printed as an error so that it is surfaced by tlproc.
+	shutdownC := make(chan string, 1)
+	go func() {
+		sigC := make(chan os.Signal, 1)
+		signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigC
+		shutdownC <- fmt.Sprintf("received %v", sig)
+	}()
+	go func() {
+		shutdownC <- watchdog{
+			parentPID:   cfg.ParentPID,
+			idleTimeout: time.Duration(cfg.IdleTimeout),
+			lastActive:  srv.lastActive,
+		}.run()
+	}()
 	go func() {
-		<-sigC
-		os.Remove(*socketFile)
+		reason := <-shutdownC
+		fmt.Fprintf(os.Stderr, "%sshutting down: %s\n", cfg.ErrorPrefix, reason)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			logError("failed to shut down server cleanly:", err)
+			s.Close()
+		}
 	}()
-	signal.Notify(sigC, os.Interrupt, os.Kill)
 
 	fmt.Fprintln(os.Stdout, "Starting server at", l.Addr().String())
-	log.Fatal(s.Serve(loggingListener{l}))
+	if err := s.Serve(srv.listener(l)); !errors.Is(err, http.ErrServerClosed) {
+		os.Remove(cfg.SocketFile)
+		log.Fatal(err)
+	}
+	if err := tl.Close(); err != nil {
+		logError("failed to close traffic log:", err)
+	}
+	os.Remove(cfg.SocketFile)
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/getlantern/trafficlog"
+)
+
+// The traffic log's accounting overhead for each packet in its buffers, in bytes. This mirrors an
+// unexported value in the traffic log.
+const packetOverheadBytes = 160
+
+// Totals are sampled at this resolution for up to maxMeterSamples samples.
+const (
+	meterResolution = time.Second
+	maxMeterSamples = 3600
+)
+
+type meterSample struct {
+	t     time.Time
+	total int64
+}
+
+// captureMeter counts the bytes captured into the traffic log's capture buffer, as the traffic log
+// accounts for them. This lets us estimate how full the capture buffer is and how much a save
+// would copy into the save buffer.
+type captureMeter struct {
+	mx    sync.Mutex
+	total int64
+
+	// The capacity of the capture buffer and an estimate of the bytes it holds. Like the traffic
+	// log, we apply changes in capacity as packets arrive.
+	cap, buffered int64
+
+	// The total before the first packet captured in each period, oldest first.
+	samples []meterSample
+}
+
+func newCaptureMeter(captureBytes int) *captureMeter {
+	return &captureMeter{cap: int64(captureBytes)}
+}
+
+func (m *captureMeter) setCap(captureBytes int) {
+	m.mx.Lock()
+	m.cap = int64(captureBytes)
+	m.mx.Unlock()
+}
+
+func (m *captureMeter) add(n int, now time.Time) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if len(m.samples) == 0 || now.Sub(m.samples[len(m.samples)-1].t) >= meterResolution {
+		m.samples = append(m.samples, meterSample{now, m.total})
+		if len(m.samples) > maxMeterSamples {
+			m.samples = append(m.samples[:0], m.samples[1:]...)
+		}
+	}
+	m.total += int64(n)
+	m.buffered += int64(n)
+	if m.buffered > m.cap {
+		m.buffered = m.cap
+	}
+}
+
+// held estimates the bytes held in the capture buffer, including the traffic log's overhead. As
+// packets are evicted whole, the estimate may exceed the true value by the size of one packet.
+func (m *captureMeter) held() int64 {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.buffered
+}
+
+// since estimates the bytes captured since t. The estimate may exceed the true value by the bytes
+// captured in one period of meterResolution. If t predates the samples kept, the estimate covers
+// only the samples.
+func (m *captureMeter) since(t time.Time) int64 {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if len(m.samples) == 0 {
+		return m.total
+	}
+	base := m.samples[0].total
+	for _, s := range m.samples[1:] {
+		if s.t.After(t) {
+			break
+		}
+		base = s.total
+	}
+	return m.total - base
+}
+
+// factory wraps the mutator factory given to the traffic log, metering each packet captured.
+func (m *captureMeter) factory(f trafficlog.MutatorFactory) trafficlog.MutatorFactory {
+	return meteredMutators{f, m}
+}
+
+type meteredMutators struct {
+	trafficlog.MutatorFactory
+	meter *captureMeter
+}
+
+func (mm meteredMutators) MutatorFor(lt trafficlog.LinkType) trafficlog.PacketMutator {
+	var (
+		mutate = mm.MutatorFactory.MutatorFor(lt)
+		// The traffic log calls each mutator from a single goroutine.
+		cw = new(countingWriter)
+	)
+	return func(pkt []byte, w io.Writer) error {
+		cw.w, cw.n = w, 0
+		if err := mutate(pkt, cw); err != nil {
+			// The packet is dropped by the traffic log.
+			return err
+		}
+		mm.meter.add(cw.n+packetOverheadBytes, time.Now())
+		return nil
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += n
+	return n, err
+}
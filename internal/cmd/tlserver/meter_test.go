@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/getlantern/trafficlog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/mutators"
+)
+
+func TestCaptureMeter(t *testing.T) {
+	var (
+		m     = newCaptureMeter(250)
+		start = time.Now()
+		at    = func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+	)
+	require.Zero(t, m.since(start))
+
+	m.add(100, at(0))
+	m.add(100, at(10))
+	m.add(100, at(20))
+	require.EqualValues(t, 300, m.since(at(-10)))
+	require.EqualValues(t, 200, m.since(at(10)))
+	// Estimates are rounded up to the start of a sample.
+	require.EqualValues(t, 200, m.since(at(15)))
+	require.EqualValues(t, 100, m.since(at(20)))
+	require.EqualValues(t, 250, m.held())
+
+	// Packets are metered as mutated.
+	truncate, err := mutators.New(mutators.Truncate, mutators.Params{mutators.ParamBytes: "20"})
+	require.NoError(t, err)
+	buf := new(bytes.Buffer)
+	require.NoError(t, m.factory(truncate).MutatorFor(trafficlog.LinkTypeEthernet)(make([]byte, 40), buf))
+	require.Equal(t, 20, buf.Len())
+	require.EqualValues(t, 300+20+packetOverheadBytes, m.since(at(-10)))
+
+	m.setCap(1000)
+	m.add(100, at(30))
+	require.EqualValues(t, 350, m.held())
+}
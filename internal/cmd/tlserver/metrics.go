@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/trafficlog"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+// Upper bounds, in seconds, of the request latency histogram buckets.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// Requests to paths other than these are counted under "other" to bound the number of series.
+var knownPaths = map[string]bool{
+	pathUpdateAddresses:   true,
+	pathUpdateBufferSizes: true,
+	pathSaveCaptures:      true,
+	pathGetCaptures:       true,
+	"/health":             true,
+	tlapi.PathStatus:      true,
+	tlapi.PathMetrics:     true,
+	tlapi.PathReconfigure: true,
+	tlapi.PathFilters:     true,
+	tlapi.PathAnnotations: true,
+	tlapi.PathSaveWindow:  true,
+	tlapi.PathSummary:     true,
+}
+
+type requestKey struct {
+	path string
+	code int
+}
+
+type histogram struct {
+	// counts[i] is the number of observations falling in latencyBuckets[i] (non-cumulative). The
+	// final element counts observations above the last bucket.
+	counts []uint64
+	sum    float64
+	total  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(latencyBuckets, v)
+	h.counts[i]++
+	h.sum += v
+	h.total++
+}
+
+// metrics collected by the server. Exposed in the Prometheus text exposition format.
+type metrics struct {
+	mx           sync.Mutex
+	captureStats trafficlog.CaptureStats
+	requests     map[requestKey]uint64
+	latencies    map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:  map[requestKey]uint64{},
+		latencies: map[string]*histogram{},
+	}
+}
+
+func (m *metrics) recordStats(stats trafficlog.CaptureStats) {
+	m.mx.Lock()
+	m.captureStats = stats
+	m.mx.Unlock()
+}
+
+func (m *metrics) recordRequest(path string, code int, elapsed time.Duration) {
+	if !knownPaths[path] {
+		path = "other"
+	}
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.requests[requestKey{path, code}]++
+	h, ok := m.latencies[path]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.latencies[path] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+func (s *server) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	buf := new(bytes.Buffer)
+	if err := s.writeMetrics(buf); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+func (s *server) writeMetrics(w io.Writer) error {
+	saveBufferPackets, saveBufferBytes := s.measureSaveBuffer()
+	saveBufferMemory := int64(saveBufferBytes)
+	saveResidentMemory := saveBufferMemory
+	if stats := s.saveBufferStats(); stats != nil {
+		saveBufferMemory, saveResidentMemory = stats.CompressedBytes, stats.ResidentBytes
+	}
+	s.mx.Lock()
+	captureCap, saveCap := s.cfg.CaptureBytes, s.cfg.SaveBytes
+	s.mx.Unlock()
+	var captureFill, saveFill float64
+	captureBufferMemory := s.meter.held()
+	if captureCap > 0 {
+		captureFill = float64(captureBufferMemory) / float64(captureCap)
+	}
+	if saveCap > 0 {
+		saveFill = float64(saveBufferMemory) / float64(saveCap)
+	}
+
+	m := s.metrics
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	e := &expositionWriter{w: w}
+	e.metric("tlserver_packets_received_total", "counter",
+		"Packets successfully processed by the traffic log.", float64(m.captureStats.Received))
+	e.metric("tlserver_packets_dropped_total", "counter",
+		"Packets dropped by the traffic log.", float64(m.captureStats.Dropped))
+	e.metric("tlserver_capture_buffer_capacity_bytes", "gauge",
+		"Capacity of the capture buffer.", float64(captureCap))
+	// The traffic log does not expose the fill level of the capture buffer, so this is estimated.
+	e.metric("tlserver_capture_buffer_memory_bytes", "gauge",
+		"Estimated memory occupied by packets in the capture buffer.", float64(captureBufferMemory))
+	e.metric("tlserver_capture_buffer_fill_ratio", "gauge",
+		"Estimated fraction of the capture buffer in use.", captureFill)
+	e.metric("tlserver_save_buffer_capacity_bytes", "gauge",
+		"Capacity of the save buffer.", float64(saveCap))
+	e.metric("tlserver_save_buffer_bytes", "gauge",
+		"Bytes of packet data held in the save buffer.", float64(saveBufferBytes))
+	e.metric("tlserver_save_buffer_memory_bytes", "gauge",
+		"Memory occupied by packet data in the save buffer.", float64(saveBufferMemory))
+	e.metric("tlserver_save_resident_memory_bytes", "gauge",
+		"Memory occupied by saved packets, including any staged for compression.", float64(saveResidentMemory))
+	e.metric("tlserver_save_buffer_packets", "gauge",
+		"Packets held in the save buffer.", float64(saveBufferPackets))
+	e.metric("tlserver_save_buffer_fill_ratio", "gauge",
+		"Fraction of the save buffer in use.", saveFill)
+	e.metric("tlserver_auth_failures_total", "counter",
+		"Connections which failed peer authentication.", float64(atomic.LoadInt64(&s.rejectedConns)))
+	e.metric("tlserver_connections_accepted_total", "counter",
+		"Connections accepted by the server.", float64(atomic.LoadInt64(&s.acceptedConns)))
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].path != keys[j].path {
+			return keys[i].path < keys[j].path
+		}
+		return keys[i].code < keys[j].code
+	})
+	e.header("tlserver_http_requests_total", "counter", "HTTP requests by path and status code.")
+	for _, k := range keys {
+		e.sample("tlserver_http_requests_total", float64(m.requests[k]),
+			"path", k.path, "code", strconv.Itoa(k.code))
+	}
+
+	paths := make([]string, 0, len(m.latencies))
+	for path := range m.latencies {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	const latencyName = "tlserver_http_request_duration_seconds"
+	e.header(latencyName, "histogram", "HTTP request latencies by path.")
+	for _, path := range paths {
+		h := m.latencies[path]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.counts[i]
+			e.sample(latencyName+"_bucket", float64(cumulative), "path", path, "le", formatFloat(le))
+		}
+		e.sample(latencyName+"_bucket", float64(h.total), "path", path, "le", "+Inf")
+		e.sample(latencyName+"_sum", h.sum, "path", path)
+		e.sample(latencyName+"_count", float64(h.total), "path", path)
+	}
+	return e.err
+}
+
+// Returns the number of packets and bytes of packet data in the save buffer, before any
+// compression. The traffic log does not expose these, so they are measured as packets are saved.
+func (s *server) measureSaveBuffer() (packets, bytesHeld int) {
+	if stats := s.saveBufferStats(); stats != nil {
+		return stats.Packets, int(stats.LogicalBytes)
+	}
+	return s.newlySaved.held()
+}
+
+// expositionWriter writes the Prometheus text exposition format. The first write error is
+// retained and subsequent writes are skipped.
+type expositionWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *expositionWriter) printf(format string, a ...interface{}) {
+	if e.err == nil {
+		_, e.err = fmt.Fprintf(e.w, format, a...)
+	}
+}
+
+func (e *expositionWriter) header(name, metricType, help string) {
+	e.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// labels are provided as name, value pairs.
+func (e *expositionWriter) sample(name string, value float64, labels ...string) {
+	if len(labels) == 0 {
+		e.printf("%s %s\n", name, formatFloat(value))
+		return
+	}
+	buf := new(bytes.Buffer)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(buf, "%s=%s", labels[i], strconv.Quote(labels[i+1]))
+	}
+	e.printf("%s{%s} %s\n", name, buf.String(), formatFloat(value))
+}
+
+func (e *expositionWriter) metric(name, metricType, help string, value float64) {
+	e.header(name, metricType, help)
+	e.sample(name, value)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
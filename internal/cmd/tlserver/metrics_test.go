@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpositionWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	e := &expositionWriter{w: buf}
+	e.metric("test_total", "counter", "A test counter.", 3)
+	e.header("test_requests_total", "counter", "Requests.")
+	e.sample("test_requests_total", 1.5, "path", "/status", "code", "200")
+	require.NoError(t, e.err)
+
+	expected := "# HELP test_total A test counter.\n" +
+		"# TYPE test_total counter\n" +
+		"test_total 3\n" +
+		"# HELP test_requests_total Requests.\n" +
+		"# TYPE test_requests_total counter\n" +
+		"test_requests_total{path=\"/status\",code=\"200\"} 1.5\n"
+	require.Equal(t, expected, buf.String())
+}
+
+func TestHistogram(t *testing.T) {
+	m := newMetrics()
+	m.recordRequest("/status", 200, 0)
+	m.recordRequest("/status", 200, 2*time.Millisecond)
+	m.recordRequest("/unknown", 404, 0)
+
+	h := m.latencies["/status"]
+	require.Equal(t, uint64(2), h.total)
+	require.Equal(t, uint64(1), h.counts[0])
+	require.Equal(t, uint64(1), h.counts[1])
+	require.Equal(t, uint64(1), m.requests[requestKey{"other", 404}])
+}
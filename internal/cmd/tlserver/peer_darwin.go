@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns the PID and executable of the peer, if they can be determined. This requires access to
+// the underlying socket, which may not be exposed by the authipc connection.
+func identifyPeer(c net.Conn) (pid int, executable string) {
+	sc, ok := unwrapConn(c).(syscall.Conn)
+	if !ok {
+		return 0, ""
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, ""
+	}
+	rc.Control(func(fd uintptr) {
+		pid, err = unix.GetsockoptInt(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+	})
+	if err != nil {
+		return 0, ""
+	}
+
+	// The kern.procargs2 sysctl returns argc, followed by the null-terminated executable path.
+	args, err := unix.SysctlRaw("kern.procargs2", pid)
+	if err != nil || len(args) < 4 {
+		return pid, ""
+	}
+	args = args[4:]
+	if i := bytes.IndexByte(args, 0); i >= 0 {
+		args = args[:i]
+	}
+	return pid, string(args)
+}
+
+// Unwraps connections which expose the connection they wrap.
+func unwrapConn(c net.Conn) net.Conn {
+	for {
+		wrapper, ok := c.(interface{ NetConn() net.Conn })
+		if !ok {
+			return c
+		}
+		c = wrapper.NetConn()
+	}
+}
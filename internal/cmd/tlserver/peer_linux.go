@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/peercred"
+)
+
+// Returns the PID and executable of the peer, if they can be determined.
+func identifyPeer(c net.Conn) (pid int, executable string) {
+	switch conn := c.(type) {
+	case *peercred.Conn:
+		return conn.Peer.PID, conn.Peer.Executable
+	case *net.UnixConn:
+		// Debug builds do not authenticate peers, but we can still identify them.
+		if peer, err := peercred.Identify(conn); err == nil {
+			return peer.PID, peer.Executable
+		}
+	}
+	return 0, ""
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/pcapng"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+const (
+	// Persisted files are named for the writing process and numbered in the order written.
+	persistSuffix     = ".pcapng"
+	persistTempSuffix = ".tmp"
+
+	// Interval at which expired files are deleted, in addition to whenever a file is written.
+	persistCleanupInterval = 10 * time.Minute
+)
+
+// persistedCaptures writes saved packets to disk so that they survive the process. Each save is
+// written to a new pcapng file. Files left by previous processes are recovered for export. Files
+// are deleted once they expire, or when the total size exceeds the cap, oldest first.
+type persistedCaptures struct {
+	dir    string
+	prefix string
+	ttl    time.Duration
+
+	// Recorded in each file written by this process.
+	comment string
+
+	cap int64
+
+	mx  sync.Mutex
+	seq int
+}
+
+// Opens the persisted captures in the install directory.
+func openPersisted(cfg *tlapi.Config) (*persistedCaptures, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to locate install directory: %w", err)
+	}
+	dir := filepath.Join(filepath.Dir(self), tlapi.PersistDirName)
+	return openPersistedCaptures(dir, int64(cfg.PersistBytes), time.Duration(cfg.PersistTTL))
+}
+
+// Opens the directory, creating it if necessary. The directory must be owned by the current user;
+// it is made accessible only by that user.
+func openPersistedCaptures(dir string, cap int64, ttl time.Duration) (*persistedCaptures, error) {
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return nil, fmt.Errorf("failed to create directory: %w", err)
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat directory: %w", err)
+	}
+	statT, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, errors.New("failed to obtain detailed stat info for directory")
+	}
+	if !info.IsDir() || int(statT.Uid) != os.Getuid() {
+		return nil, fmt.Errorf("%s is not a directory owned by the current user", dir)
+	}
+	if info.Mode().Perm() != 0700 {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to restrict permissions on directory: %w", err)
+		}
+	}
+	if ttl <= 0 {
+		ttl = tlapi.DefaultPersistTTL
+	}
+	start := time.Now()
+	pc := &persistedCaptures{
+		dir:    dir,
+		prefix: fmt.Sprintf("%d-%d-", os.Getpid(), start.UnixNano()),
+		ttl:    ttl,
+		comment: fmt.Sprintf("persisted by tlserver %s, PID %d, started at %s",
+			version, os.Getpid(), start.UTC().Format(time.RFC3339)),
+		cap: cap,
+	}
+	if err := pc.cleanup(); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// write persists a pcapng file. The file is written in full before it is given its final name, so
+// that a partially written file is never recovered.
+func (pc *persistedCaptures) write(contents []byte) error {
+	pc.mx.Lock()
+	pc.seq++
+	name := fmt.Sprintf("%s%08d%s", pc.prefix, pc.seq, persistSuffix)
+	pc.mx.Unlock()
+
+	path := filepath.Join(pc.dir, name)
+	f, err := os.OpenFile(path+persistTempSuffix, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	_, err = f.Write(contents)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(path+persistTempSuffix, path)
+	}
+	if err != nil {
+		os.Remove(path + persistTempSuffix)
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return pc.cleanup()
+}
+
+type persistedFile struct {
+	path      string
+	size      int64
+	modTime   time.Time
+	recovered bool
+}
+
+// Lists the persisted files, oldest first.
+func (pc *persistedCaptures) list() ([]persistedFile, error) {
+	infos, err := ioutil.ReadDir(pc.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %w", err)
+	}
+	files := []persistedFile{}
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || !strings.HasSuffix(info.Name(), persistSuffix) {
+			continue
+		}
+		files = append(files, persistedFile{
+			path:      filepath.Join(pc.dir, info.Name()),
+			size:      info.Size(),
+			modTime:   info.ModTime(),
+			recovered: !strings.HasPrefix(info.Name(), pc.prefix),
+		})
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	return files, nil
+}
+
+// Deletes expired files and, if the cap is exceeded, the oldest files. Temporary files left by
+// previous processes are deleted too.
+func (pc *persistedCaptures) cleanup() error {
+	pc.mx.Lock()
+	defer pc.mx.Unlock()
+
+	if infos, err := ioutil.ReadDir(pc.dir); err == nil {
+		for _, info := range infos {
+			name := info.Name()
+			if strings.HasSuffix(name, persistTempSuffix) && !strings.HasPrefix(name, pc.prefix) {
+				os.Remove(filepath.Join(pc.dir, name))
+			}
+		}
+	}
+	files, err := pc.list()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	for _, f := range files {
+		if time.Since(f.modTime) <= pc.ttl && total <= pc.cap {
+			continue
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete persisted file: %w", err)
+		}
+		total -= f.size
+	}
+	return nil
+}
+
+// Deletes expired files at persistCleanupInterval. Never returns.
+func (pc *persistedCaptures) expire() {
+	for range time.Tick(persistCleanupInterval) {
+		if err := pc.cleanup(); err != nil {
+			logError("failed to clean up persisted captures:", err)
+		}
+	}
+}
+
+func (pc *persistedCaptures) stats() (*tlapi.PersistedStats, error) {
+	pc.mx.Lock()
+	defer pc.mx.Unlock()
+	files, err := pc.list()
+	if err != nil {
+		return nil, err
+	}
+	stats := &tlapi.PersistedStats{Files: len(files)}
+	for _, f := range files {
+		stats.Bytes += f.size
+		if f.recovered {
+			stats.RecoveredFiles++
+		}
+	}
+	return stats, nil
+}
+
+// Returns the contents of the unexpired files left by previous processes, oldest first. Files which
+// cannot be read are skipped.
+func (pc *persistedCaptures) recovered() [][]byte {
+	pc.mx.Lock()
+	files, err := pc.list()
+	pc.mx.Unlock()
+	if err != nil {
+		logError("failed to list persisted captures:", err)
+		return nil
+	}
+	contents := [][]byte{}
+	for _, f := range files {
+		if !f.recovered || time.Since(f.modTime) > pc.ttl {
+			continue
+		}
+		b, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			logError("failed to read persisted captures:", err)
+			continue
+		}
+		contents = append(contents, b)
+	}
+	return contents
+}
+
+// Writes newly saved packets to disk. The mutator applied to each packet and the labels of the
+// windows containing it are recorded as comments, as they would be on export. The captured hosts
+// are recorded in a section comment, for use in anonymizing the file once recovered.
+//
+// Packets outside every saved window are not persisted, as they would not be exported. These are
+// kept, and persisted if a later save covers them, until packets captured up to the time they were
+// may have been lost. Must be called with s.processMx held.
+func (s *server) persist(packets []savedPacket, lost time.Time) error {
+	candidates := []savedPacket{}
+	for _, p := range s.unpersisted {
+		if p.ci.Timestamp.After(lost) {
+			candidates = append(candidates, p)
+		}
+	}
+	candidates = append(candidates, packets...)
+	s.unpersisted = nil
+	if len(candidates) == 0 {
+		return nil
+	}
+	raw := new(bytes.Buffer)
+	pw, err := newSavedPacketWriter(raw)
+	if err != nil {
+		return err
+	}
+	for _, p := range candidates {
+		if err := pw.write(p); err != nil {
+			return err
+		}
+	}
+	if err := pw.flush(); err != nil {
+		return err
+	}
+
+	var (
+		saveFilter = s.saves.exportFilter()
+		next, kept int
+	)
+	rw := pcapng.Rewriter{
+		SectionComments: []string{s.persisted.comment, s.capturedHostsComment()},
+		Packet: func(p *pcapng.Packet, iface pcapng.Interface) (bool, error) {
+			// Packets are written in the order of the candidates.
+			candidate := candidates[next]
+			next++
+			p.AddComment("mutator: " + s.mutator.labelAt(p.Time(iface)))
+			if !saveFilter.filter(p, iface) {
+				s.unpersisted = append(s.unpersisted, candidate)
+				return false, nil
+			}
+			kept++
+			return true, nil
+		},
+	}
+	annotated := new(bytes.Buffer)
+	if err := rw.Rewrite(raw, annotated); err != nil {
+		return fmt.Errorf("failed to annotate packets: %w", err)
+	}
+	if kept == 0 {
+		return nil
+	}
+	return s.persisted.write(annotated.Bytes())
+}
+
+// Writes the captures recovered from previous processes, each in a section of its own. If
+// anonymize is true, local addresses are replaced with pseudonyms. The addresses of the hosts
+// captured by this process, or recorded as captured by the process which wrote the file, are kept.
+// Files which cannot be parsed are skipped.
+func (s *server) writeRecovered(w io.Writer, anonymize bool) error {
+	if s.persisted == nil {
+		return nil
+	}
+	for _, contents := range s.persisted.recovered() {
+		rw := pcapng.Rewriter{}
+		if anonymize {
+			anonymizer := s.anonymizer
+			rw.SectionComments = []string{anonymizedComment}
+			rw.Section = func(comments []string) error {
+				hosts := parseCapturedHosts(comments)
+				anonymizer = s.anonymizer.AlsoKeeping(func(ip net.IP) bool { return hosts[ip.String()] })
+				return nil
+			}
+			rw.Packet = func(p *pcapng.Packet, iface pcapng.Interface) (bool, error) {
+				anonymizer.Packet(p.Data, iface.LinkType)
+				return true, nil
+			}
+		}
+		buf := new(bytes.Buffer)
+		if err := rw.Rewrite(bytes.NewReader(contents), buf); err != nil {
+			logError("skipping bad persisted captures:", err)
+			continue
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
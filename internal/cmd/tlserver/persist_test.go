@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistedCaptures(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "saved-captures")
+
+	previous, err := openPersistedCaptures(dir, 1024, time.Hour)
+	require.NoError(t, err)
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	require.NoError(t, previous.write([]byte("expired")))
+	require.NoError(t, previous.write([]byte("first")))
+	require.NoError(t, previous.write([]byte("second")))
+	files, err := previous.list()
+	require.NoError(t, err)
+	require.Len(t, files, 3)
+	for _, f := range files {
+		info, err := os.Stat(f.path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		require.False(t, f.recovered)
+	}
+	// Order the files by age, expiring the first.
+	for i, f := range files {
+		modTime := time.Now().Add(time.Duration(i-len(files)) * time.Minute)
+		if i == 0 {
+			modTime = time.Now().Add(-2 * time.Hour)
+		}
+		require.NoError(t, os.Chtimes(f.path, modTime, modTime))
+	}
+
+	// The files of the previous process should be recovered, except the expired one.
+	pc, err := openPersistedCaptures(dir, 1024, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{[]byte("first"), []byte("second")}, pc.recovered())
+
+	// Exceeding the cap should delete the oldest files.
+	pc.cap = int64(len("second") + 1000)
+	require.NoError(t, pc.write(make([]byte, 1000)))
+	require.Equal(t, [][]byte{[]byte("second")}, pc.recovered())
+	stats, err := pc.stats()
+	require.NoError(t, err)
+	require.Equal(t, 2, stats.Files)
+	require.Equal(t, 1, stats.RecoveredFiles)
+	require.Equal(t, int64(1006), stats.Bytes)
+
+	// Temporary files left by previous processes should be deleted.
+	stray := filepath.Join(dir, "1-1-00000001.pcapng"+persistTempSuffix)
+	require.NoError(t, ioutil.WriteFile(stray, nil, 0600))
+	require.NoError(t, pc.cleanup())
+	_, err = os.Stat(stray)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestCapturedHostsComment(t *testing.T) {
+	s := &server{capturedIPs: map[string]bool{}}
+	s.addCapturedHosts([]string{"10.0.0.1:443", "[2001:db8::1]:443"})
+	comment := s.capturedHostsComment()
+	require.Equal(t, capturedHostsPrefix+"10.0.0.1, 2001:db8::1", comment)
+	require.Equal(t,
+		map[string]bool{"10.0.0.1": true, "2001:db8::1": true},
+		parseCapturedHosts([]string{"persisted by tlserver", comment}))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+// errPrivilegedGroupHeld is returned by dropPrivileges if the privileged group is one of the
+// supplementary groups of the user running tlserver. This is the case for users of other capture
+// tools, such as Wireshark, whose BPF group tlserver has adopted.
+var errPrivilegedGroupHeld = errors.New("the user is a member of the privileged group, which only root can remove")
+
+// dropPrivileges gives up the group privileges held by tlserver: the effective and saved group IDs
+// granted by the setgid bit, and any supplementary groups. The drop is then verified. Clearing the
+// supplementary groups requires root, which tlserver does not have, so tlserver instead ensures that
+// the privileged group is not among them; if it is, errPrivilegedGroupHeld is returned.
+//
+// This is not supported on Linux, where tlserver's capture privileges are file capabilities rather
+// than a group.
+func dropPrivileges() error {
+	rgid, egid := syscall.Getgid(), syscall.Getegid()
+	if err := syscall.Setgroups([]int{}); err != nil && !errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("failed to clear supplementary groups: %w", err)
+	}
+	if egid != rgid {
+		// Setting the real group ID also sets the saved group ID.
+		if err := syscall.Setregid(rgid, rgid); err != nil {
+			return fmt.Errorf("failed to set group IDs: %w", err)
+		}
+	}
+	return verifyDrop(rgid, egid)
+}
+
+// Checks that the group privileges have been dropped and cannot be regained.
+func verifyDrop(rgid, privilegedGID int) error {
+	if gid := syscall.Getegid(); gid != rgid {
+		return fmt.Errorf("effective group ID is %d, expected %d", gid, rgid)
+	}
+	if privilegedGID == rgid {
+		// We were not running with any group privileges.
+		return nil
+	}
+	groups, err := syscall.Getgroups()
+	if err != nil {
+		return fmt.Errorf("failed to get supplementary groups: %w", err)
+	}
+	for _, gid := range groups {
+		if gid == privilegedGID {
+			return fmt.Errorf("%w (group %d)", errPrivilegedGroupHeld, gid)
+		}
+	}
+	if err := syscall.Setegid(privilegedGID); err == nil {
+		return fmt.Errorf("able to regain privileged group %d", privilegedGID)
+	}
+	return nil
+}
+
+// currentPrivileges reports the group privileges currently held by the process. If privileges were
+// to be dropped but could not be, notDropped explains why.
+func currentPrivileges(dropped bool, notDropped string) tlapi.Privileges {
+	groups, err := syscall.Getgroups()
+	if err != nil {
+		logError("failed to get supplementary groups:", err)
+	}
+	if groups == nil {
+		groups = []int{}
+	}
+	return tlapi.Privileges{
+		Dropped:           dropped,
+		NotDropped:        notDropped,
+		RealGID:           syscall.Getgid(),
+		EffectiveGID:      syscall.Getegid(),
+		SupplementaryGIDs: groups,
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/trafficlog"
+	"github.com/getlantern/trafficlog-flashlight/internal/mutators"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+// Describes a mutator and its parameters, e.g. "truncate(bytes=64)".
+func mutatorLabel(name string, params map[string]string) string {
+	if len(params) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(params))
+	for k, v := range params {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return fmt.Sprintf("%s(%s)", name, strings.Join(pairs, ","))
+}
+
+type mutatorChange struct {
+	since time.Time
+	label string
+}
+
+// mutatorSwitch is the mutator factory given to the traffic log. It delegates to a factory which
+// may be replaced at runtime. Because packets are mutated as they are captured, packets already
+// in the buffers retain the mutations applied when they were captured. A history of changes is
+// kept so that the mutator applied to each packet can be recorded on export.
+type mutatorSwitch struct {
+	mx      sync.Mutex
+	current trafficlog.MutatorFactory
+	gen     int
+	history []mutatorChange
+}
+
+func newMutatorSwitch(name string, params map[string]string, f trafficlog.MutatorFactory) *mutatorSwitch {
+	return &mutatorSwitch{
+		current: f,
+		history: []mutatorChange{{time.Time{}, mutatorLabel(name, params)}},
+	}
+}
+
+func (m *mutatorSwitch) set(name string, params map[string]string, f trafficlog.MutatorFactory) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.current = f
+	m.gen++
+	m.history = append(m.history, mutatorChange{time.Now(), mutatorLabel(name, params)})
+}
+
+func (m *mutatorSwitch) get() (trafficlog.MutatorFactory, int) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return m.current, m.gen
+}
+
+// labelAt returns the label of the mutator in effect at the input time. Packets are timestamped
+// slightly before they are mutated, so packets captured immediately before a change may be
+// attributed to the previous mutator.
+func (m *mutatorSwitch) labelAt(t time.Time) string {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	label := m.history[0].label
+	for _, change := range m.history[1:] {
+		if change.since.After(t) {
+			break
+		}
+		label = change.label
+	}
+	return label
+}
+
+// MutatorFor implements trafficlog.MutatorFactory.
+func (m *mutatorSwitch) MutatorFor(lt trafficlog.LinkType) trafficlog.PacketMutator {
+	var (
+		gen     = -1
+		mutator trafficlog.PacketMutator
+	)
+	return func(pkt []byte, w io.Writer) error {
+		if f, currentGen := m.get(); currentGen != gen {
+			mutator, gen = f.MutatorFor(lt), currentGen
+		}
+		return mutator(pkt, w)
+	}
+}
+
+// Stats are collected from the traffic log at trafficlog.MinimumStatsInterval, but published on
+// stderr at the configured interval, which may be changed at runtime.
+func (s *server) recordStats(stats trafficlog.CaptureStats) {
+	s.metrics.recordStats(stats)
+	s.mx.Lock()
+	s.latestStats = &stats
+	s.mx.Unlock()
+}
+
+func (s *server) publishStats() {
+	s.mx.Lock()
+	interval := time.Duration(s.cfg.StatsInterval)
+	s.mx.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case interval = <-s.statsIntervalC:
+			ticker.Reset(interval)
+			continue
+		case <-ticker.C:
+		}
+		s.mx.Lock()
+		stats, errorPrefix, statsPrefix := s.latestStats, s.cfg.ErrorPrefix, s.cfg.StatsPrefix
+		s.mx.Unlock()
+		if stats == nil {
+			continue
+		}
+		b, err := json.Marshal(tlapi.Stats{
+			Received:   stats.Received,
+			Dropped:    stats.Dropped,
+			Filters:    s.filterStats(),
+			SaveBuffer: s.saveBufferStats(),
+		})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%sfailed to marshal stats: %v\n", errorPrefix, err)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s%s\n", statsPrefix, string(b))
+	}
+}
+
+func (s *server) reconfigure(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	r := new(tlapi.Reconfiguration)
+	if err := json.NewDecoder(req.Body).Decode(r); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to decode request: %v", err))
+		return
+	}
+	if r.StatsInterval < 0 {
+		writeError(w, http.StatusBadRequest, "StatsInterval must not be negative")
+		return
+	}
+	var f trafficlog.MutatorFactory
+	if r.Mutator != "" {
+		var err error
+		if f, err = mutators.New(r.Mutator, r.MutatorParams); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if r.StatsInterval > 0 {
+		interval := time.Duration(r.StatsInterval)
+		if interval < trafficlog.MinimumStatsInterval {
+			interval = trafficlog.MinimumStatsInterval
+		}
+		s.cfg.StatsInterval = tlapi.Duration(interval)
+		// Replace any pending update.
+		select {
+		case <-s.statsIntervalC:
+		default:
+		}
+		s.statsIntervalC <- interval
+	}
+	if f != nil && mutatorLabel(r.Mutator, r.MutatorParams) != mutatorLabel(s.cfg.Mutator, s.cfg.MutatorParams) {
+		s.mutator.set(r.Mutator, r.MutatorParams, f)
+		s.cfg.Mutator, s.cfg.MutatorParams = r.Mutator, r.MutatorParams
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
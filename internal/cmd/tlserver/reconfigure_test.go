@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/mutators"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+func TestReconfigure(t *testing.T) {
+	f, err := mutators.New(mutators.StripAppLayer, nil)
+	require.NoError(t, err)
+	s := &server{
+		mutator:        newMutatorSwitch(mutators.StripAppLayer, nil, f),
+		statsIntervalC: make(chan time.Duration, 1),
+		cfg: tlapi.Config{
+			StatsInterval: tlapi.Duration(time.Minute),
+			Mutator:       mutators.StripAppLayer,
+		},
+	}
+	reconfigure := func(r tlapi.Reconfiguration) int {
+		body, err := json.Marshal(r)
+		require.NoError(t, err)
+		rec := httptest.NewRecorder()
+		s.reconfigure(rec, httptest.NewRequest(http.MethodPut, tlapi.PathReconfigure, bytes.NewReader(body)))
+		return rec.Code
+	}
+
+	// Changing only the interval must leave the mutator in place.
+	require.Equal(t, http.StatusNoContent, reconfigure(tlapi.Reconfiguration{StatsInterval: tlapi.Duration(time.Hour)}))
+	require.Equal(t, time.Hour, <-s.statsIntervalC)
+	require.Equal(t, mutators.StripAppLayer, s.cfg.Mutator)
+	require.Equal(t, mutators.StripAppLayer, s.mutator.labelAt(time.Now()))
+
+	require.Equal(t, http.StatusNoContent, reconfigure(tlapi.Reconfiguration{Mutator: mutators.None}))
+	require.Equal(t, tlapi.Duration(time.Hour), s.cfg.StatsInterval)
+	require.Equal(t, mutators.None, s.mutator.labelAt(time.Now()))
+	require.Empty(t, s.statsIntervalC)
+
+	require.Equal(t, http.StatusBadRequest, reconfigure(tlapi.Reconfiguration{Mutator: "unknown"}))
+}
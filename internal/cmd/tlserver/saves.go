@@ -0,0 +1,367 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/pcapng"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+// Path of the tlhttp endpoint for saving captures, which the server intercepts.
+const pathSaveCaptures = "/save-captures"
+
+// Only the most recent saves are kept. Packets captured before the end of the most recently
+// discarded save are exported regardless of the remaining saves.
+const maxSaves = 10000
+
+// Added to the duration of each save made with the traffic log, covering the time between our
+// computing the duration and the traffic log applying it.
+const saveMargin = 100 * time.Millisecond
+
+// A windowed save is refused if the packets captured since the window ended, which the save would
+// also copy, would fill more than this fraction of the save buffer. Packets captured to and from
+// every address are counted, as the traffic log does not track the bytes captured per address.
+const maxSaveWindowExcessDivisor = 2
+
+// The number of times a windowed save is repeated if it evicts packets stored for the window.
+const maxSaveRetries = 2
+
+type interval struct {
+	start, end time.Time
+}
+
+func (i interval) contains(t time.Time) bool {
+	return !t.Before(i.start) && !t.After(i.end)
+}
+
+// saveRecord describes a save of the packets captured to or from an address.
+type saveRecord struct {
+	interval
+	address, label string
+
+	// Resolved from the address. If there are no IPs, the record matches packets to or from any
+	// host. The port is zero if it could not be parsed.
+	ips  []net.IP
+	port uint16
+}
+
+// Host names are resolved as they are by the traffic log.
+func newSaveRecord(address string, start, end time.Time, label string) saveRecord {
+	rec := saveRecord{interval: interval{start, end}, address: address, label: label}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return rec
+	}
+	if p, err := strconv.ParseUint(port, 10, 16); err == nil {
+		rec.port = uint16(p)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		rec.ips = []net.IP{ip}
+	} else if resolved, err := net.LookupIP(host); err == nil {
+		rec.ips = resolved
+	}
+	return rec
+}
+
+func (rec saveRecord) match(ep *packetEndpoints) bool {
+	if len(rec.ips) == 0 {
+		return true
+	}
+	for _, ip := range rec.ips {
+		if ep.match(ip, rec.port) {
+			return true
+		}
+	}
+	return false
+}
+
+// saves keeps track of the packets saved with the traffic log so that overlapping saves are not
+// stored twice and so that exports can be limited to the windows requested.
+//
+// The traffic log can only save the packets captured between some point in the past and the
+// present. A windowed save therefore stores everything from the earliest point in the window not
+// already stored up to the present. Stored intervals are forgotten once their packets may have
+// been evicted from the save buffer. On export, duplicates are dropped, as are packets outside
+// every window saved for their address.
+type saves struct {
+	mx      sync.Mutex
+	records []saveRecord
+
+	// Windowed saves, as requested, recorded in exported captures.
+	windows []tlapi.SaveWindow
+
+	// The intervals copied to the traffic log's save buffer, by address. Sorted and merged.
+	stored map[string][]interval
+
+	// Packets captured before this time are exported regardless of the records.
+	horizon time.Time
+}
+
+func newSaves() *saves {
+	return &saves{stored: map[string][]interval{}}
+}
+
+// saveWindow records a windowed save for each of the window's addresses, then stores the window.
+func (sv *saves) saveWindow(sw tlapi.SaveWindow, captured func(addr string) bool, saveFn func(addr string, d time.Duration)) {
+	records := make([]saveRecord, 0, len(sw.Addresses))
+	for _, addr := range sw.Addresses {
+		records = append(records, newSaveRecord(addr, sw.Start, sw.End, sw.Label))
+	}
+
+	sv.mx.Lock()
+	defer sv.mx.Unlock()
+	sv.store(sw, captured, saveFn)
+	for _, rec := range records {
+		sv.add(rec)
+	}
+	sv.windows = append(sv.windows, sw)
+	if len(sv.windows) > maxSaves {
+		sv.windows = sv.windows[len(sv.windows)-maxSaves:]
+	}
+}
+
+// storeWindow stores a window already recorded with saveWindow. This is used to save the window
+// again once packets stored for it have been evicted.
+func (sv *saves) storeWindow(sw tlapi.SaveWindow, captured func(addr string) bool, saveFn func(addr string, d time.Duration)) bool {
+	sv.mx.Lock()
+	defer sv.mx.Unlock()
+	return sv.store(sw, captured, saveFn)
+}
+
+// For each of the window's addresses which is being captured and for which the window is not
+// already stored, saveFn is called to save the packets captured for the address within the input
+// duration. Reports whether saveFn was called. Must be called with sv.mx held.
+func (sv *saves) store(sw tlapi.SaveWindow, captured func(addr string) bool, saveFn func(addr string, d time.Duration)) bool {
+	saved := false
+	for _, addr := range sw.Addresses {
+		if from, ok := uncovered(sv.stored[addr], interval{sw.Start, sw.End}); ok && captured(addr) {
+			now := time.Now()
+			saveFn(addr, now.Sub(from)+saveMargin)
+			sv.stored[addr] = mergeInterval(sv.stored[addr], interval{from, now})
+			saved = true
+		}
+	}
+	return saved
+}
+
+// forget drops the stored intervals, for every address, up to and including the input time. This
+// is called when packets captured up to that time have been evicted, so that later saves covering
+// the time store the packets again. The records are kept, as any copies remaining in the buffer
+// are still exported.
+func (sv *saves) forget(through time.Time) {
+	sv.mx.Lock()
+	defer sv.mx.Unlock()
+	for addr, stored := range sv.stored {
+		kept := []interval{}
+		for _, i := range stored {
+			if !i.end.After(through) {
+				continue
+			}
+			if !i.start.After(through) {
+				i.start = through.Add(time.Nanosecond)
+			}
+			kept = append(kept, i)
+		}
+		if len(kept) == 0 {
+			delete(sv.stored, addr)
+		} else {
+			sv.stored[addr] = kept
+		}
+	}
+}
+
+// recordSave records a save made directly with the traffic log.
+func (sv *saves) recordSave(addr string, d time.Duration) {
+	end := time.Now()
+	rec := newSaveRecord(addr, end.Add(-d), end, "")
+
+	sv.mx.Lock()
+	defer sv.mx.Unlock()
+	sv.stored[addr] = mergeInterval(sv.stored[addr], rec.interval)
+	sv.add(rec)
+}
+
+// Must be called with sv.mx held.
+func (sv *saves) add(rec saveRecord) {
+	sv.records = append(sv.records, rec)
+	if len(sv.records) <= maxSaves {
+		return
+	}
+	for _, discarded := range sv.records[:len(sv.records)-maxSaves] {
+		if discarded.end.After(sv.horizon) {
+			sv.horizon = discarded.end
+		}
+	}
+	sv.records = append([]saveRecord{}, sv.records[len(sv.records)-maxSaves:]...)
+	for addr, stored := range sv.stored {
+		for len(stored) > 0 && stored[0].end.Before(sv.horizon) {
+			stored = stored[1:]
+		}
+		if len(stored) == 0 {
+			delete(sv.stored, addr)
+		} else {
+			sv.stored[addr] = stored
+		}
+	}
+}
+
+// Returns the earliest time in the window which is not covered by the stored intervals, if any.
+// The stored intervals must be sorted and merged.
+func uncovered(stored []interval, window interval) (time.Time, bool) {
+	t := window.start
+	for _, i := range stored {
+		if i.end.Before(t) {
+			continue
+		}
+		if i.start.After(t) {
+			break
+		}
+		t = i.end
+	}
+	return t, t.Before(window.end)
+}
+
+// Adds the new interval to the sorted, merged intervals, merging it with any it overlaps.
+func mergeInterval(intervals []interval, i interval) []interval {
+	all := append(append([]interval{}, intervals...), i)
+	sort.Slice(all, func(i, j int) bool { return all[i].start.Before(all[j].start) })
+	merged := all[:1]
+	for _, next := range all[1:] {
+		last := &merged[len(merged)-1]
+		if next.start.After(last.end) {
+			merged = append(merged, next)
+		} else if next.end.After(last.end) {
+			last.end = next.end
+		}
+	}
+	return merged
+}
+
+// Returns a filter for a single export of the saved packets.
+func (sv *saves) exportFilter() *saveFilter {
+	sv.mx.Lock()
+	defer sv.mx.Unlock()
+	f := &saveFilter{
+		records: append([]saveRecord{}, sv.records...),
+		windows: append([]tlapi.SaveWindow{}, sv.windows...),
+		horizon: sv.horizon,
+		seen:    map[packetKey]bool{},
+	}
+	sort.SliceStable(f.records, func(i, j int) bool { return f.records[i].start.Before(f.records[j].start) })
+	return f
+}
+
+type packetKey struct {
+	linkType  uint16
+	timestamp int64
+	sum       [sha256.Size]byte
+}
+
+// saveFilter drops duplicate packets, and packets outside every window saved for their address,
+// from an export. The labels of the windows containing each packet are recorded as comments.
+type saveFilter struct {
+	records []saveRecord // sorted by start time
+	windows []tlapi.SaveWindow
+	horizon time.Time
+	seen    map[packetKey]bool
+}
+
+// Reports whether the packet should be exported.
+func (f *saveFilter) filter(p *pcapng.Packet, iface pcapng.Interface) bool {
+	ts := p.Time(iface)
+	key := packetKey{iface.LinkType, ts.UnixNano(), sha256.Sum256(p.Data)}
+	if f.seen[key] {
+		return false
+	}
+	f.seen[key] = true
+
+	keep := ts.Before(f.horizon) || len(f.records) == 0
+	var (
+		ep     *packetEndpoints
+		labels = map[string]bool{}
+	)
+	for _, rec := range f.records {
+		if rec.start.After(ts) {
+			break
+		}
+		if !rec.contains(ts) {
+			continue
+		}
+		if len(rec.ips) > 0 && ep == nil {
+			ep = endpointsOf(p.Data, iface.LinkType)
+		}
+		if !rec.match(ep) {
+			continue
+		}
+		keep = true
+		if rec.label != "" && !labels[rec.label] {
+			labels[rec.label] = true
+			p.AddComment("save: " + rec.label)
+		}
+	}
+	return keep
+}
+
+func (f *saveFilter) sectionComments() []string {
+	comments := []string{}
+	for _, sw := range f.windows {
+		comments = append(comments, sw.Comment())
+	}
+	return comments
+}
+
+func (s *server) saveWindow(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	sw := new(tlapi.SaveWindow)
+	if err := json.NewDecoder(req.Body).Decode(sw); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to decode request: %v", err))
+		return
+	}
+	if err := sw.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if now := time.Now(); sw.End.After(now) {
+		if !sw.Start.Before(now) {
+			writeError(w, http.StatusBadRequest, "window starts in the future")
+			return
+		}
+		sw.End = now
+	}
+	// The traffic log can only save up to the present, so everything captured since the window
+	// ended is copied too, evicting earlier saves.
+	s.mx.Lock()
+	saveBytes := s.cfg.SaveBytes
+	s.mx.Unlock()
+	if excess, limit := s.meter.since(sw.End), int64(saveBytes)/maxSaveWindowExcessDivisor; excess > limit {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf(
+			"window ended too long ago: saving it would also copy an estimated %d bytes captured since, over the limit of %d",
+			excess, limit))
+		return
+	}
+	addresses := map[string]bool{}
+	for _, addr := range s.currentAddresses() {
+		addresses[addr] = true
+	}
+	captured := func(addr string) bool { return addresses[addr] }
+	s.saves.saveWindow(*sw, captured, s.tl.SaveCaptures)
+	// Saving may evict packets stored for earlier saves, including those stored for this window.
+	// Any part of the window no longer stored is saved again.
+	for i := 0; s.processSaves() && i < maxSaveRetries; i++ {
+		if !s.saves.storeWindow(*sw, captured, s.tl.SaveCaptures) {
+			break
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
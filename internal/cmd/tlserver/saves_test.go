@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/pcapng"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+func TestSaveWindow(t *testing.T) {
+	var (
+		now   = time.Now()
+		proxy = "203.0.113.7:443"
+		saved []time.Duration
+	)
+	sv := newSaves()
+	save := func(start, end time.Time, label string) {
+		sv.saveWindow(
+			tlapi.SaveWindow{Addresses: []string{proxy}, Start: start, End: end, Label: label},
+			func(string) bool { return true },
+			func(_ string, d time.Duration) { saved = append(saved, d) })
+	}
+
+	save(now.Add(-time.Minute), now.Add(-30*time.Second), "issue-1")
+	require.Len(t, saved, 1)
+	require.InDelta(t, time.Minute+saveMargin, saved[0], float64(time.Second))
+
+	// Already stored, so nothing should be saved.
+	save(now.Add(-50*time.Second), now.Add(-40*time.Second), "issue-2")
+	require.Len(t, saved, 1)
+
+	// Only the portion before the stored interval should be saved.
+	save(now.Add(-2*time.Minute), now.Add(-90*time.Second), "issue-3")
+	require.Len(t, saved, 2)
+	require.InDelta(t, 2*time.Minute+saveMargin, saved[1], float64(time.Second))
+	require.Len(t, sv.stored[proxy], 1)
+	require.Len(t, sv.records, 3)
+
+	// Once the stored packets have been evicted, the window should be saved again.
+	sv.forget(now.Add(-45 * time.Second))
+	save(now.Add(-50*time.Second), now.Add(-40*time.Second), "issue-2")
+	require.Len(t, saved, 3)
+	require.InDelta(t, 50*time.Second+saveMargin, saved[2], float64(time.Second))
+	sv.forget(time.Now())
+	require.Empty(t, sv.stored)
+}
+
+func TestMergeInterval(t *testing.T) {
+	base := time.Date(2022, 9, 3, 14, 30, 0, 0, time.UTC)
+	at := func(seconds int) time.Time { return base.Add(time.Duration(seconds) * time.Second) }
+
+	var intervals []interval
+	intervals = mergeInterval(intervals, interval{at(10), at(20)})
+	intervals = mergeInterval(intervals, interval{at(30), at(40)})
+	intervals = mergeInterval(intervals, interval{at(0), at(5)})
+	require.Equal(t, []interval{{at(0), at(5)}, {at(10), at(20)}, {at(30), at(40)}}, intervals)
+
+	from, ok := uncovered(intervals, interval{at(12), at(35)})
+	require.True(t, ok)
+	require.Equal(t, at(20), from)
+	_, ok = uncovered(intervals, interval{at(32), at(38)})
+	require.False(t, ok)
+
+	intervals = mergeInterval(intervals, interval{at(15), at(30)})
+	require.Equal(t, []interval{{at(0), at(5)}, {at(10), at(40)}}, intervals)
+}
+
+func TestSaveFilter(t *testing.T) {
+	var (
+		start  = time.Date(2022, 9, 3, 14, 30, 0, 0, time.UTC)
+		local  = net.IPv4(192, 168, 1, 20)
+		proxyA = net.IPv4(203, 0, 113, 7)
+		proxyB = net.IPv4(203, 0, 113, 8)
+	)
+
+	src := new(bytes.Buffer)
+	w, err := pcapgo.NewNgWriter(src, layers.LinkTypeEthernet)
+	require.NoError(t, err)
+	writePacket := func(dst net.IP, ts time.Time) {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: local, DstIP: dst}
+		tcp := &layers.TCP{SrcPort: 50000, DstPort: 443}
+		require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+		buf := gopacket.NewSerializeBuffer()
+		require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+			&layers.Ethernet{SrcMAC: make(net.HardwareAddr, 6), DstMAC: make(net.HardwareAddr, 6), EthernetType: layers.EthernetTypeIPv4},
+			ip, tcp))
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(buf.Bytes()), Length: len(buf.Bytes())}
+		require.NoError(t, w.WritePacket(ci, buf.Bytes()))
+	}
+	writePacket(proxyA, start)                     // in the window
+	writePacket(proxyA, start)                     // duplicate
+	writePacket(proxyB, start.Add(time.Second))    // wrong address
+	writePacket(proxyA, start.Add(2*time.Second))  // in both windows
+	writePacket(proxyA, start.Add(10*time.Second)) // after both windows
+	require.NoError(t, w.Flush())
+
+	sv := newSaves()
+	sv.records = []saveRecord{
+		newSaveRecord("203.0.113.7:443", start, start.Add(5*time.Second), "issue-1"),
+		newSaveRecord("203.0.113.7:443", start.Add(time.Second), start.Add(5*time.Second), "dial-failure"),
+	}
+	sv.windows = []tlapi.SaveWindow{
+		{Addresses: []string{"203.0.113.7:443"}, Start: start, End: start.Add(5 * time.Second), Label: "issue-1"},
+	}
+	f := sv.exportFilter()
+
+	var comments [][]string
+	rw := pcapng.Rewriter{
+		SectionComments: f.sectionComments(),
+		Packet: func(p *pcapng.Packet, iface pcapng.Interface) (bool, error) {
+			if !f.filter(p, iface) {
+				return false, nil
+			}
+			comments = append(comments, p.Comments())
+			return true, nil
+		},
+	}
+	dst := new(bytes.Buffer)
+	require.NoError(t, rw.Rewrite(src, dst))
+	require.Equal(t, [][]string{
+		{"save: issue-1"},
+		{"save: issue-1", "save: dial-failure"},
+	}, comments)
+
+	r, err := pcapgo.NewNgReader(dst, pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+	require.Contains(t, r.SectionInfo().Comment, "saved 2022-09-03T14:30:00Z to 2022-09-03T14:30:05Z for 203.0.113.7:443: issue-1")
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/trafficlog"
+	"github.com/getlantern/trafficlog-flashlight/internal/anonymize"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+	"github.com/getlantern/trafficlog/tlhttp"
+)
+
+// Set at build time; see the Makefile.
+var version = "unknown"
+
+// Paths of the tlhttp endpoints intercepted by the server.
+const (
+	pathUpdateAddresses   = "/addresses"
+	pathUpdateBufferSizes = "/buffer-sizes"
+)
+
+// server wraps the tlhttp request handler, adding tlserver-specific endpoints and keeping track of
+// the server's state.
+type server struct {
+	*http.ServeMux
+
+	tl         *trafficlog.TrafficLog
+	tlHandler  http.Handler
+	mutator    *mutatorSwitch
+	meter      *captureMeter
+	metrics    *metrics
+	audit      *auditLog
+	anonymizer *anonymize.Anonymizer
+	start      time.Time
+
+	// Accessed atomically. lastRequest is in Unix nanoseconds.
+	acceptedConns, rejectedConns, lastRequest int64
+
+	// Receives updates to the stats interval.
+	statsIntervalC chan time.Duration
+
+	mx              sync.Mutex
+	cfg             tlapi.Config
+	addresses       []string
+	lastAuthFailure time.Time
+	latestStats     *trafficlog.CaptureStats
+
+	// The IPs of all hosts captured since start-up, as strings.
+	capturedIPs map[string]bool
+
+	// Set before the server starts serving requests.
+	privilegesDropped    bool
+	privilegesNotDropped string
+
+	filtersMx sync.Mutex
+	filters   map[string]*filterCapture
+
+	annotations annotations
+	saves       *saves
+
+	// Nil unless saves are compressed and persisted respectively.
+	compressed *compressedBuffer
+	persisted  *persistedCaptures
+
+	// Serializes processSaves.
+	processMx  sync.Mutex
+	newlySaved *newlySaved
+
+	// Saved packets not persisted, as they were outside every saved window. Guarded by processMx.
+	unpersisted []savedPacket
+}
+
+// The mutator and meter must be those wrapping the factory used by the traffic log. The audit log
+// and persisted captures may be nil.
+func newServer(tl *trafficlog.TrafficLog, cfg tlapi.Config, mutator *mutatorSwitch, meter *captureMeter, audit *auditLog, persisted *persistedCaptures) *server {
+	s := &server{
+		ServeMux:       http.NewServeMux(),
+		tl:             tl,
+		tlHandler:      tlhttp.RequestHandler(tl, os.Stderr),
+		mutator:        mutator,
+		meter:          meter,
+		metrics:        newMetrics(),
+		audit:          audit,
+		persisted:      persisted,
+		start:          time.Now(),
+		statsIntervalC: make(chan time.Duration, 1),
+		cfg:            cfg,
+		addresses:      append([]string{}, cfg.Addresses...),
+		capturedIPs:    map[string]bool{},
+		filters:        map[string]*filterCapture{},
+		saves:          newSaves(),
+		newlySaved:     newNewlySaved(),
+	}
+	if cfg.CompressSaves {
+		s.compressed = newCompressedBuffer(cfg.SaveBytes)
+	}
+	s.anonymizer = s.newAnonymizer()
+	s.addCapturedHosts(cfg.Addresses)
+	s.lastRequest = s.start.UnixNano()
+	s.HandleFunc(tlapi.PathStatus, s.status)
+	s.HandleFunc(tlapi.PathMetrics, s.serveMetrics)
+	s.HandleFunc(tlapi.PathReconfigure, s.reconfigure)
+	s.HandleFunc(pathGetCaptures, s.getCaptures)
+	s.HandleFunc(tlapi.PathFilters, s.updateFilters)
+	s.HandleFunc(tlapi.PathAnnotations, s.annotate)
+	s.HandleFunc(tlapi.PathSaveWindow, s.saveWindow)
+	s.HandleFunc(tlapi.PathSummary, s.summary)
+	s.HandleFunc(pathUpdateAddresses, s.intercept(func(body []byte) {
+		req := struct{ Addresses []string }{}
+		if json.Unmarshal(body, &req) == nil {
+			s.mx.Lock()
+			s.addresses = req.Addresses
+			s.mx.Unlock()
+			s.addCapturedHosts(req.Addresses)
+		}
+	}))
+	s.HandleFunc(pathSaveCaptures, s.intercept(func(body []byte) {
+		req := struct {
+			Address  string
+			Duration tlapi.Duration
+		}{}
+		if json.Unmarshal(body, &req) == nil {
+			s.saves.recordSave(req.Address, time.Duration(req.Duration))
+		}
+		s.processSaves()
+	}))
+	s.HandleFunc(pathUpdateBufferSizes, s.intercept(func(body []byte) {
+		req := struct{ CaptureBytes, SaveBytes int }{}
+		if json.Unmarshal(body, &req) == nil {
+			s.mx.Lock()
+			shrunk := req.SaveBytes < s.cfg.SaveBytes
+			s.cfg.CaptureBytes, s.cfg.SaveBytes = req.CaptureBytes, req.SaveBytes
+			s.mx.Unlock()
+			s.meter.setCap(req.CaptureBytes)
+			if s.compressed != nil {
+				s.compressed.setCap(req.SaveBytes)
+			}
+			if shrunk {
+				// Saved packets will be evicted when packets are next saved, before eviction
+				// could be detected.
+				s.saves.forget(time.Now())
+			}
+		}
+	}))
+	s.Handle("/", s.tlHandler)
+	return s
+}
+
+// ServeHTTP wraps the server's request multiplexer, recording activity, request metrics and the
+// audit log.
+func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	atomic.StoreInt64(&s.lastRequest, start.UnixNano())
+
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			writeError(w, http.StatusBadRequest, "failed to read request: "+err.Error())
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	addressesBefore := s.currentAddresses()
+
+	rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+	s.ServeMux.ServeHTTP(rec, req)
+	s.metrics.recordRequest(req.URL.Path, rec.code, time.Since(start))
+
+	peer := peerFromContext(req.Context())
+	entry := tlapi.AuditEntry{
+		Time:           start,
+		PeerPID:        peer.pid,
+		PeerExecutable: peer.executable,
+		Method:         req.Method,
+		Path:           req.URL.Path,
+		Params:         auditParams(body),
+		StatusCode:     rec.code,
+		ResponseBytes:  rec.n,
+	}
+	if req.URL.Path == pathUpdateAddresses {
+		entry.AddressesAdded, entry.AddressesRemoved = diffAddresses(
+			addressesBefore, s.currentAddresses())
+	}
+	if rec.code >= 400 {
+		entry.Error = http.StatusText(rec.code)
+	}
+	s.audit.record(entry)
+}
+
+// Returns a handler which passes the request to the tlhttp handler. If the request succeeds,
+// onSuccess is called with the request body.
+func (s *server) intercept(onSuccess func(body []byte)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "failed to read request: "+err.Error())
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		s.tlHandler.ServeHTTP(rec, req)
+		if rec.code >= 200 && rec.code < 300 {
+			onSuccess(body)
+		}
+	}
+}
+
+// statusRecorder records the status code and the number of bytes written to the underlying
+// ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+	n    int64
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.n += int64(n)
+	return n, err
+}
+
+func (s *server) currentAddresses() []string {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return append([]string{}, s.addresses...)
+}
+
+func (s *server) status(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.mx.Lock()
+	status := tlapi.Status{
+		Version:             version,
+		DebugBuild:          debugBuild,
+		PID:                 os.Getpid(),
+		Uptime:              tlapi.Duration(time.Since(s.start)),
+		CaptureBytes:        s.cfg.CaptureBytes,
+		SaveBytes:           s.cfg.SaveBytes,
+		StatsInterval:       s.cfg.StatsInterval,
+		Mutator:             s.cfg.Mutator,
+		MutatorParams:       s.cfg.MutatorParams,
+		Addresses:           append([]string{}, s.addresses...),
+		AcceptedConnections: atomic.LoadInt64(&s.acceptedConns),
+		RejectedConnections: atomic.LoadInt64(&s.rejectedConns),
+		Privileges:          currentPrivileges(s.privilegesDropped, s.privilegesNotDropped),
+		CompressSaves:       s.cfg.CompressSaves,
+	}
+	if !s.lastAuthFailure.IsZero() {
+		t := s.lastAuthFailure
+		status.LastAuthFailure = &t
+	}
+	s.mx.Unlock()
+	status.Filters, status.FilterStats = s.currentFilters(), s.filterStats()
+	status.SaveBuffer = s.saveBufferStats()
+	if s.persisted != nil {
+		if stats, err := s.persisted.stats(); err == nil {
+			status.Persisted = stats
+		}
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// lastActive returns the time of the last request. Only authenticated peers are able to make
+// requests.
+func (s *server) lastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastRequest))
+}
+
+// authFailed is called when a peer fails authentication.
+func (s *server) authFailed(err error) {
+	logError(err)
+	s.audit.record(tlapi.AuditEntry{Time: time.Now(), Error: err.Error()})
+	atomic.AddInt64(&s.rejectedConns, 1)
+	s.mx.Lock()
+	s.lastAuthFailure = time.Now()
+	s.mx.Unlock()
+}
+
+// listener wraps l, counting accepted connections.
+func (s *server) listener(l net.Listener) net.Listener {
+	return countingListener{l, &s.acceptedConns}
+}
+
+type countingListener struct {
+	net.Listener
+	count *int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(l.count, 1)
+	}
+	return c, err
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logError("failed to encode response:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, statusCode int, msg string) {
+	writeJSON(w, statusCode, tlapi.ErrorResponse{ErrorMsg: msg})
+}
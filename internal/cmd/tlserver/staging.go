@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// savedPacket is a packet read from the traffic log's save buffer.
+type savedPacket struct {
+	iface pcapgo.NgInterface
+	ci    gopacket.CaptureInfo
+	data  []byte
+}
+
+// The fields of an interface which distinguish it in the traffic log's output.
+type interfaceKey struct {
+	name, description string
+	linkType          layers.LinkType
+	snapLength        uint32
+}
+
+func keyOf(iface pcapgo.NgInterface) interfaceKey {
+	return interfaceKey{iface.Name, iface.Description, iface.LinkType, iface.SnapLength}
+}
+
+// newlySaved picks out the packets added to the traffic log's save buffer since it was last read.
+// The traffic log does not allow its save buffer to be cleared, so the packets present at the
+// previous read are remembered in order to tell which are new. A packet saved again while a copy
+// remains in the buffer is not considered new.
+//
+// The number of packets and bytes of packet data in the buffer at the last read are also recorded,
+// as the traffic log does not expose these.
+type newlySaved struct {
+	mx   sync.Mutex
+	seed maphash.Seed
+	// Capture times, in Unix nanoseconds, of the packets present at the last read.
+	seen map[uint64]int64
+
+	packets, bytesHeld int
+}
+
+// An evicted packet is at most this large: the maximum snap length plus the traffic log's
+// per-packet overhead.
+const maxSavedPacketBytes = 65535 + packetOverheadBytes
+
+// evictedPackets describes the packets evicted from the save buffer since it was last read.
+type evictedPackets struct {
+	// The latest capture time among the evicted packets present at the last read; zero if none.
+	through time.Time
+
+	// Set if packets may have been saved and evicted in between reads, in which case their
+	// capture times are unknown.
+	unread bool
+}
+
+func newNewlySaved() *newlySaved {
+	return &newlySaved{seed: maphash.MakeSeed(), seen: map[uint64]int64{}}
+}
+
+// read returns the new packets and describes the packets evicted since the last read. writeSaved
+// should write the contents of the save buffer, which has the input capacity, as pcapng.
+func (n *newlySaved) read(writeSaved func(io.Writer) error, capBytes int) ([]savedPacket, *evictedPackets, error) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+
+	buf := new(bytes.Buffer)
+	if err := writeSaved(buf); err != nil {
+		return nil, nil, fmt.Errorf("failed to read saved packets: %w", err)
+	}
+	r, err := pcapgo.NewNgReader(buf, pcapgo.NgReaderOptions{WantMixedLinkType: true})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read saved packets: %w", err)
+	}
+	var (
+		seen           = map[uint64]int64{}
+		packets        = []savedPacket{}
+		held, heldData int
+		retained       bool
+	)
+	for {
+		data, ci, err := r.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read saved packet: %w", err)
+		}
+		iface, err := r.Interface(ci.InterfaceIndex)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read saved packet interface: %w", err)
+		}
+		held, heldData = held+1, heldData+len(data)
+		key := n.key(iface.LinkType, ci, data)
+		seen[key] = ci.Timestamp.UnixNano()
+		if _, ok := n.seen[key]; ok {
+			retained = true
+		} else {
+			packets = append(packets, savedPacket{iface, ci, data})
+		}
+	}
+
+	evicted := new(evictedPackets)
+	for key, ts := range n.seen {
+		if _, ok := seen[key]; !ok && ts > evicted.through.UnixNano() {
+			evicted.through = time.Unix(0, ts)
+		}
+	}
+	// The buffer evicts packets in the order saved. New packets can only have been evicted if none
+	// of the packets present at the last read remain, and the buffer is (nearly) full.
+	if !retained && len(packets) > 0 && heldData+held*packetOverheadBytes+maxSavedPacketBytes > capBytes {
+		evicted.unread = true
+	}
+	n.seen, n.packets, n.bytesHeld = seen, held, heldData
+	return packets, evicted, nil
+}
+
+// held returns the number of packets and bytes of packet data in the save buffer at the last read.
+func (n *newlySaved) held() (packets, bytesHeld int) {
+	n.mx.Lock()
+	defer n.mx.Unlock()
+	return n.packets, n.bytesHeld
+}
+
+func (n *newlySaved) key(lt layers.LinkType, ci gopacket.CaptureInfo, data []byte) uint64 {
+	var h maphash.Hash
+	h.SetSeed(n.seed)
+	var hdr [10]byte
+	binary.LittleEndian.PutUint16(hdr[:2], uint16(lt))
+	binary.LittleEndian.PutUint64(hdr[2:], uint64(ci.Timestamp.UnixNano()))
+	h.Write(hdr[:])
+	h.Write(data)
+	return h.Sum64()
+}
+
+// savedPacketWriter writes saved packets in pcapng format, as the traffic log would.
+type savedPacketWriter struct {
+	w   *pcapgo.NgWriter
+	ids map[interfaceKey]int
+}
+
+func newSavedPacketWriter(w io.Writer) (*savedPacketWriter, error) {
+	// As with the traffic log, the first interface is a placeholder.
+	pcapW, err := pcapgo.NewNgWriter(w, layers.LinkTypeEthernet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize pcapng writer: %w", err)
+	}
+	return &savedPacketWriter{pcapW, map[interfaceKey]int{}}, nil
+}
+
+func (pw *savedPacketWriter) write(p savedPacket) error {
+	key := keyOf(p.iface)
+	id, ok := pw.ids[key]
+	if !ok {
+		var err error
+		id, err = pw.w.AddInterface(pcapgo.NgInterface{
+			Name:        p.iface.Name,
+			Description: p.iface.Description,
+			OS:          p.iface.OS,
+			LinkType:    p.iface.LinkType,
+			SnapLength:  p.iface.SnapLength,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to register interface: %w", err)
+		}
+		pw.ids[key] = id
+	}
+	ci := p.ci
+	ci.InterfaceIndex = id
+	if err := pw.w.WritePacket(ci, p.data); err != nil {
+		return fmt.Errorf("failed to write packet: %w", err)
+	}
+	return nil
+}
+
+func (pw *savedPacketWriter) flush() error {
+	if err := pw.w.Flush(); err != nil {
+		return fmt.Errorf("failed to flush writer: %w", err)
+	}
+	return nil
+}
+
+// Processes packets newly added to the traffic log's save buffer: these are compressed and
+// persisted, if so configured, and the contents of the buffer are measured. The intervals stored
+// for saves are forgotten as far as the saved packets may have been evicted. This should be called
+// after each save. Reports whether any stored intervals were forgotten.
+func (s *server) processSaves() bool {
+	s.processMx.Lock()
+	defer s.processMx.Unlock()
+	s.mx.Lock()
+	saveBytes := s.cfg.SaveBytes
+	s.mx.Unlock()
+	packets, evicted, err := s.newlySaved.read(s.tl.WritePcapng, saveBytes)
+	if err != nil {
+		logError(err)
+		return false
+	}
+	// With compression, packets evicted from the traffic log's buffer are only lost if they were
+	// never read.
+	var lost time.Time
+	if evicted.unread {
+		lost = time.Now()
+	} else if s.compressed == nil {
+		lost = evicted.through
+	}
+	if s.compressed != nil {
+		through, err := s.compressed.add(packets)
+		if err != nil {
+			logError("failed to compress saved packets:", err)
+		}
+		if through.After(lost) {
+			lost = through
+		}
+	}
+	if s.persisted != nil {
+		if err := s.persist(packets, lost); err != nil {
+			logError("failed to persist saved packets:", err)
+		}
+	}
+	if lost.IsZero() {
+		return false
+	}
+	s.saves.forget(lost)
+	return true
+}
+
+// Writes the saved packets as pcapng.
+func (s *server) writeSaved(w io.Writer) error {
+	if s.compressed == nil {
+		return s.tl.WritePcapng(w)
+	}
+	s.processSaves()
+	return s.compressed.writePcapng(w)
+}
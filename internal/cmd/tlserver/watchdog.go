@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// How often the watchdog checks on the parent process and for idleness.
+const watchdogInterval = time.Second
+
+// watchdog shuts the server down if the parent process goes away or if no authenticated request
+// arrives for the idle timeout. This ensures that tlserver does not outlive a crashed or
+// force-quit parent, capturing and holding memory indefinitely.
+type watchdog struct {
+	// Ignored if zero.
+	parentPID   int
+	idleTimeout time.Duration
+
+	// Returns the time of the last authenticated request.
+	lastActive func() time.Time
+}
+
+// run blocks until one of the watchdog's triggers fires, then returns the reason.
+func (w watchdog) run() string {
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		if w.parentPID != 0 && !parentAlive(w.parentPID) {
+			return fmt.Sprintf("parent process %d exited", w.parentPID)
+		}
+		if w.idleTimeout > 0 {
+			if idle := time.Since(w.lastActive()); idle >= w.idleTimeout {
+				return fmt.Sprintf("no requests received in %v", idle.Round(time.Second))
+			}
+		}
+	}
+}
+
+// If our parent exits, we are re-parented (to init or launchd), so the parent is alive only while
+// it remains our parent. Probing the PID directly is unreliable: it may have been reused, or belong
+// to another user's process. tlproc always passes its own PID.
+func parentAlive(pid int) bool {
+	return os.Getppid() == pid
+}
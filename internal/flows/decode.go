@@ -0,0 +1,173 @@
+// Package flows decodes the TCP and UDP packets in a pcapng file, such as the captures exported by
+// tlserver, and summarizes them by flow.
+//
+// Captured packets may have been truncated or stripped of their payloads by a mutator, but mutators
+// leave headers intact. Payload lengths are therefore taken from the IP and TCP headers, rather
+// than from the captured data.
+package flows
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/pcapng"
+)
+
+// Packet is a decoded TCP or UDP packet.
+type Packet struct {
+	// Number is the position of the packet in the file, counting from 1 across all sections. This
+	// matches the frame numbers shown by Wireshark.
+	Number int
+
+	// Section is the index of the pcapng section containing the packet, counting from 0.
+	Section int
+
+	Time time.Time
+
+	// Length is the original length of the packet, including the link-layer header.
+	Length int
+
+	Protocol         layers.IPProtocol
+	Src, Dst         net.IP
+	SrcPort, DstPort uint16
+
+	// TTL is the IPv4 TTL or IPv6 hop limit. IPID is the IPv4 identification field, or zero for
+	// IPv6.
+	TTL  uint8
+	IPID uint16
+
+	// TCP is set for TCP packets.
+	TCP *TCPHeader
+
+	// PayloadLength is the length of the transport-layer payload as sent. Payload holds as much of
+	// the payload as was captured.
+	PayloadLength int
+	Payload       []byte
+}
+
+// TCPHeader holds the fields of a TCP header used in flow analysis.
+type TCPHeader struct {
+	Seq, Ack                uint32
+	SYN, ACK, RST, FIN, PSH bool
+	Window                  uint16
+}
+
+// Source returns the source of the packet in the form host:port.
+func (p *Packet) Source() string {
+	return net.JoinHostPort(p.Src.String(), strconv.Itoa(int(p.SrcPort)))
+}
+
+// Destination returns the destination of the packet in the form host:port.
+func (p *Packet) Destination() string {
+	return net.JoinHostPort(p.Dst.String(), strconv.Itoa(int(p.DstPort)))
+}
+
+// Key identifies the flow to which a packet belongs. Packets sent in either direction have the
+// same key.
+type Key struct {
+	Protocol layers.IPProtocol
+
+	// The endpoints of the flow in the form host:port, ordered lexically.
+	A, B string
+}
+
+// Key returns the key of the packet's flow.
+func (p *Packet) Key() Key {
+	a, b := p.Source(), p.Destination()
+	if b < a {
+		a, b = b, a
+	}
+	return Key{p.Protocol, a, b}
+}
+
+// Read decodes the pcapng file read from r, calling fn for each TCP or UDP packet, in order.
+// Packets which are neither, or which cannot be decoded, are skipped and counted. An error is
+// returned if the file cannot be parsed or if fn returns an error.
+func Read(r io.Reader, fn func(*Packet) error) (skipped int, err error) {
+	return ReadSections(r, nil, fn)
+}
+
+// ReadSections is like Read, but also calls section, if non-nil, with the comments of each section
+// header, before any of the section's packets.
+func ReadSections(r io.Reader, section func(comments []string) error, fn func(*Packet) error) (skipped int, err error) {
+	number, sections := 0, 0
+	rw := pcapng.Rewriter{
+		Section: func(comments []string) error {
+			sections++
+			if section == nil {
+				return nil
+			}
+			return section(comments)
+		},
+		Packet: func(p *pcapng.Packet, iface pcapng.Interface) (bool, error) {
+			number++
+			decoded, ok := decode(p.Data, layers.LinkType(iface.LinkType))
+			if !ok {
+				skipped++
+				return false, nil
+			}
+			decoded.Number = number
+			if sections > 0 {
+				decoded.Section = sections - 1
+			}
+			decoded.Time = p.Time(iface)
+			decoded.Length = int(p.OriginalLength)
+			return false, fn(decoded)
+		},
+	}
+	if err := rw.Rewrite(r, ioutil.Discard); err != nil {
+		return skipped, fmt.Errorf("failed to read pcapng: %w", err)
+	}
+	return skipped, nil
+}
+
+func decode(data []byte, linkType layers.LinkType) (*Packet, bool) {
+	pkt := gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{NoCopy: true})
+	var (
+		p         = new(Packet)
+		ipPayload int
+	)
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		if ip.Flags&layers.IPv4MoreFragments != 0 || ip.FragOffset != 0 {
+			return nil, false
+		}
+		p.Protocol, p.Src, p.Dst, p.TTL, p.IPID = ip.Protocol, ip.SrcIP, ip.DstIP, ip.TTL, ip.Id
+		ipPayload = int(ip.Length) - int(ip.IHL)*4
+	case *layers.IPv6:
+		p.Protocol, p.Src, p.Dst, p.TTL = ip.NextHeader, ip.SrcIP, ip.DstIP, ip.HopLimit
+		ipPayload = int(ip.Length)
+	default:
+		return nil, false
+	}
+	switch transport := pkt.TransportLayer().(type) {
+	case *layers.TCP:
+		p.Protocol = layers.IPProtocolTCP
+		p.SrcPort, p.DstPort = uint16(transport.SrcPort), uint16(transport.DstPort)
+		p.TCP = &TCPHeader{
+			Seq: transport.Seq, Ack: transport.Ack,
+			SYN: transport.SYN, ACK: transport.ACK, RST: transport.RST, FIN: transport.FIN,
+			PSH: transport.PSH, Window: transport.Window,
+		}
+		p.PayloadLength = ipPayload - int(transport.DataOffset)*4
+		p.Payload = transport.Payload
+	case *layers.UDP:
+		p.Protocol = layers.IPProtocolUDP
+		p.SrcPort, p.DstPort = uint16(transport.SrcPort), uint16(transport.DstPort)
+		p.PayloadLength = int(transport.Length) - 8
+		p.Payload = transport.Payload
+	default:
+		return nil, false
+	}
+	if p.PayloadLength < len(p.Payload) {
+		p.PayloadLength = len(p.Payload)
+	}
+	return p, true
+}
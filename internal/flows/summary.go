@@ -0,0 +1,187 @@
+package flows
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+// Summarize reads a pcapng file and summarizes the packets in each flow.
+func Summarize(r io.Reader) (*tlapi.Summary, error) {
+	s := newSummarizer()
+	skipped, err := Read(r, func(p *Packet) error {
+		s.add(p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	summary := s.summary()
+	summary.OtherPackets = skipped
+	return summary, nil
+}
+
+type summarizer struct {
+	flows map[Key]*flowState
+	order []*flowState
+}
+
+func newSummarizer() *summarizer {
+	return &summarizer{flows: map[Key]*flowState{}}
+}
+
+// One direction of a flow.
+type flowDirection struct {
+	counts tlapi.FlowDirection
+
+	// The end of the highest TCP sequence range seen, valid if started.
+	maxEnd  uint32
+	started bool
+}
+
+type flowState struct {
+	protocol            layers.IPProtocol
+	client, server      string
+	firstSeen, lastSeen time.Time
+
+	// Indexed by direction: client to server, then server to client.
+	dirs [2]flowDirection
+
+	// Set once a SYN has been seen from the client.
+	clientSYN bool
+
+	// The time of the client's last SYN and, once seen, the handshake RTT.
+	lastSYN time.Time
+	rtt     *time.Duration
+
+	// Data sent by the client, accumulated until a ClientHello can be parsed.
+	stream    []byte
+	helloDone bool
+	hello     *ClientHello
+}
+
+func (s *summarizer) add(p *Packet) {
+	key := p.Key()
+	f, ok := s.flows[key]
+	if !ok {
+		f = &flowState{
+			protocol:  p.Protocol,
+			client:    p.Source(),
+			server:    p.Destination(),
+			firstSeen: p.Time,
+			lastSeen:  p.Time,
+		}
+		s.flows[key] = f
+		s.order = append(s.order, f)
+	}
+	tcp := p.TCP
+	if tcp != nil && tcp.SYN && !tcp.ACK && !f.clientSYN {
+		// The sender of the first SYN is the client, whichever packet was seen first.
+		f.clientSYN = true
+		if p.Source() != f.client {
+			f.client, f.server = f.server, f.client
+			f.dirs[0], f.dirs[1] = f.dirs[1], f.dirs[0]
+			f.stream, f.helloDone = nil, false
+		}
+	}
+	if p.Time.Before(f.firstSeen) {
+		f.firstSeen = p.Time
+	}
+	if p.Time.After(f.lastSeen) {
+		f.lastSeen = p.Time
+	}
+	fromClient := p.Source() == f.client
+	dir := &f.dirs[0]
+	if !fromClient {
+		dir = &f.dirs[1]
+	}
+	dir.counts.Packets++
+	dir.counts.Bytes += int64(p.Length)
+	if tcp == nil {
+		return
+	}
+
+	switch {
+	case tcp.SYN && tcp.ACK:
+		dir.counts.SYNACK++
+		if !fromClient && f.rtt == nil && !f.lastSYN.IsZero() {
+			rtt := p.Time.Sub(f.lastSYN)
+			f.rtt = &rtt
+		}
+	case tcp.SYN:
+		dir.counts.SYN++
+		if fromClient && f.rtt == nil {
+			f.lastSYN = p.Time
+		}
+	}
+	if tcp.RST {
+		dir.counts.RST++
+	}
+	if tcp.FIN {
+		dir.counts.FIN++
+	}
+	if p.PayloadLength == 0 {
+		return
+	}
+	end := tcp.Seq + uint32(p.PayloadLength)
+	if dir.started && int32(end-dir.maxEnd) <= 0 {
+		dir.counts.Retransmissions++
+		return
+	}
+	dir.maxEnd, dir.started = end, true
+	if fromClient {
+		f.addClientData(p)
+	}
+}
+
+// Accumulates data sent by the client until a ClientHello is parsed or cannot be.
+func (f *flowState) addClientData(p *Packet) {
+	if f.helloDone {
+		return
+	}
+	f.stream = append(f.stream, p.Payload...)
+	hello, err := ParseClientHello(f.stream)
+	switch {
+	case err == nil:
+		f.hello = hello
+	case errors.Is(err, ErrIncomplete) && len(p.Payload) == p.PayloadLength:
+		// Wait for more data.
+		return
+	}
+	f.stream, f.helloDone = nil, true
+}
+
+func (s *summarizer) summary() *tlapi.Summary {
+	summary := &tlapi.Summary{Flows: []tlapi.FlowSummary{}}
+	for _, f := range s.order {
+		fs := tlapi.FlowSummary{
+			Protocol:       strings.ToLower(f.protocol.String()),
+			Client:         f.client,
+			Server:         f.server,
+			FirstSeen:      f.firstSeen,
+			LastSeen:       f.lastSeen,
+			ClientToServer: f.dirs[0].counts,
+			ServerToClient: f.dirs[1].counts,
+		}
+		if f.rtt != nil {
+			rtt := tlapi.Duration(*f.rtt)
+			fs.HandshakeRTT = &rtt
+		}
+		if f.hello != nil {
+			fs.SNI = f.hello.ServerName
+			fs.ClientHelloFingerprint = f.hello.JA3Hash()
+		}
+		summary.Flows = append(summary.Flows, fs)
+	}
+	// Captures recovered from previous processes follow the live captures in exports.
+	sort.SliceStable(summary.Flows, func(i, j int) bool {
+		return summary.Flows[i].FirstSeen.Before(summary.Flows[j].FirstSeen)
+	})
+	return summary
+}
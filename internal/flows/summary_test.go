@@ -0,0 +1,132 @@
+package flows
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+// Returns a ClientHello record as written by crypto/tls.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+
+	hdr := make([]byte, tlsRecordHeaderLen)
+	_, err := io.ReadFull(server, hdr)
+	require.NoError(t, err)
+	body := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	_, err = io.ReadFull(server, body)
+	require.NoError(t, err)
+	client.Close()
+	return append(hdr, body...)
+}
+
+func TestSummarize(t *testing.T) {
+	var (
+		start = time.Date(2022, 9, 3, 14, 30, 0, 0, time.UTC)
+		at    = func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+		local = net.IPv4(192, 168, 1, 20)
+		proxy = net.IPv4(203, 0, 113, 7)
+		hello = clientHello(t, "example.com")
+		buf   = new(bytes.Buffer)
+	)
+	w, err := pcapgo.NewNgWriter(buf, layers.LinkTypeEthernet)
+	require.NoError(t, err)
+	eth := func(etherType layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{
+			SrcMAC: make(net.HardwareAddr, 6), DstMAC: make(net.HardwareAddr, 6), EthernetType: etherType,
+		}
+	}
+	write := func(ts time.Time, ls ...gopacket.SerializableLayer) {
+		b := gopacket.NewSerializeBuffer()
+		require.NoError(t, gopacket.SerializeLayers(b, gopacket.SerializeOptions{FixLengths: true}, ls...))
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(b.Bytes()), Length: len(b.Bytes())}
+		require.NoError(t, w.WritePacket(ci, b.Bytes()))
+	}
+	writeTCP := func(ts time.Time, fromClient bool, tcp layers.TCP, payload []byte) {
+		ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: local, DstIP: proxy}
+		tcp.SrcPort, tcp.DstPort = 50000, 443
+		if !fromClient {
+			ip.SrcIP, ip.DstIP = proxy, local
+			tcp.SrcPort, tcp.DstPort = 443, 50000
+		}
+		require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+		write(ts, eth(layers.EthernetTypeIPv4), ip, &tcp, gopacket.Payload(payload))
+	}
+
+	writeTCP(at(0), true, layers.TCP{SYN: true, Seq: 99}, nil)
+	writeTCP(at(1000), true, layers.TCP{SYN: true, Seq: 99}, nil)
+	writeTCP(at(1040), false, layers.TCP{SYN: true, ACK: true, Seq: 499, Ack: 100}, nil)
+	writeTCP(at(1041), true, layers.TCP{ACK: true, Seq: 100, Ack: 500}, nil)
+	writeTCP(at(1042), true, layers.TCP{ACK: true, PSH: true, Seq: 100, Ack: 500}, hello[:100])
+	writeTCP(at(1043), true, layers.TCP{ACK: true, PSH: true, Seq: 200, Ack: 500}, hello[100:])
+	writeTCP(at(1300), true, layers.TCP{ACK: true, PSH: true, Seq: 200, Ack: 500}, hello[100:])
+	writeTCP(at(1310), false, layers.TCP{RST: true, Seq: 500}, nil)
+
+	udp := &layers.UDP{SrcPort: 53000, DstPort: 53}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: local, DstIP: net.IPv4(8, 8, 8, 8)}
+	require.NoError(t, udp.SetNetworkLayerForChecksum(ip))
+	write(at(500), eth(layers.EthernetTypeIPv4), ip, udp, gopacket.Payload(make([]byte, 30)))
+	write(at(600), eth(layers.EthernetTypeARP), &layers.ARP{
+		AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+		SourceHwAddress: make([]byte, 6), SourceProtAddress: local.To4(),
+		DstHwAddress: make([]byte, 6), DstProtAddress: proxy.To4(),
+	})
+	require.NoError(t, w.Flush())
+
+	summary, err := Summarize(buf)
+	require.NoError(t, err)
+	require.Equal(t, 1, summary.OtherPackets)
+	require.Len(t, summary.Flows, 2)
+
+	tcpFlow := summary.Flows[0]
+	require.Equal(t, "tcp", tcpFlow.Protocol)
+	require.Equal(t, "192.168.1.20:50000", tcpFlow.Client)
+	require.Equal(t, "203.0.113.7:443", tcpFlow.Server)
+	require.WithinDuration(t, at(0), tcpFlow.FirstSeen, 0)
+	require.WithinDuration(t, at(1310), tcpFlow.LastSeen, 0)
+	require.Equal(t, 6, tcpFlow.ClientToServer.Packets)
+	require.Equal(t, 2, tcpFlow.ClientToServer.SYN)
+	require.Equal(t, 1, tcpFlow.ClientToServer.Retransmissions)
+	require.Equal(t, 1, tcpFlow.ServerToClient.SYNACK)
+	require.Equal(t, 1, tcpFlow.ServerToClient.RST)
+	require.Equal(t, int64(2*60), tcpFlow.ServerToClient.Bytes) // minimum Ethernet frames
+	require.NotNil(t, tcpFlow.HandshakeRTT)
+	require.Equal(t, tlapi.Duration(40*time.Millisecond), *tcpFlow.HandshakeRTT)
+	require.Equal(t, "example.com", tcpFlow.SNI)
+	require.Len(t, tcpFlow.ClientHelloFingerprint, 32)
+
+	udpFlow := summary.Flows[1]
+	require.Equal(t, "udp", udpFlow.Protocol)
+	require.Equal(t, "8.8.8.8:53", udpFlow.Server)
+	require.Equal(t, 1, udpFlow.ClientToServer.Packets)
+	require.Zero(t, udpFlow.ServerToClient.Packets)
+}
+
+func TestParseClientHello(t *testing.T) {
+	record := clientHello(t, "example.com")
+	_, err := ParseClientHello(record[:len(record)-1])
+	require.ErrorIs(t, err, ErrIncomplete)
+
+	hello, err := ParseClientHello(record)
+	require.NoError(t, err)
+	require.Equal(t, "example.com", hello.ServerName)
+	// The version is that of the record layer's ClientHello: TLS 1.2, even when offering 1.3.
+	require.Regexp(t, `^771,[0-9-]+,0-[0-9-]+,[0-9-]+,0$`, hello.JA3)
+
+	require.True(t, isGREASE(0x0a0a))
+	require.True(t, isGREASE(0xfafa))
+	require.False(t, isGREASE(0x0a1a))
+}
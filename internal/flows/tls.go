@@ -0,0 +1,212 @@
+package flows
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	tlsRecordHeaderLen      = 5
+	tlsMaxRecordLen         = 1<<14 + 2048
+	tlsContentHandshake     = 22
+	tlsHandshakeClientHello = 1
+
+	tlsExtensionServerName      = 0
+	tlsExtensionSupportedGroups = 10
+	tlsExtensionPointFormats    = 11
+)
+
+// ErrIncomplete is returned by ParseClientHello when more of the stream is needed.
+var ErrIncomplete = errors.New("incomplete ClientHello")
+
+// ClientHello holds the fields of a TLS ClientHello used to identify a client.
+type ClientHello struct {
+	// ServerName is the value of the server name indication extension, if present.
+	ServerName string
+
+	// JA3 is the JA3 fingerprint string: the version, cipher suites, extensions, supported groups
+	// and point formats, with GREASE values removed.
+	JA3 string
+}
+
+// JA3Hash returns the JA3 fingerprint, the MD5 hash of the fingerprint string.
+func (ch ClientHello) JA3Hash() string {
+	sum := md5.Sum([]byte(ch.JA3))
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseClientHello parses a ClientHello from the start of a TLS stream. The ClientHello must be
+// contained within a single record. If the stream ends before the record does, ErrIncomplete is
+// returned.
+func ParseClientHello(stream []byte) (*ClientHello, error) {
+	if len(stream) < tlsRecordHeaderLen {
+		return nil, ErrIncomplete
+	}
+	if stream[0] != tlsContentHandshake || stream[1] != 3 {
+		return nil, errors.New("not a TLS handshake record")
+	}
+	recordLen := int(binary.BigEndian.Uint16(stream[3:5]))
+	if recordLen > tlsMaxRecordLen {
+		return nil, errors.New("record too long")
+	}
+	if len(stream) < tlsRecordHeaderLen+recordLen {
+		return nil, ErrIncomplete
+	}
+	r := reader(stream[tlsRecordHeaderLen : tlsRecordHeaderLen+recordLen])
+
+	msgType, ok := r.uint8()
+	if !ok || msgType != tlsHandshakeClientHello {
+		return nil, errors.New("not a ClientHello")
+	}
+	body, ok := r.bytes(24)
+	if !ok {
+		return nil, errors.New("ClientHello spans multiple records")
+	}
+	version, ok := body.uint16()
+	if !ok || !body.skip(32) {
+		return nil, errors.New("malformed ClientHello")
+	}
+	if _, ok := body.bytes(8); !ok {
+		return nil, errors.New("malformed session ID")
+	}
+	suites, ok := body.bytes(16)
+	if !ok {
+		return nil, errors.New("malformed cipher suites")
+	}
+	if _, ok := body.bytes(8); !ok {
+		return nil, errors.New("malformed compression methods")
+	}
+
+	var (
+		hello                             = new(ClientHello)
+		ciphers, extensions, groups, fmts []string
+	)
+	for len(suites) > 0 {
+		suite, ok := suites.uint16()
+		if !ok {
+			return nil, errors.New("malformed cipher suites")
+		}
+		if !isGREASE(suite) {
+			ciphers = append(ciphers, strconv.Itoa(int(suite)))
+		}
+	}
+	// Extensions are optional.
+	exts, _ := body.bytes(16)
+	for len(exts) > 0 {
+		extType, ok := exts.uint16()
+		if !ok {
+			return nil, errors.New("malformed extensions")
+		}
+		data, ok := exts.bytes(16)
+		if !ok {
+			return nil, errors.New("malformed extensions")
+		}
+		if isGREASE(extType) {
+			continue
+		}
+		extensions = append(extensions, strconv.Itoa(int(extType)))
+		switch extType {
+		case tlsExtensionServerName:
+			hello.ServerName = parseServerName(data)
+		case tlsExtensionSupportedGroups:
+			list, _ := data.bytes(16)
+			for len(list) > 0 {
+				group, ok := list.uint16()
+				if !ok {
+					break
+				}
+				if !isGREASE(group) {
+					groups = append(groups, strconv.Itoa(int(group)))
+				}
+			}
+		case tlsExtensionPointFormats:
+			list, _ := data.bytes(8)
+			for _, f := range list {
+				fmts = append(fmts, strconv.Itoa(int(f)))
+			}
+		}
+	}
+	hello.JA3 = strings.Join([]string{
+		strconv.Itoa(int(version)),
+		strings.Join(ciphers, "-"),
+		strings.Join(extensions, "-"),
+		strings.Join(groups, "-"),
+		strings.Join(fmts, "-"),
+	}, ",")
+	return hello, nil
+}
+
+// Returns the host name in a server name extension, or the empty string if there is none.
+func parseServerName(data reader) string {
+	list, _ := data.bytes(16)
+	for len(list) > 0 {
+		nameType, ok := list.uint8()
+		if !ok {
+			return ""
+		}
+		name, ok := list.bytes(16)
+		if !ok {
+			return ""
+		}
+		if nameType == 0 {
+			return string(name)
+		}
+	}
+	return ""
+}
+
+// GREASE values (RFC 8701) are of the form 0x?a?a.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// reader consumes big-endian fields from the front of a byte slice.
+type reader []byte
+
+func (r *reader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+// Reads a length-prefixed field. The length prefix has the input number of bits.
+func (r *reader) bytes(lengthBits int) (reader, bool) {
+	var n int
+	for i := 0; i < lengthBits/8; i++ {
+		b, ok := r.uint8()
+		if !ok {
+			return nil, false
+		}
+		n = n<<8 | int(b)
+	}
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
@@ -0,0 +1,134 @@
+// Package mutators provides a registry of named, parameterised packet mutators. tlserver runs in a
+// separate process, so a trafficlog.MutatorFactory cannot be handed to it directly. Instead, the
+// mutators are compiled into tlserver and selected by name (with parameters) across the process
+// boundary.
+package mutators
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/getlantern/trafficlog"
+)
+
+// Names of the registered mutators.
+const (
+	// None performs no mutations.
+	None = "none"
+
+	// StripAppLayer strips all application-layer data. Link, network and transport headers are
+	// retained.
+	StripAppLayer = "strip-app-layer"
+
+	// TLSHandshakeOnly retains TLS handshake, alert and change-cipher-spec records, but strips the
+	// contents of application data records (the record headers are retained). All other
+	// application-layer data is stripped.
+	TLSHandshakeOnly = "tls-handshake-only"
+
+	// Truncate truncates every link-layer packet to the number of bytes specified by the
+	// ParamBytes parameter.
+	Truncate = "truncate"
+)
+
+// ParamBytes is the parameter used to configure the Truncate mutator.
+const ParamBytes = "bytes"
+
+// Params configure a mutator. The parameters accepted depend on the mutator.
+type Params map[string]string
+
+type registration struct {
+	params []string
+	create func(Params) (trafficlog.MutatorFactory, error)
+}
+
+var registry = map[string]registration{
+	None: {nil, func(_ Params) (trafficlog.MutatorFactory, error) {
+		return new(trafficlog.NoOpFactory), nil
+	}},
+	StripAppLayer: {nil, func(_ Params) (trafficlog.MutatorFactory, error) {
+		return new(trafficlog.AppStripperFactory), nil
+	}},
+	TLSHandshakeOnly: {nil, func(_ Params) (trafficlog.MutatorFactory, error) {
+		return new(tlsHandshakeFactory), nil
+	}},
+	Truncate: {[]string{ParamBytes}, newTruncateFactory},
+}
+
+// New creates the mutator factory registered under the given name. An error is returned if the
+// name is not registered or the parameters are invalid.
+func New(name string, params Params) (trafficlog.MutatorFactory, error) {
+	r, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown mutator '%s'", name)
+	}
+	for p := range params {
+		if !contains(r.params, p) {
+			return nil, fmt.Errorf("unknown parameter '%s' for mutator '%s'", p, name)
+		}
+	}
+	f, err := r.create(params)
+	if err != nil {
+		return nil, fmt.Errorf("bad parameters for mutator '%s': %w", name, err)
+	}
+	return f, nil
+}
+
+// Names returns the names of all registered mutators in sorted order.
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func contains(ss []string, s string) bool {
+	for _, elem := range ss {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
+
+type truncateFactory struct {
+	n int
+}
+
+func newTruncateFactory(params Params) (trafficlog.MutatorFactory, error) {
+	s, ok := params[ParamBytes]
+	if !ok {
+		return nil, fmt.Errorf("'%s' must be provided", ParamBytes)
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse '%s': %w", ParamBytes, err)
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("'%s' must be positive", ParamBytes)
+	}
+	return truncateFactory{n}, nil
+}
+
+func (f truncateFactory) MutatorFor(_ trafficlog.LinkType) trafficlog.PacketMutator {
+	return func(pkt []byte, w io.Writer) error {
+		if len(pkt) > f.n {
+			pkt = pkt[:f.n]
+		}
+		_, err := w.Write(pkt)
+		return err
+	}
+}
+
+func layerTypeFor(lt trafficlog.LinkType) gopacket.LayerType {
+	if lt == trafficlog.LinkTypeLoopback {
+		return layers.LayerTypeLoopback
+	}
+	return layers.LayerTypeEthernet
+}
@@ -0,0 +1,113 @@
+package mutators
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/trafficlog"
+)
+
+func TestNew(t *testing.T) {
+	for _, name := range []string{None, StripAppLayer, TLSHandshakeOnly} {
+		_, err := New(name, nil)
+		require.NoError(t, err, name)
+	}
+	_, err := New(Truncate, Params{ParamBytes: "64"})
+	require.NoError(t, err)
+
+	_, err = New("unknown", nil)
+	require.Error(t, err)
+	_, err = New(Truncate, nil)
+	require.Error(t, err)
+	_, err = New(Truncate, Params{ParamBytes: "0"})
+	require.Error(t, err)
+	_, err = New(Truncate, Params{ParamBytes: "x"})
+	require.Error(t, err)
+	_, err = New(None, Params{ParamBytes: "64"})
+	require.Error(t, err)
+}
+
+func TestTruncate(t *testing.T) {
+	f, err := New(Truncate, Params{ParamBytes: "4"})
+	require.NoError(t, err)
+	mutate := f.MutatorFor(trafficlog.LinkTypeEthernet)
+
+	buf := new(bytes.Buffer)
+	require.NoError(t, mutate([]byte{1, 2, 3, 4, 5, 6}, buf))
+	require.Equal(t, []byte{1, 2, 3, 4}, buf.Bytes())
+
+	buf.Reset()
+	require.NoError(t, mutate([]byte{1, 2}, buf))
+	require.Equal(t, []byte{1, 2}, buf.Bytes())
+}
+
+func TestTLSHandshakeOnly(t *testing.T) {
+	var (
+		handshake = tlsRecord(tlsHandshake, 10)
+		appData   = tlsRecord(tlsApplicationData, 8)
+	)
+	mutate := tlsHandshakeFactory{}.MutatorFor(trafficlog.LinkTypeEthernet)
+
+	pkt, headers := tcpPacket(t, append(handshake, appData...))
+	buf := new(bytes.Buffer)
+	require.NoError(t, mutate(pkt, buf))
+	expected := append(append(headers, handshake...), appData[:tlsRecordHeaderLen]...)
+	require.Equal(t, expected, buf.Bytes())
+
+	// An application data record split across segments should be stripped in both.
+	appData = tlsRecord(tlsApplicationData, 20)
+	pkt, headers = tcpPacket(t, appData[:10])
+	buf.Reset()
+	require.NoError(t, mutate(pkt, buf))
+	require.Equal(t, append(headers, appData[:tlsRecordHeaderLen]...), buf.Bytes())
+
+	pkt, headers = tcpPacket(t, append(appData[10:], handshake...))
+	buf.Reset()
+	require.NoError(t, mutate(pkt, buf))
+	require.Equal(t, append(headers, handshake...), buf.Bytes())
+
+	// Non-TLS data should be stripped entirely.
+	pkt, headers = tcpPacket(t, []byte("GET / HTTP/1.1\r\n\r\n"))
+	buf.Reset()
+	require.NoError(t, mutate(pkt, buf))
+	require.Equal(t, headers, buf.Bytes())
+}
+
+func tlsRecord(contentType byte, payloadLen int) []byte {
+	record := []byte{contentType, 3, 3, byte(payloadLen >> 8), byte(payloadLen)}
+	for i := 0; i < payloadLen; i++ {
+		record = append(record, byte(i+1))
+	}
+	return record
+}
+
+// Returns the packet and the bytes making up its headers.
+func tcpPacket(t *testing.T, payload []byte) (pkt, headers []byte) {
+	t.Helper()
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{1, 2, 3, 4, 5, 6},
+		DstMAC:       net.HardwareAddr{6, 5, 4, 3, 2, 1},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+	tcp := &layers.TCP{SrcPort: 443, DstPort: 50000, ACK: true, Window: 1024}
+	require.NoError(t, tcp.SetNetworkLayerForChecksum(ip))
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(payload)))
+	pkt = buf.Bytes()
+	return pkt, append([]byte{}, pkt[:len(pkt)-len(payload)]...)
+}
@@ -0,0 +1,153 @@
+package mutators
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"github.com/getlantern/trafficlog"
+)
+
+const (
+	tlsRecordHeaderLen = 5
+
+	tlsChangeCipherSpec = 20
+	tlsAlert            = 21
+	tlsHandshake        = 22
+	tlsApplicationData  = 23
+
+	// Bounds the number of TCP flows tracked by a single mutator. If exceeded, all state is
+	// dropped; flows in the middle of a record will have the remainder of that record stripped.
+	maxTrackedFlows = 4096
+)
+
+// State for a single direction of a TCP flow. TLS records frequently span multiple segments, so we
+// track how much of the current record remains and whether it is being kept.
+type tlsFlowState struct {
+	remaining int
+	keep      bool
+}
+
+type tlsHandshakeFactory struct{}
+
+// MutatorFor implements trafficlog.MutatorFactory.
+//
+// Record boundaries are tracked per flow, assuming segments arrive in order. Retransmitted or
+// reordered segments may cause a flow to lose track of record boundaries; when this happens, data
+// is stripped until a segment begins with a valid record header.
+func (f tlsHandshakeFactory) MutatorFor(linkType trafficlog.LinkType) trafficlog.PacketMutator {
+	var (
+		eth     layers.Ethernet
+		lb      layers.Loopback
+		ip4     layers.IPv4
+		ip6     layers.IPv6
+		tcp     layers.TCP
+		udp     layers.UDP
+		payload gopacket.Payload
+
+		decoded = make([]gopacket.LayerType, 4)
+		parser  = gopacket.NewDecodingLayerParser(
+			layerTypeFor(linkType), &eth, &lb, &ip4, &ip6, &tcp, &udp, &payload,
+		)
+		flows = map[string]*tlsFlowState{}
+	)
+	return func(linkPkt []byte, w io.Writer) error {
+		decodeErr := parser.DecodeLayers(linkPkt, &decoded)
+		var (
+			link, network, transport gopacket.Layer
+			flowKey                  string
+		)
+		for _, layerType := range decoded {
+			switch layerType {
+			case layers.LayerTypeEthernet:
+				link = &eth
+			case layers.LayerTypeLoopback:
+				link = &lb
+			case layers.LayerTypeIPv4:
+				network = &ip4
+				flowKey = fmt.Sprintf("%v>%v", ip4.SrcIP, ip4.DstIP)
+			case layers.LayerTypeIPv6:
+				network = &ip6
+				flowKey = fmt.Sprintf("%v>%v", ip6.SrcIP, ip6.DstIP)
+			case layers.LayerTypeTCP:
+				transport = &tcp
+			case layers.LayerTypeUDP:
+				transport = &udp
+			}
+		}
+		if decodeErr != nil && (transport == nil || network == nil || link == nil) {
+			// Note: we ignore decoding errors if we were still able to decode the expected layers.
+			return fmt.Errorf("decoding error: %w", decodeErr)
+		}
+		for _, layer := range []gopacket.Layer{link, network, transport} {
+			if _, err := w.Write(layer.LayerContents()); err != nil {
+				return fmt.Errorf("write failed: %w", err)
+			}
+		}
+		if transport != &tcp {
+			return nil
+		}
+
+		flowKey = fmt.Sprintf("%s:%d:%d", flowKey, tcp.SrcPort, tcp.DstPort)
+		state, ok := flows[flowKey]
+		if !ok {
+			if len(flows) >= maxTrackedFlows {
+				flows = map[string]*tlsFlowState{}
+			}
+			state = new(tlsFlowState)
+			flows[flowKey] = state
+		}
+		if tcp.FIN || tcp.RST {
+			delete(flows, flowKey)
+		}
+		if _, err := w.Write(filterTLSRecords(tcp.LayerPayload(), state)); err != nil {
+			return fmt.Errorf("write failed: %w", err)
+		}
+		return nil
+	}
+}
+
+// Returns the parts of the TCP payload to keep. The state is updated to reflect any record
+// continuing into the next segment.
+func filterTLSRecords(payload []byte, state *tlsFlowState) []byte {
+	kept := []byte{}
+	for i := 0; i < len(payload); {
+		if state.remaining > 0 {
+			n := state.remaining
+			if n > len(payload)-i {
+				n = len(payload) - i
+			}
+			if state.keep {
+				kept = append(kept, payload[i:i+n]...)
+			}
+			state.remaining -= n
+			i += n
+			continue
+		}
+
+		hdr := payload[i:]
+		if len(hdr) < tlsRecordHeaderLen || !isTLSRecordHeader(hdr) {
+			// Either this is not TLS or we have lost track of the record boundaries. Strip the
+			// remainder of the segment.
+			state.remaining = 0
+			break
+		}
+		kept = append(kept, hdr[:tlsRecordHeaderLen]...)
+		state.remaining = int(hdr[3])<<8 | int(hdr[4])
+		state.keep = hdr[0] != tlsApplicationData
+		i += tlsRecordHeaderLen
+	}
+	return kept
+}
+
+func isTLSRecordHeader(b []byte) bool {
+	switch b[0] {
+	case tlsChangeCipherSpec, tlsAlert, tlsHandshake, tlsApplicationData:
+	default:
+		return false
+	}
+	// The major version is 3 for SSL 3.0 through TLS 1.3.
+	return b[1] == 3
+}
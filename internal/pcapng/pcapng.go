@@ -0,0 +1,474 @@
+// Package pcapng provides block-level rewriting of pcapng files. The gopacket pcapgo package can
+// read and write pcapng, but cannot write per-packet options such as comments. tlserver uses this
+// package to annotate and transform the captures exported by the traffic log.
+//
+// Only the blocks of interest are decoded: section headers (for byte order and comments),
+// interface descriptions (for link type and timestamp resolution) and enhanced packets. All other
+// blocks are passed through unchanged.
+package pcapng
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// Block types.
+const (
+	BlockTypeSectionHeader        = 0x0A0D0D0A
+	BlockTypeInterfaceDescription = 0x00000001
+	BlockTypeEnhancedPacket       = 0x00000006
+)
+
+// Option codes.
+const (
+	OptionEndOfOptions = 0
+	OptionComment      = 1
+
+	// Interface description options.
+	OptionInterfaceName                = 2
+	optionInterfaceTimestampResolution = 9
+)
+
+const byteOrderMagic = 0x1A2B3C4D
+
+// Option is a block option.
+type Option struct {
+	Code  uint16
+	Value []byte
+}
+
+// Block is a raw pcapng block. The body excludes the type and length fields.
+type Block struct {
+	Type uint32
+	Body []byte
+}
+
+// Interface describes a capture interface as declared in an interface description block.
+type Interface struct {
+	LinkType uint16
+
+	// The timestamp resolution. This may not be representable as a time.Duration (e.g. 2^-30
+	// seconds).
+	unitsPerSecond float64
+}
+
+// Packet is a decoded enhanced packet block.
+type Packet struct {
+	InterfaceID    uint32
+	Timestamp      uint64
+	OriginalLength uint32
+	Data           []byte
+	Options        []Option
+}
+
+// Time converts the packet's timestamp, using the resolution of the input interface.
+func (p Packet) Time(iface Interface) time.Time {
+	// Integer arithmetic is exact for the usual resolutions, which divide a second evenly.
+	if units := uint64(iface.unitsPerSecond); float64(units) == iface.unitsPerSecond &&
+		units > 0 && units <= 1e9 && 1e9%units == 0 {
+		return time.Unix(int64(p.Timestamp/units), int64(p.Timestamp%units*(1e9/units)))
+	}
+	secs := float64(p.Timestamp) / iface.unitsPerSecond
+	whole := math.Floor(secs)
+	return time.Unix(int64(whole), int64((secs-whole)*1e9))
+}
+
+// AddComment adds a comment option to the packet.
+func (p *Packet) AddComment(comment string) {
+	p.Options = append(p.Options, Option{OptionComment, []byte(comment)})
+}
+
+// Comments returns the values of any comment options on the packet.
+func (p Packet) Comments() []string {
+	comments := []string{}
+	for _, opt := range p.Options {
+		if opt.Code == OptionComment {
+			comments = append(comments, string(opt.Value))
+		}
+	}
+	return comments
+}
+
+// Rewriter copies a pcapng file, applying transformations along the way.
+type Rewriter struct {
+	// SectionComments are added to each section header block.
+	SectionComments []string
+
+	// Section, if non-nil, is called for each section header block with the comments it already
+	// has, before any of the section's packets.
+	Section func(comments []string) error
+
+	// Packet, if non-nil, is called for each enhanced packet block. The packet may be modified in
+	// place. If Packet returns false, the packet is dropped.
+	Packet func(p *Packet, iface Interface) (keep bool, err error)
+
+	// Append adds interfaces, and the packets captured on them, to the end of the first section. If
+	// the input is empty, a section is created for them. Packet is not called for these packets.
+	Append []AppendedInterface
+}
+
+// AppendedInterface is an interface added to a pcapng file by a Rewriter, along with its packets.
+// Packet timestamps are in microseconds, the default resolution; InterfaceID is assigned by the
+// Rewriter.
+type AppendedInterface struct {
+	LinkType uint16
+	Options  []Option
+	Packets  []Packet
+}
+
+// MicrosecondTimestamp converts t to a timestamp for an AppendedInterface packet.
+func MicrosecondTimestamp(t time.Time) uint64 {
+	return uint64(t.UnixNano() / 1000)
+}
+
+// Rewrite reads a pcapng file from r and writes the transformed file to w.
+func (rw Rewriter) Rewrite(r io.Reader, w io.Writer) error {
+	var (
+		order      binary.ByteOrder = binary.LittleEndian
+		interfaces []Interface
+		sections   int
+	)
+	for {
+		b, newOrder, err := readBlock(r, order)
+		if errors.Is(err, io.EOF) {
+			if sections == 0 && len(rw.Append) > 0 {
+				if err := writeBlock(w, newSectionHeader(order), order); err != nil {
+					return err
+				}
+			}
+			if sections <= 1 {
+				return rw.writeAppended(w, order, len(interfaces))
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch b.Type {
+		case BlockTypeSectionHeader:
+			// The end of the first section.
+			if sections == 1 {
+				if err := rw.writeAppended(w, order, len(interfaces)); err != nil {
+					return err
+				}
+			}
+			sections++
+			interfaces = nil
+			if rw.Section != nil {
+				comments, err := sectionComments(b, newOrder)
+				if err != nil {
+					return err
+				}
+				if err := rw.Section(comments); err != nil {
+					return err
+				}
+			}
+			if len(rw.SectionComments) > 0 {
+				if b, err = addSectionComments(b, newOrder, rw.SectionComments); err != nil {
+					return err
+				}
+			}
+			if sections == 1 && len(rw.Append) > 0 {
+				// The section length, if specified, will no longer be correct.
+				b = unspecifySectionLength(b, newOrder)
+			}
+		case BlockTypeInterfaceDescription:
+			iface, err := parseInterface(b.Body, order)
+			if err != nil {
+				return err
+			}
+			interfaces = append(interfaces, *iface)
+		case BlockTypeEnhancedPacket:
+			if rw.Packet == nil {
+				break
+			}
+			p, err := parsePacket(b.Body, order)
+			if err != nil {
+				return err
+			}
+			if int(p.InterfaceID) >= len(interfaces) {
+				return fmt.Errorf("packet references undeclared interface %d", p.InterfaceID)
+			}
+			keep, err := rw.Packet(p, interfaces[p.InterfaceID])
+			if err != nil {
+				return err
+			}
+			if !keep {
+				continue
+			}
+			b = &Block{BlockTypeEnhancedPacket, encodePacket(*p, order)}
+		}
+		order = newOrder
+		if err := writeBlock(w, *b, order); err != nil {
+			return err
+		}
+	}
+}
+
+// Walk reads a pcapng file from r, calling fn for each enhanced packet block in order. Packets in
+// every section are included.
+func Walk(r io.Reader, fn func(p *Packet, iface Interface) error) error {
+	rw := Rewriter{Packet: func(p *Packet, iface Interface) (bool, error) {
+		return false, fn(p, iface)
+	}}
+	return rw.Rewrite(r, ioutil.Discard)
+}
+
+// Writes the appended interfaces, then their packets. The section already declares numInterfaces.
+func (rw Rewriter) writeAppended(w io.Writer, order binary.ByteOrder, numInterfaces int) error {
+	for _, iface := range rw.Append {
+		body := appendUint16(nil, order, iface.LinkType)
+		body = appendUint16(body, order, 0)
+		// No snap length limit.
+		body = appendUint32(body, order, 0)
+		body = append(body, encodeOptions(iface.Options, order)...)
+		if err := writeBlock(w, Block{BlockTypeInterfaceDescription, body}, order); err != nil {
+			return err
+		}
+	}
+	for i, iface := range rw.Append {
+		for _, p := range iface.Packets {
+			p.InterfaceID = uint32(numInterfaces + i)
+			if err := writeBlock(w, Block{BlockTypeEnhancedPacket, encodePacket(p, order)}, order); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reads the next block. Section header blocks determine the byte order for the remainder of the
+// section, so the (possibly new) byte order is returned.
+func readBlock(r io.Reader, order binary.ByteOrder) (*Block, binary.ByteOrder, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, errors.New("truncated block header")
+		}
+		return nil, nil, err
+	}
+	// The section header block type is a palindrome, so it can be read in either byte order.
+	blockType := order.Uint32(hdr[:4])
+	if blockType == BlockTypeSectionHeader {
+		magic := make([]byte, 4)
+		if _, err := io.ReadFull(r, magic); err != nil {
+			return nil, nil, fmt.Errorf("failed to read byte-order magic: %w", err)
+		}
+		switch {
+		case binary.LittleEndian.Uint32(magic) == byteOrderMagic:
+			order = binary.LittleEndian
+		case binary.BigEndian.Uint32(magic) == byteOrderMagic:
+			order = binary.BigEndian
+		default:
+			return nil, nil, errors.New("bad byte-order magic in section header")
+		}
+		hdr = append(hdr, magic...)
+	}
+	totalLen := order.Uint32(hdr[4:8])
+	if totalLen < 12 || totalLen%4 != 0 || int(totalLen) < len(hdr)+4 {
+		return nil, nil, fmt.Errorf("bad block length %d", totalLen)
+	}
+	rest := make([]byte, int(totalLen)-len(hdr))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, nil, fmt.Errorf("failed to read block: %w", err)
+	}
+	body := append(hdr[8:], rest[:len(rest)-4]...)
+	if trailer := order.Uint32(rest[len(rest)-4:]); trailer != totalLen {
+		return nil, nil, fmt.Errorf("block length mismatch: %d != %d", trailer, totalLen)
+	}
+	return &Block{blockType, body}, order, nil
+}
+
+func writeBlock(w io.Writer, b Block, order binary.ByteOrder) error {
+	totalLen := uint32(12 + len(b.Body))
+	buf := make([]byte, 0, totalLen)
+	buf = appendUint32(buf, order, b.Type)
+	buf = appendUint32(buf, order, totalLen)
+	buf = append(buf, b.Body...)
+	buf = appendUint32(buf, order, totalLen)
+	_, err := w.Write(buf)
+	return err
+}
+
+func appendUint16(b []byte, order binary.ByteOrder, v uint16) []byte {
+	b = append(b, 0, 0)
+	order.PutUint16(b[len(b)-2:], v)
+	return b
+}
+
+func appendUint32(b []byte, order binary.ByteOrder, v uint32) []byte {
+	b = append(b, 0, 0, 0, 0)
+	order.PutUint32(b[len(b)-4:], v)
+	return b
+}
+
+func padLen(n int) int {
+	return (4 - n%4) % 4
+}
+
+func parseOptions(b []byte, order binary.ByteOrder) ([]Option, error) {
+	opts := []Option{}
+	for len(b) >= 4 {
+		code, length := order.Uint16(b[:2]), int(order.Uint16(b[2:4]))
+		if code == OptionEndOfOptions {
+			break
+		}
+		b = b[4:]
+		if len(b) < length {
+			return nil, errors.New("truncated option")
+		}
+		opts = append(opts, Option{code, append([]byte{}, b[:length]...)})
+		b = b[min(len(b), length+padLen(length)):]
+	}
+	return opts, nil
+}
+
+func encodeOptions(opts []Option, order binary.ByteOrder) []byte {
+	if len(opts) == 0 {
+		return nil
+	}
+	b := []byte{}
+	for _, opt := range opts {
+		b = appendUint16(b, order, opt.Code)
+		b = appendUint16(b, order, uint16(len(opt.Value)))
+		b = append(b, opt.Value...)
+		b = append(b, make([]byte, padLen(len(opt.Value)))...)
+	}
+	return append(b, 0, 0, 0, 0)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// The fixed portion of a section header body is the byte-order magic, version and section length.
+const sectionHeaderFixedLen = 16
+
+func newSectionHeader(order binary.ByteOrder) Block {
+	body := appendUint32(nil, order, byteOrderMagic)
+	// Version 1.0.
+	body = appendUint16(body, order, 1)
+	body = appendUint16(body, order, 0)
+	body = append(body, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	return Block{BlockTypeSectionHeader, body}
+}
+
+func unspecifySectionLength(b *Block, order binary.ByteOrder) *Block {
+	if len(b.Body) < sectionHeaderFixedLen {
+		return b
+	}
+	body := append([]byte{}, b.Body...)
+	for i := 8; i < sectionHeaderFixedLen; i++ {
+		body[i] = 0xff
+	}
+	return &Block{b.Type, body}
+}
+
+func sectionComments(b *Block, order binary.ByteOrder) ([]string, error) {
+	if len(b.Body) < sectionHeaderFixedLen {
+		return nil, errors.New("truncated section header")
+	}
+	opts, err := parseOptions(b.Body[sectionHeaderFixedLen:], order)
+	if err != nil {
+		return nil, fmt.Errorf("bad section header options: %w", err)
+	}
+	comments := []string{}
+	for _, opt := range opts {
+		if opt.Code == OptionComment {
+			comments = append(comments, string(opt.Value))
+		}
+	}
+	return comments, nil
+}
+
+func addSectionComments(b *Block, order binary.ByteOrder, comments []string) (*Block, error) {
+	if len(b.Body) < sectionHeaderFixedLen {
+		return nil, errors.New("truncated section header")
+	}
+	opts, err := parseOptions(b.Body[sectionHeaderFixedLen:], order)
+	if err != nil {
+		return nil, fmt.Errorf("bad section header options: %w", err)
+	}
+	for _, c := range comments {
+		opts = append(opts, Option{OptionComment, []byte(c)})
+	}
+	body := append([]byte{}, b.Body[:sectionHeaderFixedLen]...)
+	return &Block{b.Type, append(body, encodeOptions(opts, order)...)}, nil
+}
+
+// The fixed portion of an interface description body is the link type, reserved field and snap
+// length.
+const interfaceFixedLen = 8
+
+func parseInterface(body []byte, order binary.ByteOrder) (*Interface, error) {
+	if len(body) < interfaceFixedLen {
+		return nil, errors.New("truncated interface description")
+	}
+	opts, err := parseOptions(body[interfaceFixedLen:], order)
+	if err != nil {
+		return nil, fmt.Errorf("bad interface description options: %w", err)
+	}
+	// The default resolution is microseconds.
+	iface := &Interface{LinkType: order.Uint16(body[:2]), unitsPerSecond: 1e6}
+	for _, opt := range opts {
+		if opt.Code != optionInterfaceTimestampResolution || len(opt.Value) != 1 {
+			continue
+		}
+		exp := float64(opt.Value[0] & 0x7f)
+		if opt.Value[0]&0x80 == 0 {
+			iface.unitsPerSecond = math.Pow(10, exp)
+		} else {
+			iface.unitsPerSecond = math.Pow(2, exp)
+		}
+	}
+	return iface, nil
+}
+
+// The fixed portion of an enhanced packet body is the interface ID, timestamp (high and low),
+// captured length and original length.
+const packetFixedLen = 20
+
+func parsePacket(body []byte, order binary.ByteOrder) (*Packet, error) {
+	if len(body) < packetFixedLen {
+		return nil, errors.New("truncated enhanced packet block")
+	}
+	capLen := int(order.Uint32(body[12:16]))
+	dataEnd := packetFixedLen + capLen
+	if dataEnd > len(body) {
+		return nil, errors.New("truncated packet data")
+	}
+	p := &Packet{
+		InterfaceID:    order.Uint32(body[:4]),
+		Timestamp:      uint64(order.Uint32(body[4:8]))<<32 | uint64(order.Uint32(body[8:12])),
+		OriginalLength: order.Uint32(body[16:20]),
+		Data:           append([]byte{}, body[packetFixedLen:dataEnd]...),
+	}
+	optStart := min(len(body), dataEnd+padLen(capLen))
+	opts, err := parseOptions(body[optStart:], order)
+	if err != nil {
+		return nil, fmt.Errorf("bad packet options: %w", err)
+	}
+	p.Options = opts
+	return p, nil
+}
+
+func encodePacket(p Packet, order binary.ByteOrder) []byte {
+	b := make([]byte, 0, packetFixedLen+len(p.Data)+4)
+	b = appendUint32(b, order, p.InterfaceID)
+	b = appendUint32(b, order, uint32(p.Timestamp>>32))
+	b = appendUint32(b, order, uint32(p.Timestamp))
+	b = appendUint32(b, order, uint32(len(p.Data)))
+	b = appendUint32(b, order, p.OriginalLength)
+	b = append(b, p.Data...)
+	b = append(b, make([]byte, padLen(len(p.Data)))...)
+	return append(b, encodeOptions(p.Options, order)...)
+}
@@ -0,0 +1,130 @@
+package pcapng
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewrite(t *testing.T) {
+	start := time.Date(2022, 9, 3, 14, 30, 0, 123456000, time.UTC)
+	packets := [][]byte{{1, 2, 3}, {4, 5, 6, 7, 8}, {9}}
+
+	src := new(bytes.Buffer)
+	w, err := pcapgo.NewNgWriter(src, layers.LinkTypeEthernet)
+	require.NoError(t, err)
+	for i, data := range packets {
+		ci := gopacket.CaptureInfo{
+			Timestamp:     start.Add(time.Duration(i) * time.Second),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}
+		require.NoError(t, w.WritePacket(ci, data))
+	}
+	require.NoError(t, w.Flush())
+
+	var seen []time.Time
+	dst := new(bytes.Buffer)
+	rw := Rewriter{
+		SectionComments: []string{"section comment"},
+		Packet: func(p *Packet, iface Interface) (bool, error) {
+			require.Equal(t, uint16(layers.LinkTypeEthernet), iface.LinkType)
+			seen = append(seen, p.Time(iface))
+			if len(p.Data) == 1 {
+				return false, nil
+			}
+			p.AddComment("packet comment")
+			p.Data[0] = 0xff
+			return true, nil
+		},
+	}
+	require.NoError(t, rw.Rewrite(bytes.NewReader(src.Bytes()), dst))
+	require.Len(t, seen, len(packets))
+	for i, ts := range seen {
+		require.WithinDuration(t, start.Add(time.Duration(i)*time.Second), ts, time.Microsecond)
+	}
+
+	// The output should be readable by pcapgo.
+	r, err := pcapgo.NewNgReader(bytes.NewReader(dst.Bytes()), pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+	require.Equal(t, "section comment", r.SectionInfo().Comment)
+	var read [][]byte
+	for {
+		data, _, err := r.ReadPacketData()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		read = append(read, data)
+	}
+	require.Equal(t, [][]byte{{0xff, 2, 3}, {0xff, 5, 6, 7, 8}}, read)
+
+	// And the comments should survive another pass.
+	var sectionComments, comments []string
+	rw = Rewriter{
+		Section: func(c []string) error {
+			sectionComments = append(sectionComments, c...)
+			return nil
+		},
+		Packet: func(p *Packet, _ Interface) (bool, error) {
+			comments = append(comments, p.Comments()...)
+			return true, nil
+		},
+	}
+	require.NoError(t, rw.Rewrite(bytes.NewReader(dst.Bytes()), ioutil.Discard))
+	require.Equal(t, []string{"section comment"}, sectionComments)
+	require.Equal(t, []string{"packet comment", "packet comment"}, comments)
+}
+
+func TestRewriteAppend(t *testing.T) {
+	ts := time.Date(2022, 9, 3, 14, 30, 0, 123456000, time.UTC)
+	appended := []AppendedInterface{{
+		LinkType: uint16(layers.LinkTypeRaw),
+		Options:  []Option{{OptionInterfaceName, []byte("en0")}},
+		Packets: []Packet{{
+			Timestamp:      MicrosecondTimestamp(ts),
+			OriginalLength: 3,
+			Data:           []byte{7, 8, 9},
+		}},
+	}}
+
+	src := new(bytes.Buffer)
+	w, err := pcapgo.NewNgWriter(src, layers.LinkTypeEthernet)
+	require.NoError(t, err)
+	require.NoError(t, w.WritePacket(gopacket.CaptureInfo{Timestamp: ts, CaptureLength: 1, Length: 1}, []byte{1}))
+	require.NoError(t, w.Flush())
+
+	// An empty input should result in a new section.
+	for _, input := range [][]byte{src.Bytes(), nil} {
+		dst := new(bytes.Buffer)
+		rw := Rewriter{Append: appended}
+		require.NoError(t, rw.Rewrite(bytes.NewReader(input), dst))
+
+		r, err := pcapgo.NewNgReader(bytes.NewReader(dst.Bytes()), pcapgo.NgReaderOptions{WantMixedLinkType: true})
+		require.NoError(t, err)
+		var last []byte
+		var lastCI gopacket.CaptureInfo
+		for {
+			data, ci, err := r.ReadPacketData()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+			last, lastCI = data, ci
+		}
+		require.Equal(t, []byte{7, 8, 9}, last)
+		require.WithinDuration(t, ts, lastCI.Timestamp, time.Microsecond)
+		iface, err := r.Interface(lastCI.InterfaceIndex)
+		require.NoError(t, err)
+		require.Equal(t, "en0", iface.Name)
+		require.Equal(t, layers.LinkTypeRaw, iface.LinkType)
+	}
+}
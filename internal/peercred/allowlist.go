@@ -0,0 +1,140 @@
+// Package peercred authenticates tlserver peers on Linux, where the code-signing checks performed by
+// authipc are unavailable. Peers are identified using SO_PEERCRED: a peer must be running as the
+// user for which tlserver was installed, and its executable must hash to an allow-listed value.
+//
+// The allow list is written to the install directory by tlconfig, running as root.
+package peercred
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// FileName is the name of the allow list file, which lives alongside the tlserver binary.
+const FileName = "tlserver-peers.json"
+
+// AllowList describes the processes permitted to connect to tlserver.
+type AllowList struct {
+	// UID is the user ID of the user for which tlserver was installed.
+	UID int
+
+	// SHA256 holds the hex-encoded SHA-256 hashes of allowed executables.
+	SHA256 []string
+}
+
+// Path returns the path to the allow list file in the input install directory.
+func Path(installDir string) string {
+	return filepath.Join(installDir, FileName)
+}
+
+// Load the allow list at the input path. Because this file controls access to tlserver, it is
+// opened without following symbolic links and refused unless CheckFile accepts it.
+func Load(path string) (*AllowList, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open allow list: %w", err)
+	}
+	defer f.Close()
+	if err := CheckFile(f); err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read allow list: %w", err)
+	}
+	al := new(AllowList)
+	if err := json.Unmarshal(b, al); err != nil {
+		return nil, fmt.Errorf("failed to decode allow list: %w", err)
+	}
+	return al, nil
+}
+
+// CheckFile returns an error unless the opened allow list is a regular file owned by root and
+// writable only by root. The install directory is owned by the user, so files with more than one
+// link are refused too: these may be hard links to some other file owned by root.
+func CheckFile(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat allow list: %w", err)
+	}
+	statT, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("failed to obtain detailed stat info")
+	}
+	if !info.Mode().IsRegular() || statT.Uid != 0 || info.Mode().Perm()&0022 != 0 || statT.Nlink != 1 {
+		return fmt.Errorf(
+			"refusing to use allow list %s: must be a regular file owned by root, writable only by root and with a single link",
+			f.Name())
+	}
+	return nil
+}
+
+// Encode the allow list as it should be written to disk.
+func (al AllowList) Encode() ([]byte, error) {
+	b, err := json.MarshalIndent(al, "", "\t")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode allow list: %w", err)
+	}
+	return append(b, '\n'), nil
+}
+
+// Check returns an AuthError if the peer is not allowed.
+func (al AllowList) Check(peer Peer) error {
+	if peer.UID != al.UID {
+		return AuthError{peer, fmt.Sprintf("peer UID does not match installing user (UID %d)", al.UID)}
+	}
+	for _, allowed := range al.SHA256 {
+		if peer.SHA256 == allowed {
+			return nil
+		}
+	}
+	return AuthError{peer, "peer executable hash is not in the allow list"}
+}
+
+// HashFile returns the hex-encoded SHA-256 hash of the file at the input path.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Peer describes the process on the other end of a connection.
+type Peer struct {
+	PID, UID int
+
+	// Executable is the path to the peer's executable and SHA256 is the hex-encoded hash of its
+	// contents. These may be empty if they could not be determined.
+	Executable, SHA256 string
+}
+
+// AuthError is returned when a peer fails authentication.
+type AuthError struct {
+	Peer   Peer
+	Reason string
+}
+
+func (e AuthError) Error() string {
+	exe := e.Peer.Executable
+	if exe == "" {
+		exe = "unknown executable"
+	}
+	return fmt.Sprintf(
+		"peer authentication failed for PID %d (%s, UID %d, SHA-256 %s): %s",
+		e.Peer.PID, exe, e.Peer.UID, e.Peer.SHA256, e.Reason,
+	)
+}
@@ -0,0 +1,21 @@
+package peercred
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	allow := AllowList{UID: 501, SHA256: []string{"aaaa", "bbbb"}}
+	require.NoError(t, allow.Check(Peer{PID: 10, UID: 501, SHA256: "bbbb"}))
+
+	err := allow.Check(Peer{PID: 10, UID: 502, SHA256: "aaaa"})
+	require.True(t, errors.As(err, new(AuthError)))
+	require.Contains(t, err.Error(), "UID")
+
+	err = allow.Check(Peer{PID: 10, UID: 501, Executable: "/usr/bin/evil", SHA256: "cccc"})
+	require.True(t, errors.As(err, new(AuthError)))
+	require.Contains(t, err.Error(), "/usr/bin/evil")
+}
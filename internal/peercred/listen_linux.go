@@ -0,0 +1,170 @@
+package peercred
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// Listener is a Unix domain socket listener which authenticates peers against an allow list.
+// Connections from peers failing authentication are closed immediately and never returned by
+// Accept.
+type Listener struct {
+	*net.UnixListener
+
+	allow   AllowList
+	onError func(error)
+}
+
+// Listen on the Unix domain socket at the input path. Any authentication failures are passed to
+// onError, which may be nil.
+func Listen(path string, allow AllowList, onError func(error)) (*Listener, error) {
+	addr, err := net.ResolveUnixAddr("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address: %w", err)
+	}
+	l, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		return nil, err
+	}
+	if onError == nil {
+		onError = func(_ error) {}
+	}
+	return &Listener{l, allow, onError}, nil
+}
+
+// Conn is an authenticated connection.
+type Conn struct {
+	*net.UnixConn
+
+	// Peer is the process on the other end of the connection.
+	Peer Peer
+}
+
+// Accept the next authenticated connection. The returned connection is a *Conn.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.AcceptUnix()
+		if err != nil {
+			return nil, err
+		}
+		peer, err := Identify(c)
+		if err == nil {
+			err = l.allow.Check(*peer)
+		}
+		if err != nil {
+			c.Close()
+			l.onError(err)
+			continue
+		}
+		return &Conn{c, *peer}, nil
+	}
+}
+
+// Identify the process on the other end of the connection. Note that the PID reported by
+// SO_PEERCRED is that of the process which connected; we read its executable immediately to
+// narrow the window in which the PID could be reused.
+func Identify(c *net.UnixConn) (*Peer, error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain raw connection: %w", err)
+	}
+	var (
+		cred    *syscall.Ucred
+		credErr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to access socket: %w", err)
+	}
+	if credErr != nil {
+		return nil, fmt.Errorf("failed to read peer credentials: %w", credErr)
+	}
+
+	peer := &Peer{PID: int(cred.Pid), UID: int(cred.Uid)}
+	exeLink := fmt.Sprintf("/proc/%d/exe", peer.PID)
+	peer.Executable, _ = os.Readlink(exeLink)
+	// Hash via the /proc link rather than the path, which may have been replaced since exec.
+	if peer.SHA256, err = hashExecutable(exeLink); err != nil {
+		return nil, AuthError{*peer, fmt.Sprintf("failed to hash peer executable: %v", err)}
+	}
+	return peer, nil
+}
+
+// Identifies a version of a file. The change time is included as, unlike the modification time,
+// it cannot be set by the file's owner; any write or attempt to restore the modification time
+// updates it.
+type fileVersion struct {
+	dev, ino, size      uint64
+	mtimeSec, mtimeNsec int64
+	ctimeSec, ctimeNsec int64
+}
+
+func versionOf(f *os.File) (*fileVersion, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	statT, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, errors.New("failed to obtain detailed stat info")
+	}
+	return &fileVersion{
+		uint64(statT.Dev), uint64(statT.Ino), uint64(statT.Size),
+		int64(statT.Mtim.Sec), int64(statT.Mtim.Nsec),
+		int64(statT.Ctim.Sec), int64(statT.Ctim.Nsec),
+	}, nil
+}
+
+// Maximum number of digests cached by hashExecutable. Peers are typically few, so the cache is
+// simply cleared when full.
+const maxCachedDigests = 64
+
+var (
+	digestsMx sync.Mutex
+	digests   = map[fileVersion]string{}
+)
+
+// Like HashFile, but digests are cached by file version, so that peers reconnecting do not cost
+// a read of their entire executable each time. The version is read from the open file before and
+// after hashing; the digest is only cached if the file did not change in between.
+func hashExecutable(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	before, err := versionOf(f)
+	if err != nil {
+		return "", err
+	}
+	digestsMx.Lock()
+	digest, ok := digests[*before]
+	digestsMx.Unlock()
+	if ok {
+		return digest, nil
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	digest = hex.EncodeToString(h.Sum(nil))
+	if after, err := versionOf(f); err == nil && *after == *before {
+		digestsMx.Lock()
+		if len(digests) >= maxCachedDigests {
+			digests = map[fileVersion]string{}
+		}
+		digests[*before] = digest
+		digestsMx.Unlock()
+	}
+	return digest, nil
+}
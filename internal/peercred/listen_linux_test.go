@@ -0,0 +1,86 @@
+package peercred
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peercred-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	selfHash, err := HashFile("/proc/self/exe")
+	require.NoError(t, err)
+
+	// The connection is accepted or closed before Accept returns, so we test with a short-lived
+	// listener per case.
+	accepted := func(allow AllowList) (bool, error) {
+		var (
+			l       *Listener
+			authErr error
+		)
+		l, err := Listen(filepath.Join(dir, "test.sock"), allow, func(err error) {
+			authErr = err
+			l.Close()
+		})
+		require.NoError(t, err)
+		defer l.Close()
+
+		acceptC := make(chan error, 1)
+		go func() {
+			c, err := l.Accept()
+			if err == nil {
+				c.Close()
+			}
+			acceptC <- err
+		}()
+		c, err := net.Dial("unix", filepath.Join(dir, "test.sock"))
+		require.NoError(t, err)
+		defer c.Close()
+		return <-acceptC == nil, authErr
+	}
+
+	ok, authErr := accepted(AllowList{UID: os.Getuid(), SHA256: []string{selfHash}})
+	require.True(t, ok)
+	require.NoError(t, authErr)
+
+	ok, authErr = accepted(AllowList{UID: os.Getuid(), SHA256: []string{"not-a-hash"}})
+	require.False(t, ok)
+	require.True(t, errors.As(authErr, new(AuthError)))
+
+	ok, authErr = accepted(AllowList{UID: os.Getuid() + 1, SHA256: []string{selfHash}})
+	require.False(t, ok)
+	require.True(t, errors.As(authErr, new(AuthError)))
+}
+
+func TestHashExecutable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exe")
+	require.NoError(t, ioutil.WriteFile(path, []byte("original"), 0700))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	expected, err := HashFile(path)
+	require.NoError(t, err)
+	digest, err := hashExecutable(path)
+	require.NoError(t, err)
+	require.Equal(t, expected, digest)
+	digest, err = hashExecutable(path)
+	require.NoError(t, err)
+	require.Equal(t, expected, digest)
+
+	// Rewriting the file and restoring its modification time must not return the cached digest.
+	require.NoError(t, ioutil.WriteFile(path, []byte("modified"), 0700))
+	require.NoError(t, os.Chtimes(path, info.ModTime(), info.ModTime()))
+	expected, err = HashFile(path)
+	require.NoError(t, err)
+	digest, err = hashExecutable(path)
+	require.NoError(t, err)
+	require.Equal(t, expected, digest)
+}
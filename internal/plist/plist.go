@@ -0,0 +1,258 @@
+// Package plist encodes and decodes XML property lists, as used by launchd. Only the subset of the
+// format needed for launchd job definitions is supported: dictionaries, arrays, strings, integers,
+// reals, booleans, data and dates.
+//
+// Values are represented using the following Go types:
+//
+//	dict    - Dict (map[string]interface{} is also accepted when encoding)
+//	array   - []interface{} ([]string is also accepted when encoding)
+//	string  - string
+//	integer - int64 (int is also accepted when encoding)
+//	real    - float64
+//	true    - bool
+//	false   - bool
+//	data    - []byte
+//	date    - time.Time
+package plist
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const header = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+`
+
+// Dict is a property list dictionary. Keys are encoded in sorted order.
+type Dict map[string]interface{}
+
+// Marshal encodes v as an XML property list.
+func Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	buf.WriteString(header)
+	buf.WriteString("<plist version=\"1.0\">\n")
+	if err := encodeValue(buf, v, 1); err != nil {
+		return nil, err
+	}
+	buf.WriteString("</plist>\n")
+	return buf.Bytes(), nil
+}
+
+func encodeValue(buf *bytes.Buffer, v interface{}, depth int) error {
+	indent := strings.Repeat("\t", depth)
+	writeElem := func(name, content string) {
+		buf.WriteString(indent)
+		buf.WriteString("<" + name + ">")
+		xml.EscapeText(buf, []byte(content))
+		buf.WriteString("</" + name + ">\n")
+	}
+
+	switch v := v.(type) {
+	case Dict:
+		return encodeDict(buf, v, depth)
+	case map[string]interface{}:
+		return encodeDict(buf, v, depth)
+	case []interface{}:
+		buf.WriteString(indent + "<array>\n")
+		for _, elem := range v {
+			if err := encodeValue(buf, elem, depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(indent + "</array>\n")
+	case []string:
+		buf.WriteString(indent + "<array>\n")
+		for _, elem := range v {
+			if err := encodeValue(buf, elem, depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(indent + "</array>\n")
+	case string:
+		writeElem("string", v)
+	case int:
+		writeElem("integer", strconv.Itoa(v))
+	case int64:
+		writeElem("integer", strconv.FormatInt(v, 10))
+	case float64:
+		writeElem("real", strconv.FormatFloat(v, 'g', -1, 64))
+	case bool:
+		if v {
+			buf.WriteString(indent + "<true/>\n")
+		} else {
+			buf.WriteString(indent + "<false/>\n")
+		}
+	case []byte:
+		writeElem("data", base64.StdEncoding.EncodeToString(v))
+	case time.Time:
+		writeElem("date", v.UTC().Format(time.RFC3339))
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+	return nil
+}
+
+func encodeDict(buf *bytes.Buffer, d map[string]interface{}, depth int) error {
+	indent := strings.Repeat("\t", depth)
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf.WriteString(indent + "<dict>\n")
+	for _, k := range keys {
+		buf.WriteString(indent + "\t<key>")
+		xml.EscapeText(buf, []byte(k))
+		buf.WriteString("</key>\n")
+		if err := encodeValue(buf, d[k], depth+1); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+	buf.WriteString(indent + "</dict>\n")
+	return nil
+}
+
+// Unmarshal decodes an XML property list. See the package doc for the types used to represent the
+// decoded value.
+func Unmarshal(data []byte) (interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil, errors.New("no plist element found")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			if start.Name.Local != "plist" {
+				return nil, fmt.Errorf("expected plist element, found %s", start.Name.Local)
+			}
+			break
+		}
+	}
+	start, err := nextStart(d)
+	if err != nil {
+		return nil, err
+	}
+	return decodeValue(d, start)
+}
+
+// Returns the next start element, skipping character data, comments and the like. Returns an error
+// if an end element is found first.
+func nextStart(d *xml.Decoder) (*xml.StartElement, error) {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			return &tok, nil
+		case xml.EndElement:
+			return nil, nil
+		}
+	}
+}
+
+func decodeValue(d *xml.Decoder, start *xml.StartElement) (interface{}, error) {
+	if start == nil {
+		return nil, errors.New("expected value")
+	}
+	text := func() (string, error) {
+		var s string
+		if err := d.DecodeElement(&s, start); err != nil {
+			return "", fmt.Errorf("failed to decode %s: %w", start.Name.Local, err)
+		}
+		return s, nil
+	}
+
+	switch start.Name.Local {
+	case "dict":
+		dict := Dict{}
+		for {
+			keyStart, err := nextStart(d)
+			if err != nil {
+				return nil, err
+			}
+			if keyStart == nil {
+				return dict, nil
+			}
+			if keyStart.Name.Local != "key" {
+				return nil, fmt.Errorf("expected key in dict, found %s", keyStart.Name.Local)
+			}
+			var key string
+			if err := d.DecodeElement(&key, keyStart); err != nil {
+				return nil, fmt.Errorf("failed to decode key: %w", err)
+			}
+			valueStart, err := nextStart(d)
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeValue(d, valueStart)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			dict[key] = value
+		}
+	case "array":
+		arr := []interface{}{}
+		for {
+			elemStart, err := nextStart(d)
+			if err != nil {
+				return nil, err
+			}
+			if elemStart == nil {
+				return arr, nil
+			}
+			elem, err := decodeValue(d, elemStart)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, elem)
+		}
+	case "string":
+		return text()
+	case "integer":
+		s, err := text()
+		if err != nil {
+			return nil, err
+		}
+		return strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	case "real":
+		s, err := text()
+		if err != nil {
+			return nil, err
+		}
+		return strconv.ParseFloat(strings.TrimSpace(s), 64)
+	case "true", "false":
+		if err := d.Skip(); err != nil {
+			return nil, err
+		}
+		return start.Name.Local == "true", nil
+	case "data":
+		s, err := text()
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+	case "date":
+		s, err := text()
+		if err != nil {
+			return nil, err
+		}
+		return time.Parse(time.RFC3339, strings.TrimSpace(s))
+	default:
+		return nil, fmt.Errorf("unsupported element %s", start.Name.Local)
+	}
+}
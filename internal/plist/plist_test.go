@@ -0,0 +1,52 @@
+package plist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	in := Dict{
+		"Label":            "org.getlantern.test",
+		"ProgramArguments": []string{"/path/to/bin", "-flag", "<escaped & value>"},
+		"RunAtLoad":        true,
+		"Disabled":         false,
+		"KeepAlive":        Dict{"SuccessfulExit": false},
+		"Nice":             -5,
+		"Ratio":            0.5,
+		"Data":             []byte{0, 1, 2, 3},
+		"Date":             now,
+	}
+	b, err := Marshal(in)
+	require.NoError(t, err)
+
+	out, err := Unmarshal(b)
+	require.NoError(t, err)
+	require.Equal(t, Dict{
+		"Label":            "org.getlantern.test",
+		"ProgramArguments": []interface{}{"/path/to/bin", "-flag", "<escaped & value>"},
+		"RunAtLoad":        true,
+		"Disabled":         false,
+		"KeepAlive":        Dict{"SuccessfulExit": false},
+		"Nice":             int64(-5),
+		"Ratio":            0.5,
+		"Data":             []byte{0, 1, 2, 3},
+		"Date":             now,
+	}, out)
+}
+
+func TestUnmarshalFormatting(t *testing.T) {
+	// Whitespace and comments should not matter.
+	const data = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+  <!-- a comment -->
+  <key>Label</key>     <string>x</string>
+  <key>List</key><array><integer> 1 </integer><true/></array>
+</dict></plist>`
+	out, err := Unmarshal([]byte(data))
+	require.NoError(t, err)
+	require.Equal(t, Dict{"Label": "x", "List": []interface{}{int64(1), true}}, out)
+}
@@ -0,0 +1,34 @@
+package tlapi
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MaxAnnotationLength is the maximum length, in bytes, of an annotation message.
+const MaxAnnotationLength = 1024
+
+// Annotation describes an event observed by the client, such as a failure to dial a proxy.
+// Annotations are recorded in exported captures.
+type Annotation struct {
+	// Address is the address concerned by the event, in the form host:port. Optional.
+	Address string `json:",omitempty"`
+
+	Time    time.Time
+	Message string
+}
+
+// Validate checks that the annotation has a time and a message of acceptable length.
+func (a Annotation) Validate() error {
+	if a.Time.IsZero() {
+		return errors.New("annotation time must be provided")
+	}
+	if a.Message == "" {
+		return errors.New("annotation message must be provided")
+	}
+	if len(a.Message) > MaxAnnotationLength {
+		return fmt.Errorf("annotation message exceeds %d bytes", MaxAnnotationLength)
+	}
+	return nil
+}
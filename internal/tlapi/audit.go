@@ -0,0 +1,79 @@
+package tlapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// AuditLogFileName is the name of tlserver's audit log, which lives in the install directory. When
+// the log reaches its size limit, it is moved to the same name with a ".1" suffix (replacing any
+// existing file by that name) and a new log is started.
+const AuditLogFileName = "tlserver-audit.log"
+
+// AuditLogPaths returns the paths of the audit log files in the input install directory, oldest
+// first.
+func AuditLogPaths(installDir string) []string {
+	current := filepath.Join(installDir, AuditLogFileName)
+	return []string{current + ".1", current}
+}
+
+// AuditEntry is a single record in tlserver's audit log. The log is written as JSON lines.
+type AuditEntry struct {
+	Time time.Time
+
+	// The peer making the request. These are omitted if the peer could not be identified.
+	PeerPID        int    `json:",omitempty"`
+	PeerExecutable string `json:",omitempty"`
+
+	Method string `json:",omitempty"`
+	Path   string `json:",omitempty"`
+
+	// Params holds the request body, if any. Large bodies are truncated and recorded as a string.
+	Params json.RawMessage `json:",omitempty"`
+
+	// AddressesAdded and AddressesRemoved describe changes made to the list of captured addresses.
+	AddressesAdded   []string `json:",omitempty"`
+	AddressesRemoved []string `json:",omitempty"`
+
+	// StatusCode and ResponseBytes describe the response.
+	StatusCode    int   `json:",omitempty"`
+	ResponseBytes int64 `json:",omitempty"`
+
+	// Error describes a failed request or authentication failure.
+	Error string `json:",omitempty"`
+}
+
+// ReadAuditLog reads all entries in the audit log files in the input install directory, oldest
+// first. Missing files are skipped; lines which cannot be decoded are returned as entries with
+// only the Error field set.
+func ReadAuditLog(installDir string) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	for _, path := range AuditLogPaths(installDir) {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1024*1024)
+		for scanner.Scan() {
+			var e AuditEntry
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				e = AuditEntry{Error: fmt.Sprintf("malformed audit log entry: %v", err)}
+			}
+			entries = append(entries, e)
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit log: %w", err)
+		}
+	}
+	return entries, nil
+}
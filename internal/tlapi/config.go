@@ -0,0 +1,239 @@
+// Package tlapi defines the messages exchanged between tlproc and tlserver which are not covered by
+// the tlhttp package.
+package tlapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ConfigVersion is the latest version of the Config document. tlserver accepts any version up to
+// and including the version it was built with.
+//
+// Version 2 added MutatorParams. Version 3 added ParentPID and IdleTimeout. Version 4 added
+// Addresses and DropPrivileges. Version 5 added CompressSaves. Version 6 added PersistBytes and
+// PersistTTL.
+const ConfigVersion = 6
+
+// ConfigResponsePrefix precedes the ConfigResponse written by tlserver to stdout. tlserver may
+// write other lines to stdout; the prefix allows the response to be picked out.
+const ConfigResponsePrefix = "config-response: "
+
+// Config is sent by tlproc on tlserver's stdin as a single line of JSON. It replaces command-line
+// flags so that options can be added without changing the command line of the signed binary.
+type Config struct {
+	// Version of this document. Must be set to ConfigVersion by the sender.
+	Version int
+
+	// SocketFile is the file on which tlserver listens. It should not exist.
+	SocketFile string
+
+	// CaptureBytes and SaveBytes are the sizes of the capture and save buffers respectively.
+	CaptureBytes, SaveBytes int
+
+	// StatsInterval is the interval at which tlserver prints stats.
+	StatsInterval Duration
+
+	// Mutator is the name of the mutator applied to captured packets. See the mutators package.
+	Mutator string
+
+	// MutatorParams configure the mutator.
+	MutatorParams map[string]string `json:",omitempty"`
+
+	// ErrorPrefix and StatsPrefix precede error and stats lines printed to stderr.
+	ErrorPrefix, StatsPrefix string
+
+	// ParentPID is the PID of the launching process, which must be tlserver's direct parent. If
+	// set, tlserver shuts down when this process exits.
+	ParentPID int `json:",omitempty"`
+
+	// IdleTimeout, if positive, causes tlserver to shut down when no requests have been received
+	// for this long.
+	IdleTimeout Duration `json:",omitempty"`
+
+	// Addresses, if set, are captured from start-up. Capture handles for these addresses are opened
+	// before tlserver begins serving requests.
+	Addresses []string `json:",omitempty"`
+
+	// DropPrivileges causes tlserver to give up its group privileges once the capture handles for
+	// Addresses are open, before it begins serving requests. tlserver exits if the drop cannot be
+	// verified, unless the user is a member of the privileged group, in which case dropping the
+	// group is not possible; this is reported in Status.Privileges. Without its privileges, tlserver
+	// cannot open new capture handles, so capture cannot start for addresses added later, nor resume
+	// for addresses removed later or whose route changes. DropPrivileges is rejected on Linux.
+	DropPrivileges bool `json:",omitempty"`
+
+	// CompressSaves causes saved packets to be held compressed, in blocks, with SaveBytes bounding
+	// the compressed size. Packets are staged uncompressed as they are saved, in a buffer of the
+	// same size.
+	CompressSaves bool `json:",omitempty"`
+
+	// PersistBytes, if positive, causes saved packets to be written to disk as they are saved, so
+	// that they survive the process. Files are written to PersistDirName under the install
+	// directory, accessible only to the current user, and are capped at this many bytes in total;
+	// the oldest are deleted first. Files left by previous processes are included in exported
+	// captures.
+	PersistBytes int `json:",omitempty"`
+
+	// PersistTTL is the age at which persisted files are deleted. If unset, DefaultPersistTTL is
+	// used.
+	PersistTTL Duration `json:",omitempty"`
+}
+
+// PersistDirName is the name of the directory, in the install directory, holding the packets
+// persisted by tlserver. See Config.PersistBytes.
+const PersistDirName = "saved-captures"
+
+// DefaultPersistTTL is the default for Config.PersistTTL.
+const DefaultPersistTTL = 7 * 24 * time.Hour
+
+// Validate checks that required fields are set. Any problems are returned as a single error.
+func (c Config) Validate() error {
+	problems := []string{}
+	if c.Version < 1 || c.Version > ConfigVersion {
+		problems = append(problems, fmt.Sprintf("unsupported version %d (max %d)", c.Version, ConfigVersion))
+	}
+	if c.SocketFile == "" {
+		problems = append(problems, "SocketFile must be provided")
+	}
+	if c.CaptureBytes <= 0 {
+		problems = append(problems, "CaptureBytes must be positive")
+	}
+	if c.SaveBytes <= 0 {
+		problems = append(problems, "SaveBytes must be positive")
+	}
+	if c.ParentPID < 0 {
+		problems = append(problems, "ParentPID must not be negative")
+	}
+	if c.IdleTimeout < 0 {
+		problems = append(problems, "IdleTimeout must not be negative")
+	}
+	if c.PersistBytes < 0 {
+		problems = append(problems, "PersistBytes must not be negative")
+	}
+	if c.PersistTTL < 0 {
+		problems = append(problems, "PersistTTL must not be negative")
+	}
+	if c.DropPrivileges && len(c.Addresses) == 0 {
+		problems = append(problems, "Addresses must be provided with DropPrivileges")
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ConfigResponse is written by tlserver to stdout, prefixed by ConfigResponsePrefix, after
+// receiving a Config.
+type ConfigResponse struct {
+	Accepted bool
+
+	// Error describes why the config was rejected.
+	Error string `json:",omitempty"`
+
+	// UnknownFields lists any fields in the config which tlserver does not understand. The config
+	// is rejected if this is non-empty.
+	UnknownFields []string `json:",omitempty"`
+}
+
+// WriteConfig writes the config as a single line to w.
+func WriteConfig(w io.Writer, c Config) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+	if _, err := w.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write config: %w", err)
+	}
+	return nil
+}
+
+// ReadConfig reads a single-line config from r. Any fields present in the document, but unknown to
+// the Config type, are returned. The config is not validated.
+func ReadConfig(r io.Reader) (c *Config, unknownFields []string, err error) {
+	line, err := bufio.NewReader(r).ReadBytes('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && len(line) > 0) {
+		return nil, nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(line, &fields); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+	known := map[string]bool{}
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		known[strings.ToLower(t.Field(i).Name)] = true
+	}
+	for name := range fields {
+		// encoding/json matches field names case-insensitively.
+		if !known[strings.ToLower(name)] {
+			unknownFields = append(unknownFields, name)
+		}
+	}
+	sort.Strings(unknownFields)
+
+	c = new(Config)
+	if err := json.NewDecoder(bytes.NewReader(line)).Decode(c); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode config: %w", err)
+	}
+	return c, unknownFields, nil
+}
+
+// WriteConfigResponse writes the response as a single, prefixed line to w.
+func WriteConfigResponse(w io.Writer, resp ConfigResponse) error {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		return fmt.Errorf("failed to encode response: %w", err)
+	}
+	_, err = fmt.Fprintf(w, "%s%s\n", ConfigResponsePrefix, b)
+	return err
+}
+
+// ReadConfigResponse scans r for a line prefixed by ConfigResponsePrefix and decodes it. Other
+// lines are ignored. Once the response has been found, the remainder of r is left unread.
+func ReadConfigResponse(r *bufio.Reader) (*ConfigResponse, error) {
+	for {
+		line, err := r.ReadString('\n')
+		if strings.HasPrefix(line, ConfigResponsePrefix) {
+			resp := new(ConfigResponse)
+			b := strings.TrimSpace(strings.TrimPrefix(line, ConfigResponsePrefix))
+			if err := json.Unmarshal([]byte(b), resp); err != nil {
+				return nil, fmt.Errorf("failed to decode config response: %w", err)
+			}
+			return resp, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("no config response: %w", err)
+		}
+	}
+}
+
+// Duration is a time.Duration encoded in JSON as a string like "1m30s".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
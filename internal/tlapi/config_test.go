@@ -0,0 +1,56 @@
+package tlapi
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigRoundTrip(t *testing.T) {
+	cfg := Config{
+		Version:       ConfigVersion,
+		SocketFile:    "/tmp/test.sock",
+		CaptureBytes:  1024,
+		SaveBytes:     2048,
+		StatsInterval: Duration(time.Second),
+		Mutator:       "truncate",
+		MutatorParams: map[string]string{"bytes": "128"},
+	}
+	buf := new(bytes.Buffer)
+	require.NoError(t, WriteConfig(buf, cfg))
+
+	decoded, unknownFields, err := ReadConfig(buf)
+	require.NoError(t, err)
+	require.Empty(t, unknownFields)
+	require.Equal(t, cfg, *decoded)
+	require.NoError(t, decoded.Validate())
+
+	decoded.DropPrivileges = true
+	require.Error(t, decoded.Validate())
+	decoded.Addresses = []string{"127.0.0.1:443"}
+	require.NoError(t, decoded.Validate())
+}
+
+func TestConfigUnknownFields(t *testing.T) {
+	const doc = `{"Version": 2, "SocketFile": "/tmp/test.sock", "FutureField": true, "another": 1}` + "\n"
+	cfg, unknownFields, err := ReadConfig(strings.NewReader(doc))
+	require.NoError(t, err)
+	require.Equal(t, []string{"FutureField", "another"}, unknownFields)
+	require.Error(t, cfg.Validate())
+}
+
+func TestReadConfigResponse(t *testing.T) {
+	buf := new(bytes.Buffer)
+	buf.WriteString("WARNING: some other output\n")
+	resp := ConfigResponse{Error: "unknown fields in config", UnknownFields: []string{"FutureField"}}
+	require.NoError(t, WriteConfigResponse(buf, resp))
+	buf.WriteString("more output\n")
+
+	decoded, err := ReadConfigResponse(bufio.NewReader(buf))
+	require.NoError(t, err)
+	require.Equal(t, resp, *decoded)
+}
@@ -0,0 +1,77 @@
+package tlapi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DefaultFilterBufferBytes is used when Filter.BufferBytes is not set.
+const DefaultFilterBufferBytes = 1024 * 1024
+
+// Filter is a named BPF filter expression. Packets matching the filter are captured in addition to
+// those captured for the traffic log's addresses. The most recent packets are kept, up to
+// BufferBytes, and are included in every export of the captures.
+type Filter struct {
+	Name       string
+	Expression string
+
+	// Interface is the name of the capture device. Defaults to the device used to reach the
+	// Internet.
+	Interface string `json:",omitempty"`
+
+	// BufferBytes is the maximum size of the packets kept for this filter. Defaults to
+	// DefaultFilterBufferBytes.
+	BufferBytes int `json:",omitempty"`
+}
+
+// FilterUpdate is the body of a request to tlserver's filters endpoint.
+type FilterUpdate struct {
+	Filters []Filter
+}
+
+// FilterStats counts the packets captured by a filter.
+type FilterStats struct {
+	// Received is the total number of packets matching the filter.
+	Received uint64
+
+	// Dropped is the total number of packets dropped by the capture device.
+	Dropped uint64
+}
+
+// Stats are printed by tlserver at the stats interval. The fields of trafficlog.CaptureStats are
+// included, so Stats may be decoded as such.
+type Stats struct {
+	Received, Dropped uint64
+
+	Filters map[string]FilterStats `json:",omitempty"`
+
+	// SaveBuffer is set if saves are compressed. See Config.CompressSaves.
+	SaveBuffer *SaveBufferStats `json:",omitempty"`
+}
+
+// ValidateFilters checks that each filter is named, has an expression and has a name distinct from
+// the others. Any problems are returned as a single error. The expressions are compiled by tlserver.
+func ValidateFilters(filters []Filter) error {
+	problems := []string{}
+	names := map[string]bool{}
+	for i, f := range filters {
+		switch {
+		case f.Name == "":
+			problems = append(problems, fmt.Sprintf("filter %d has no name", i))
+		case names[f.Name]:
+			problems = append(problems, fmt.Sprintf("filter name %s is used more than once", f.Name))
+		}
+		names[f.Name] = true
+		if strings.TrimSpace(f.Expression) == "" {
+			problems = append(problems, fmt.Sprintf("filter %s has no expression", f.Name))
+		}
+		if f.BufferBytes < 0 {
+			problems = append(problems, fmt.Sprintf("filter %s has negative BufferBytes", f.Name))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
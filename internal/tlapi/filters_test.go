@@ -0,0 +1,26 @@
+package tlapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateFilters(t *testing.T) {
+	require.NoError(t, ValidateFilters(nil))
+	require.NoError(t, ValidateFilters([]Filter{
+		{Name: "dns", Expression: "udp port 53"},
+		{Name: "cdn", Expression: "tcp portrange 8000-8100", Interface: "en0", BufferBytes: 4096},
+	}))
+
+	err := ValidateFilters([]Filter{
+		{Name: "", Expression: "udp port 53"},
+		{Name: "dns", Expression: "udp port 53"},
+		{Name: "dns", Expression: " "},
+		{Name: "big", Expression: "tcp", BufferBytes: -1},
+	})
+	require.Error(t, err)
+	for _, problem := range []string{"has no name", "used more than once", "has no expression", "negative BufferBytes"} {
+		require.Contains(t, err.Error(), problem)
+	}
+}
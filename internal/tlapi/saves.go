@@ -0,0 +1,110 @@
+package tlapi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MaxSaveLabelLength is the maximum length, in bytes, of a save label.
+const MaxSaveLabelLength = 256
+
+// SaveWindow requests that packets captured between Start and End, to or from any of Addresses, be
+// saved. Packets captured after the request is received cannot be saved, so End is effectively
+// limited to the time of the request.
+type SaveWindow struct {
+	// Addresses are in the form host:port, as given to the traffic log.
+	Addresses []string
+
+	Start, End time.Time
+
+	// Label identifies the reason for the save, for example an issue ID or a failure type. Labels
+	// are recorded in exported captures. Optional.
+	Label string `json:",omitempty"`
+}
+
+// Validate checks that the window has addresses, that it is well-formed and that the label is of
+// acceptable length.
+func (sw SaveWindow) Validate() error {
+	if len(sw.Addresses) == 0 {
+		return errors.New("at least one address must be provided")
+	}
+	for _, addr := range sw.Addresses {
+		if addr == "" {
+			return errors.New("addresses must not be empty")
+		}
+	}
+	if sw.Start.IsZero() || sw.End.IsZero() {
+		return errors.New("start and end times must be provided")
+	}
+	if !sw.Start.Before(sw.End) {
+		return errors.New("start time must be before end time")
+	}
+	if len(sw.Label) > MaxSaveLabelLength {
+		return fmt.Errorf("label exceeds %d bytes", MaxSaveLabelLength)
+	}
+	return nil
+}
+
+// Comment describes the window as recorded in a section comment of exported captures.
+func (sw SaveWindow) Comment() string {
+	s := fmt.Sprintf("saved %s to %s for %s",
+		sw.Start.UTC().Format(time.RFC3339Nano),
+		sw.End.UTC().Format(time.RFC3339Nano),
+		strings.Join(sw.Addresses, ", "))
+	if sw.Label != "" {
+		s += ": " + sw.Label
+	}
+	return s
+}
+
+// ParseSaveWindowComment parses a section comment written by SaveWindow.Comment. ok is false if the
+// comment does not describe a window.
+func ParseSaveWindowComment(comment string) (sw SaveWindow, ok bool) {
+	rest := strings.TrimPrefix(comment, "saved ")
+	if rest == comment {
+		return sw, false
+	}
+	start, rest, ok := strings.Cut(rest, " to ")
+	if !ok {
+		return sw, false
+	}
+	end, rest, ok := strings.Cut(rest, " for ")
+	if !ok {
+		return sw, false
+	}
+	var err error
+	if sw.Start, err = time.Parse(time.RFC3339Nano, start); err != nil {
+		return sw, false
+	}
+	if sw.End, err = time.Parse(time.RFC3339Nano, end); err != nil {
+		return sw, false
+	}
+	// Addresses do not contain ": ", even in the form [host]:port.
+	addresses, label, _ := strings.Cut(rest, ": ")
+	sw.Addresses, sw.Label = strings.Split(addresses, ", "), label
+	return sw, true
+}
+
+// SaveBufferStats describes the packets held in a compressed save buffer.
+type SaveBufferStats struct {
+	Packets int
+
+	// LogicalBytes is the size of the packet data held. CompressedBytes is the memory it occupies,
+	// which is bounded by the save buffer size.
+	LogicalBytes, CompressedBytes int64
+
+	// ResidentBytes is the total memory occupied by saved packets, including the packets staged
+	// uncompressed. This is bounded by twice the save buffer size.
+	ResidentBytes int64
+}
+
+// PersistedStats describes the files holding packets persisted by tlserver. See
+// Config.PersistBytes.
+type PersistedStats struct {
+	// Files and Bytes count all persisted files. RecoveredFiles counts those left by previous
+	// processes.
+	Files, RecoveredFiles int
+	Bytes                 int64
+}
@@ -0,0 +1,111 @@
+package tlapi
+
+import "time"
+
+// Paths of tlserver endpoints not covered by the tlhttp package.
+const (
+	// PathStatus is the path of tlserver's status endpoint. A GET request returns a Status.
+	PathStatus = "/status"
+
+	// PathMetrics is the path of tlserver's metrics endpoint. A GET request returns metrics in the
+	// Prometheus text exposition format.
+	PathMetrics = "/metrics"
+
+	// PathReconfigure is the path of tlserver's reconfiguration endpoint. A PUT request with a
+	// Reconfiguration body applies the new settings.
+	PathReconfigure = "/reconfigure"
+
+	// PathFilters is the path of tlserver's filters endpoint. A PUT request with a FilterUpdate body
+	// replaces the set of filters.
+	PathFilters = "/filters"
+
+	// PathAnnotations is the path of tlserver's annotations endpoint. A POST request with an
+	// Annotation body records the annotation.
+	PathAnnotations = "/annotations"
+
+	// PathSaveWindow is the path of tlserver's windowed save endpoint. A POST request with a
+	// SaveWindow body saves the packets captured within the window.
+	PathSaveWindow = "/save-window"
+
+	// PathSummary is the path of tlserver's summary endpoint. A GET request returns a Summary of
+	// the captures which would be returned by the captures endpoint. QueryAnonymize is accepted.
+	PathSummary = "/summary"
+)
+
+// QueryAnonymize is a query parameter accepted by tlserver's captures endpoint, which otherwise
+// behaves as documented by tlhttp, and by the summary endpoint. If true, the IP and MAC addresses of
+// the local machine are replaced with pseudonyms in the returned pcapng or summary. The addresses of
+// captured hosts are left alone.
+const QueryAnonymize = "anonymize"
+
+// Reconfiguration holds settings which may be changed while tlserver is running. Zero values leave
+// the corresponding setting unchanged.
+type Reconfiguration struct {
+	StatsInterval Duration          `json:",omitempty"`
+	Mutator       string            `json:",omitempty"`
+	MutatorParams map[string]string `json:",omitempty"`
+}
+
+// ErrorResponse is the body returned by tlserver endpoints on failure. This matches the body
+// returned by the tlhttp endpoints.
+type ErrorResponse struct {
+	ErrorMsg string
+}
+
+// Status describes a running tlserver.
+type Status struct {
+	// Version is the build version of tlserver.
+	Version string
+
+	// DebugBuild is true if tlserver was built with peer authentication disabled.
+	DebugBuild bool
+
+	PID    int
+	Uptime Duration
+
+	// The effective configuration. Buffer sizes reflect any updates made since start-up.
+	CaptureBytes, SaveBytes int
+	StatsInterval           Duration
+	Mutator                 string
+	MutatorParams           map[string]string `json:",omitempty"`
+
+	// Addresses is the current list of addresses for which packets are captured.
+	Addresses []string
+
+	// AcceptedConnections counts the connections accepted by the server. RejectedConnections
+	// counts the connections which failed peer authentication. On macOS, authentication takes
+	// place after a connection has been accepted, so rejected connections are counted in both.
+	AcceptedConnections, RejectedConnections int64
+
+	// LastAuthFailure is the time of the most recent authentication failure, if any.
+	LastAuthFailure *time.Time `json:",omitempty"`
+
+	// Privileges held by tlserver. See Config.DropPrivileges.
+	Privileges Privileges
+
+	// Filters currently in place, with defaults applied, and the packets captured by each.
+	Filters     []Filter
+	FilterStats map[string]FilterStats `json:",omitempty"`
+
+	// CompressSaves is true if saved packets are held compressed. If so, SaveBuffer describes them.
+	CompressSaves bool
+	SaveBuffer    *SaveBufferStats `json:",omitempty"`
+
+	// Persisted describes the packets persisted to disk, if so configured.
+	Persisted *PersistedStats `json:",omitempty"`
+}
+
+// Privileges describes the group privileges held by tlserver.
+type Privileges struct {
+	// Dropped is true if tlserver dropped its group privileges before serving requests and verified
+	// that they could not be regained.
+	Dropped bool
+
+	// NotDropped explains why the privileges were not dropped, if DropPrivileges was set but
+	// dropping them was not possible: on macOS, this is the case if the user is a member of the
+	// privileged group.
+	NotDropped string `json:",omitempty"`
+
+	RealGID, EffectiveGID int
+	SupplementaryGIDs     []int
+}
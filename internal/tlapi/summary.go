@@ -0,0 +1,49 @@
+package tlapi
+
+import "time"
+
+// Summary is a per-flow breakdown of captured packets, intended for triage before the packets
+// themselves are inspected.
+type Summary struct {
+	// Flows are ordered by the time they were first seen.
+	Flows []FlowSummary
+
+	// OtherPackets counts the packets which are neither TCP nor UDP, or which could not be decoded.
+	OtherPackets int
+}
+
+// FlowSummary describes the packets exchanged over a single TCP or UDP 5-tuple.
+type FlowSummary struct {
+	// Protocol is "tcp" or "udp".
+	Protocol string
+
+	// Client and Server are in the form host:port. The client is the side which sent the first SYN
+	// or, failing that, the first packet.
+	Client, Server string
+
+	FirstSeen, LastSeen time.Time
+
+	ClientToServer, ServerToClient FlowDirection
+
+	// HandshakeRTT is the time between the client's last SYN and the server's first SYN-ACK, if
+	// both were captured.
+	HandshakeRTT *Duration `json:",omitempty"`
+
+	// SNI and ClientHelloFingerprint are taken from the first TLS ClientHello sent by the client, if
+	// captured and not stripped by the mutator. The fingerprint is a JA3 hash.
+	SNI                    string `json:",omitempty"`
+	ClientHelloFingerprint string `json:",omitempty"`
+}
+
+// FlowDirection counts the packets sent in one direction of a flow. Bytes are counted at the
+// original length of each packet, including the link-layer header, regardless of any truncation.
+// TCP flags and retransmissions are only counted for TCP flows.
+type FlowDirection struct {
+	Packets int
+	Bytes   int64
+
+	SYN, SYNACK, RST, FIN int
+
+	// Retransmissions counts segments carrying only data already seen in this direction.
+	Retransmissions int
+}
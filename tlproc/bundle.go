@@ -0,0 +1,327 @@
+package tlproc
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getlantern/trafficlog"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+const (
+	// An hour of stats at the default interval.
+	maxRecentStats = 240
+
+	maxRecentStderrLines = 500
+
+	// Recorded in the manifest for files left out of anonymized bundles.
+	omittedWhenAnonymized = "omitted from anonymized bundles"
+)
+
+// StatsRecord is a CaptureStats update, as received by a TrafficLogProcess.
+type StatsRecord struct {
+	Time time.Time
+	trafficlog.CaptureStats
+
+	// Filters holds the packet counts for each filter. See UpdateFilters.
+	Filters map[string]FilterStats `json:",omitempty"`
+
+	// SaveBuffer describes the save buffer if saves are compressed. See Options.CompressSaves.
+	SaveBuffer *SaveBufferStats `json:",omitempty"`
+}
+
+// SaveBufferStats describes the packets held in a compressed save buffer.
+type SaveBufferStats = tlapi.SaveBufferStats
+
+// recent keeps the most recent stats and stderr output of a traffic log process for inclusion in
+// bug-report bundles.
+type recent struct {
+	mx     sync.Mutex
+	stats  []StatsRecord
+	stderr []string
+}
+
+func (r *recent) addStats(stats tlapi.Stats) StatsRecord {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	record := StatsRecord{
+		time.Now(), trafficlog.CaptureStats{Received: stats.Received, Dropped: stats.Dropped},
+		stats.Filters, stats.SaveBuffer,
+	}
+	r.stats = append(r.stats, record)
+	if len(r.stats) > maxRecentStats {
+		r.stats = r.stats[len(r.stats)-maxRecentStats:]
+	}
+	return record
+}
+
+func (r *recent) latestFilterStats() map[string]FilterStats {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	latest := map[string]FilterStats{}
+	if len(r.stats) > 0 {
+		for name, stats := range r.stats[len(r.stats)-1].Filters {
+			latest[name] = stats
+		}
+	}
+	return latest
+}
+
+func (r *recent) addStderr(line string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.stderr = append(r.stderr, line)
+	if len(r.stderr) > maxRecentStderrLines {
+		r.stderr = r.stderr[len(r.stderr)-maxRecentStderrLines:]
+	}
+}
+
+func (r *recent) get() ([]StatsRecord, []string) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return append([]StatsRecord{}, r.stats...), append([]string{}, r.stderr...)
+}
+
+// BundleFormat is an archive format supported by ExportBundle.
+type BundleFormat string
+
+const (
+	BundleZip   BundleFormat = "zip"
+	BundleTarGz BundleFormat = "tar.gz"
+)
+
+// BundleOptions are used to specify optional parameters to ExportBundle.
+type BundleOptions struct {
+	// Format of the bundle. Defaults to BundleZip.
+	Format BundleFormat
+
+	// InstallDir, User and InstallOptions are passed to CheckInstall. If InstallDir is not set, the
+	// installation check is omitted from the bundle.
+	InstallDir, User string
+	InstallOptions   *InstallOptions
+
+	// Anonymize specifies the use of WriteAnonymizedPcapng rather than WritePcapng for the captures,
+	// and of AnonymizedSummary rather than Summary for the summary. The status, installation check
+	// and output of the traffic log process, which may include addresses, user names and paths, are
+	// left out of the bundle.
+	Anonymize bool
+}
+
+// Names of the files in a bundle.
+const (
+	BundleFileCaptures     = "captures.pcapng"
+	BundleFileSummary      = "summary.json"
+	BundleFileStats        = "stats.json"
+	BundleFileStatus       = "status.json"
+	BundleFileInstallCheck = "install-check.json"
+	BundleFileStderr       = "tlserver-stderr.log"
+	BundleFileManifest     = "manifest.json"
+)
+
+// BundleManifest describes the contents of a bundle. It is always the last file in the bundle.
+type BundleManifest struct {
+	Created time.Time
+
+	// Version of the traffic log process, if known.
+	Version string `json:",omitempty"`
+
+	Files []BundleManifestEntry
+
+	// Errors maps the names of files which could not be collected to the reason.
+	Errors map[string]string `json:",omitempty"`
+}
+
+// BundleManifestEntry describes a single file in a bundle.
+type BundleManifestEntry struct {
+	Name   string
+	Size   int
+	SHA256 string
+}
+
+type bundleFile struct {
+	name     string
+	contents []byte
+}
+
+// ExportBundle writes a bug-report bundle to w. The bundle is a single archive containing the saved
+// captures (as written by WritePcapng or WriteAnonymizedPcapng), a summary of the captures (see
+// Summary), recent CaptureStats, the status of the traffic log process, the result of CheckInstall,
+// recent output of the traffic log process, and a manifest with the hash of each file. See
+// BundleOptions.Anonymize for the files left out of anonymized bundles.
+//
+// Failure to collect any one of these is recorded in the manifest rather than failing the export.
+// An error is returned only if the bundle could not be written or ctx is done.
+func (p *TrafficLogProcess) ExportBundle(ctx context.Context, w io.Writer, opts *BundleOptions) error {
+	if opts == nil {
+		opts = &BundleOptions{}
+	}
+	format := opts.Format
+	if format == "" {
+		format = BundleZip
+	}
+	if format != BundleZip && format != BundleTarGz {
+		return fmt.Errorf("unsupported bundle format '%s'", format)
+	}
+
+	var (
+		files    []bundleFile
+		manifest = BundleManifest{Created: time.Now(), Errors: map[string]string{}}
+	)
+	collect := func(name string, get func() ([]byte, error)) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b, err := get()
+		if err != nil {
+			manifest.Errors[name] = err.Error()
+			return nil
+		}
+		files = append(files, bundleFile{name, b})
+		return nil
+	}
+	stats, stderr := p.recent.get()
+	collectors := []struct {
+		name string
+		get  func() ([]byte, error)
+
+		// Set if the file may identify the user and is left out of anonymized bundles.
+		identifying bool
+	}{
+		{BundleFileCaptures, func() ([]byte, error) {
+			buf := new(bytes.Buffer)
+			write := p.WritePcapng
+			if opts.Anonymize {
+				write = p.WriteAnonymizedPcapng
+			}
+			if err := write(buf); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		}, false},
+		{BundleFileSummary, func() ([]byte, error) {
+			summarize := p.Summary
+			if opts.Anonymize {
+				summarize = p.AnonymizedSummary
+			}
+			summary, err := summarize()
+			if err != nil {
+				return nil, err
+			}
+			return json.MarshalIndent(summary, "", "\t")
+		}, false},
+		{BundleFileStats, func() ([]byte, error) {
+			return json.MarshalIndent(stats, "", "\t")
+		}, false},
+		{BundleFileStatus, func() ([]byte, error) {
+			status, err := p.Status()
+			if err != nil {
+				return nil, err
+			}
+			manifest.Version = status.Version
+			return json.MarshalIndent(status, "", "\t")
+		}, true},
+		{BundleFileInstallCheck, func() ([]byte, error) {
+			if opts.InstallDir == "" {
+				return nil, fmt.Errorf("no installation directory provided")
+			}
+			check, err := CheckInstall(opts.InstallDir, opts.User, opts.InstallOptions, p)
+			if err != nil {
+				return nil, err
+			}
+			return json.MarshalIndent(check, "", "\t")
+		}, true},
+		{BundleFileStderr, func() ([]byte, error) {
+			if len(stderr) == 0 {
+				return []byte{}, nil
+			}
+			return []byte(strings.Join(stderr, "\n") + "\n"), nil
+		}, true},
+	}
+	for _, c := range collectors {
+		if opts.Anonymize && c.identifying {
+			manifest.Errors[c.name] = omittedWhenAnonymized
+			continue
+		}
+		if err := collect(c.name, c.get); err != nil {
+			return err
+		}
+	}
+	if opts.Anonymize {
+		// The version is still recorded, though the status is left out.
+		if status, err := p.Status(); err == nil {
+			manifest.Version = status.Version
+		}
+	}
+	if len(manifest.Errors) == 0 {
+		manifest.Errors = nil
+	}
+	return writeBundle(w, format, files, manifest)
+}
+
+// Writes the files and then the manifest, which is completed with an entry for each file.
+func writeBundle(w io.Writer, format BundleFormat, files []bundleFile, manifest BundleManifest) error {
+	for _, f := range files {
+		sum := sha256.Sum256(f.contents)
+		manifest.Files = append(manifest.Files, BundleManifestEntry{
+			Name: f.name, Size: len(f.contents), SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	b, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	files = append(files, bundleFile{BundleFileManifest, b})
+
+	switch format {
+	case BundleZip:
+		zw := zip.NewWriter(w)
+		for _, f := range files {
+			fw, err := zw.CreateHeader(&zip.FileHeader{
+				Name: f.name, Method: zip.Deflate, Modified: manifest.Created,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to create %s: %w", f.name, err)
+			}
+			if _, err := fw.Write(f.contents); err != nil {
+				return fmt.Errorf("failed to write %s: %w", f.name, err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("failed to finish zip: %w", err)
+		}
+	case BundleTarGz:
+		gw := gzip.NewWriter(w)
+		tw := tar.NewWriter(gw)
+		for _, f := range files {
+			err := tw.WriteHeader(&tar.Header{
+				Name: f.name, Mode: 0644, Size: int64(len(f.contents)), ModTime: manifest.Created,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to write header for %s: %w", f.name, err)
+			}
+			if _, err := tw.Write(f.contents); err != nil {
+				return fmt.Errorf("failed to write %s: %w", f.name, err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			return fmt.Errorf("failed to finish tar: %w", err)
+		}
+		if err := gw.Close(); err != nil {
+			return fmt.Errorf("failed to finish gzip: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported bundle format '%s'", format)
+	}
+	return nil
+}
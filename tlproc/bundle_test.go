@@ -0,0 +1,80 @@
+package tlproc
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBundle(t *testing.T) {
+	files := []bundleFile{
+		{BundleFileCaptures, []byte("not really a pcapng")},
+		{BundleFileStderr, []byte("error: something went wrong\n")},
+	}
+	manifest := BundleManifest{
+		Created: time.Now(),
+		Errors:  map[string]string{BundleFileStatus: "failed to send request"},
+	}
+
+	readZip := func(b []byte) map[string][]byte {
+		zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+		require.NoError(t, err)
+		contents := map[string][]byte{}
+		for _, f := range zr.File {
+			r, err := f.Open()
+			require.NoError(t, err)
+			contents[f.Name], err = ioutil.ReadAll(r)
+			require.NoError(t, err)
+			r.Close()
+		}
+		return contents
+	}
+	readTarGz := func(b []byte) map[string][]byte {
+		gr, err := gzip.NewReader(bytes.NewReader(b))
+		require.NoError(t, err)
+		tr := tar.NewReader(gr)
+		contents := map[string][]byte{}
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return contents
+			}
+			require.NoError(t, err)
+			contents[hdr.Name], err = ioutil.ReadAll(tr)
+			require.NoError(t, err)
+		}
+	}
+
+	for format, read := range map[BundleFormat]func([]byte) map[string][]byte{
+		BundleZip:   readZip,
+		BundleTarGz: readTarGz,
+	} {
+		t.Run(string(format), func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			require.NoError(t, writeBundle(buf, format, files, manifest))
+			contents := read(buf.Bytes())
+			require.Len(t, contents, len(files)+1)
+
+			decoded := new(BundleManifest)
+			require.NoError(t, json.Unmarshal(contents[BundleFileManifest], decoded))
+			require.Equal(t, manifest.Errors, decoded.Errors)
+			require.Len(t, decoded.Files, len(files))
+			for i, entry := range decoded.Files {
+				require.Equal(t, files[i].name, entry.Name)
+				require.Equal(t, files[i].contents, contents[entry.Name])
+				sum := sha256.Sum256(contents[entry.Name])
+				require.Equal(t, hex.EncodeToString(sum[:]), entry.SHA256)
+			}
+		})
+	}
+}
@@ -0,0 +1,268 @@
+package tlproc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/getlantern/trafficlog"
+	"github.com/getlantern/trafficlog-flashlight/internal/mutators"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+	"github.com/getlantern/trafficlog/tlhttp"
+)
+
+// Status describes a running traffic log process.
+type Status = tlapi.Status
+
+// Status queries the traffic log process for its current status.
+func (p *TrafficLogProcess) Status() (*Status, error) {
+	status := new(Status)
+	if err := p.do(http.MethodGet, tlapi.PathStatus, nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// WriteMetrics scrapes metrics from the traffic log process and writes them to w in the
+// Prometheus text exposition format. This can be served alongside the parent process's own
+// metrics, or parsed using a Prometheus client library.
+func (p *TrafficLogProcess) WriteMetrics(w io.Writer) error {
+	resp, err := p.request(http.MethodGet, tlapi.PathMetrics, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("failed to copy metrics: %w", err)
+	}
+	return nil
+}
+
+// WriteAnonymizedPcapng behaves like WritePcapng, but the IP and MAC addresses of the local machine
+// are replaced with pseudonyms. The addresses of captured hosts are left alone, so that flows can
+// still be compared with captures taken on the other side. Pseudonyms are consistent for the
+// lifetime of the traffic log process and checksums are adjusted to match. In packets persisted by
+// previous processes (see Options.PersistBytes), the addresses of the hosts captured by the current
+// process and of those recorded as captured by the previous process are left alone.
+func (p *TrafficLogProcess) WriteAnonymizedPcapng(w io.Writer) error {
+	resp := struct{ Pcapng []byte }{}
+	path := fmt.Sprintf("/captures?%s=true", tlapi.QueryAnonymize)
+	if err := p.do(http.MethodGet, path, nil, &resp); err != nil {
+		return err
+	}
+	if _, err := w.Write(resp.Pcapng); err != nil {
+		return fmt.Errorf("failed to write captures: %w", err)
+	}
+	return nil
+}
+
+// Summary is a per-flow breakdown of captured packets. See TrafficLogProcess.Summary.
+type Summary = tlapi.Summary
+
+// FlowSummary describes the packets exchanged over a single TCP or UDP 5-tuple.
+type FlowSummary = tlapi.FlowSummary
+
+// FlowDirection counts the packets sent in one direction of a flow.
+type FlowDirection = tlapi.FlowDirection
+
+// Summary returns a breakdown, by flow, of the captures which would be written by WritePcapng: the
+// packets and bytes sent each way, TCP flag counts, retransmissions, the handshake RTT and, where
+// the ClientHello was captured, the TLS server name and client fingerprint. This is intended for
+// triage, before the captures themselves are inspected.
+func (p *TrafficLogProcess) Summary() (*Summary, error) {
+	return p.summary(false)
+}
+
+// AnonymizedSummary behaves like Summary, but summarizes the captures which would be written by
+// WriteAnonymizedPcapng.
+func (p *TrafficLogProcess) AnonymizedSummary() (*Summary, error) {
+	return p.summary(true)
+}
+
+func (p *TrafficLogProcess) summary(anonymize bool) (*Summary, error) {
+	summary := new(Summary)
+	path := fmt.Sprintf("%s?%s=%t", tlapi.PathSummary, tlapi.QueryAnonymize, anonymize)
+	if err := p.do(http.MethodGet, path, nil, summary); err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// Filter is a named BPF filter expression. Packets matching the filter are captured in addition to
+// those captured for the addresses passed to UpdateAddresses.
+type Filter = tlapi.Filter
+
+// FilterStats counts the packets captured by a filter.
+type FilterStats = tlapi.FilterStats
+
+// UpdateFilters replaces the set of filters applied by the traffic log process. Each filter is
+// validated before any are applied; if any filter is invalid, an error is returned and the existing
+// filters remain in place. Filters which are unchanged continue capturing uninterrupted.
+//
+// Packets captured by each filter are kept separately from those captured for the traffic log's
+// addresses. The most recent are included in every export, on an interface of their own. Packet
+// counts for each filter are available from LatestFilterStats and Status.
+//
+// Filters cannot be started by a process which has dropped its privileges (see
+// Options.DropPrivileges).
+func (p *TrafficLogProcess) UpdateFilters(filters []Filter) error {
+	if err := tlapi.ValidateFilters(filters); err != nil {
+		return err
+	}
+	return p.do(http.MethodPut, tlapi.PathFilters, tlapi.FilterUpdate{Filters: filters}, nil)
+}
+
+// LatestFilterStats returns the packet counts for each filter, as of the most recent stats update.
+func (p *TrafficLogProcess) LatestFilterStats() map[string]FilterStats {
+	return p.recent.latestFilterStats()
+}
+
+// Annotate records an event observed by the caller, such as a dial failure, a proxy switch or a
+// timeout, so that it can be read together with the captures. The address, in the form host:port,
+// is optional. Annotations are written into exported captures as section comments. Additionally,
+// each is attached as a comment to the first packet captured at or after its time, to or from its
+// address. Only the most recent annotations are kept.
+//
+// Annotation messages are exported as they are, even by WriteAnonymizedPcapng.
+func (p *TrafficLogProcess) Annotate(addr string, t time.Time, message string) error {
+	ann := tlapi.Annotation{Address: addr, Time: t, Message: message}
+	if err := ann.Validate(); err != nil {
+		return err
+	}
+	return p.do(http.MethodPost, tlapi.PathAnnotations, ann, nil)
+}
+
+// SaveCapturesWindow saves the packets captured between start and end, to or from any of the
+// addresses. Unlike SaveCaptures, this can be called after the fact, once the times of a failure
+// are known, so long as the packets remain in the capture buffer. Packets captured after the call
+// cannot be saved. The label, such as an issue ID or a failure type, is optional; it is recorded in
+// exported captures against the window and each packet within it.
+//
+// The traffic log can only save the packets captured from some time up to the present. Everything
+// captured for the addresses from the start of the window until the call is therefore copied into
+// the save buffer, though only the window is exported, and may evict earlier saves. The save is
+// refused with an error if the packets captured since end would fill more than half of the save
+// buffer; windows should be saved promptly.
+//
+// Packets already saved by an earlier, overlapping save are not stored again. Exported captures
+// contain each saved packet once and only the packets within saved windows.
+func (p *TrafficLogProcess) SaveCapturesWindow(addresses []string, start, end time.Time, label string) error {
+	sw := tlapi.SaveWindow{Addresses: addresses, Start: start, End: end, Label: label}
+	if err := sw.Validate(); err != nil {
+		return err
+	}
+	return p.do(http.MethodPost, tlapi.PathSaveWindow, sw, nil)
+}
+
+// Reconfiguration holds the settings which may be changed by Reconfigure. Zero values leave the
+// corresponding setting unchanged.
+type Reconfiguration struct {
+	// StatsInterval is as in Options. Intervals below trafficlog.MinimumStatsInterval are raised to
+	// the minimum.
+	StatsInterval time.Duration
+
+	// Mutator, MutatorParams and MutatorFactory are as in Options. MutatorParams is ignored unless
+	// Mutator is set.
+	Mutator        string
+	MutatorParams  map[string]string
+	MutatorFactory trafficlog.MutatorFactory
+}
+
+func (r Reconfiguration) request() (tlapi.Reconfiguration, error) {
+	req := tlapi.Reconfiguration{StatsInterval: tlapi.Duration(r.StatsInterval)}
+	if r.StatsInterval < 0 {
+		return req, errors.New("stats interval must not be negative")
+	}
+	switch {
+	case r.Mutator != "":
+		if _, err := mutators.New(r.Mutator, r.MutatorParams); err != nil {
+			return req, fmt.Errorf("bad mutator: %w", err)
+		}
+		req.Mutator, req.MutatorParams = r.Mutator, r.MutatorParams
+	case r.MutatorFactory != nil:
+		name, err := mutatorName(r.MutatorFactory)
+		if err != nil {
+			return req, fmt.Errorf("bad mutator: %w", err)
+		}
+		req.Mutator = name
+	}
+	return req, nil
+}
+
+// Reconfigure applies the settings set in r to the running traffic log process; other settings are
+// left as they are. Packets captured before the mutator is changed retain the mutations applied
+// when they were captured. The mutator applied to each packet is recorded as a packet comment in
+// saved captures.
+func (p *TrafficLogProcess) Reconfigure(r Reconfiguration) error {
+	req, err := r.request()
+	if err != nil {
+		return err
+	}
+	return p.do(http.MethodPut, tlapi.PathReconfigure, req, nil)
+}
+
+// Makes a request to one of the tlserver endpoints which are not covered by tlhttp.Client. This
+// behaves like the request logic in tlhttp.Client.
+func (p *TrafficLogProcess) do(method, path string, reqBody, respBody interface{}) error {
+	resp, err := p.request(method, path, reqBody)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if respBody != nil {
+		if err := json.NewDecoder(resp.Body).Decode(respBody); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+	}
+	return nil
+}
+
+// Sends the request, returning an error for any non-2xx response. Callers must close the body of
+// the returned response.
+func (p *TrafficLogProcess) request(method, path string, reqBody interface{}) (*http.Response, error) {
+	bodyReader := io.ReadWriter(nil)
+	if reqBody != nil {
+		bodyReader = new(bytes.Buffer)
+		if err := json.NewEncoder(bodyReader).Encode(reqBody); err != nil {
+			return nil, fmt.Errorf("failed to encode body: %w", err)
+		}
+	}
+	scheme := p.Scheme
+	if scheme == "" {
+		scheme = tlhttp.DefaultScheme
+	}
+	fullURL := fmt.Sprintf("%s://%s:%s", scheme, p.ServerAddress, path)
+	req, err := http.NewRequest(method, fullURL, bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		er := new(tlapi.ErrorResponse)
+		if err := json.NewDecoder(resp.Body).Decode(er); err != nil {
+			return nil, fmt.Errorf("got error status '%v', but failed to decode: %w", resp.Status, err)
+		}
+		return nil, errors.New(er.ErrorMsg)
+	}
+	return resp, nil
+}
+
+// AuditEntry is a single record in the traffic log process's audit log.
+type AuditEntry = tlapi.AuditEntry
+
+// ReadAuditLog reads the audit log kept by traffic log processes started from the input
+// installation directory. Every request made of the process is recorded, along with any failed
+// connection attempts. Entries are returned oldest first. The log is bounded in size, so older
+// entries are eventually discarded.
+func ReadAuditLog(installDir string) ([]AuditEntry, error) {
+	return tlapi.ReadAuditLog(installDir)
+}
@@ -0,0 +1,25 @@
+package tlproc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/trafficlog"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+func TestReconfigurationRequest(t *testing.T) {
+	// Settings which are not set must not be sent, so that they are left unchanged.
+	req, err := Reconfiguration{StatsInterval: time.Minute}.request()
+	require.NoError(t, err)
+	require.Equal(t, tlapi.Reconfiguration{StatsInterval: tlapi.Duration(time.Minute)}, req)
+
+	req, err = Reconfiguration{MutatorFactory: new(trafficlog.AppStripperFactory)}.request()
+	require.NoError(t, err)
+	require.Equal(t, tlapi.Reconfiguration{Mutator: MutatorStripAppLayer}, req)
+
+	_, err = Reconfiguration{Mutator: "unknown"}.request()
+	require.Error(t, err)
+}
@@ -12,7 +12,9 @@ import (
 
 	"github.com/getlantern/byteexec"
 	"github.com/getlantern/elevate"
+	"github.com/getlantern/trafficlog-flashlight/internal/chmodbpf"
 	"github.com/getlantern/trafficlog-flashlight/internal/exitcodes"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
 	"github.com/getlantern/trafficlog-flashlight/internal/tlinstall"
 	"github.com/getlantern/trafficlog-flashlight/internal/tlserverbin"
 )
@@ -84,10 +86,24 @@ type InstallOptions struct {
 	//
 	// To be more specific, on macOS, the config-bpf global daemon checks for the existence of this
 	// file on each run (at system start). If config-bpf does not find the sentinel file, config-bpf
-	// will delete itself and its launchd plist file.
+	// will restore the BPF devices to their original owner, group and mode, then delete itself and
+	// its launchd plist file.
 	//
 	// Defaults to the path to the current program (os.Executable).
 	UninstallSentinel string
+
+	// ReportBPFConflicts governs behavior when another utility, such as Wireshark's ChmodBPF, is
+	// found assigning the BPF devices to a different group. By default, the installer adopts the
+	// other utility's group for the traffic log server. If ReportBPFConflicts is true, the conflict
+	// is instead reported in the installer output and devices in the other group are left alone.
+	ReportBPFConflicts bool
+}
+
+func (opts InstallOptions) conflictPolicy() chmodbpf.Policy {
+	if opts.ReportBPFConflicts {
+		return chmodbpf.Report
+	}
+	return chmodbpf.Adopt
 }
 
 func (opts InstallOptions) uninstallSentinel() (string, error) {
@@ -101,9 +117,13 @@ func (opts InstallOptions) uninstallSentinel() (string, error) {
 	return ex, nil
 }
 
-// Install the traffic log server. This package is currently macOS only; calls to Install on other
+// Install the traffic log server. This is only supported on macOS; calls to Install on other
 // platforms will result in an error. The install directory will be created if necessary.
 //
+// Binaries are only embedded in this package for macOS. On Linux, tlserver and config-bpf are
+// instead installed by running tlconfig directly, as root, for example from a package's install
+// script; see the tlconfig command. New may then be called with the install directory.
+//
 // This function first checks to see if the server binary is already installed in the given
 // directory and if the necessary system changes have already been made. If installation or any
 // system changes are necessary, the prompt and icon will be used to ask the user for elevated
@@ -139,31 +159,10 @@ func Install(dir, user, prompt, iconPath string, opts *InstallOptions) error {
 		return fmt.Errorf("failed to create temporary directory: %w", err)
 	}
 	defer os.RemoveAll(resourcesPath)
-	resources, err := tlinstall.NewResourcesDir(resourcesPath)
-	if err != nil {
-		return fmt.Errorf("failed to create reference to resources directory: %w", err)
-	}
-
-	tlserverBinary, err := tlserverbin.Asset("tlserver")
-	if err != nil {
-		return fmt.Errorf("failed to load tlserver binary: %w", err)
-	}
-	if err := ioutil.WriteFile(resources.Tlserver(), tlserverBinary, 0744); err != nil {
-		return fmt.Errorf("failed to write tlserver binary to resources directory: %w", err)
-	}
-	configBPFBinary, err := tlserverbin.Asset("config-bpf")
-	if err != nil {
-		return fmt.Errorf("failed to load config-bpf binary: %w", err)
-	}
-	if err := ioutil.WriteFile(resources.ConfigBPF(), configBPFBinary, 0744); err != nil {
-		return fmt.Errorf("failed to write config-bpf binary to resources directory: %w", err)
-	}
-
-	tlconfig, err := loadTlconfig(resourcesPath)
+	tlconfig, err := prepareTlconfig(resourcesPath, dir, user, uninstallSentinel, opts)
 	if err != nil {
-		return fmt.Errorf("failed to load tlconfig: %w", err)
+		return err
 	}
-	tlconfig.setArgs(dir, resourcesPath, uninstallSentinel, user)
 
 	// Check existing system configuration.
 	var (
@@ -235,6 +234,108 @@ func Install(dir, user, prompt, iconPath string, opts *InstallOptions) error {
 	return nil
 }
 
+// Writes the binaries to be installed to the resources directory and prepares tlconfig to install
+// them.
+func prepareTlconfig(resourcesPath, dir, user, uninstallSentinel string, opts *InstallOptions) (*tlconfigExec, error) {
+	resources, err := tlinstall.NewResourcesDir(resourcesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create reference to resources directory: %w", err)
+	}
+
+	tlserverBinary, err := tlserverbin.Asset("tlserver")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tlserver binary: %w", err)
+	}
+	if err := ioutil.WriteFile(resources.Tlserver(), tlserverBinary, 0744); err != nil {
+		return nil, fmt.Errorf("failed to write tlserver binary to resources directory: %w", err)
+	}
+	configBPFBinary, err := tlserverbin.Asset("config-bpf")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config-bpf binary: %w", err)
+	}
+	if err := ioutil.WriteFile(resources.ConfigBPF(), configBPFBinary, 0744); err != nil {
+		return nil, fmt.Errorf("failed to write config-bpf binary to resources directory: %w", err)
+	}
+
+	tlconfig, err := loadTlconfig(resourcesPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tlconfig: %w", err)
+	}
+	tlconfig.setArgs("-on-conflict", string(opts.conflictPolicy()), dir, resourcesPath, uninstallSentinel, user)
+	return tlconfig, nil
+}
+
+// Privileges describes the group privileges held by a traffic log process.
+type Privileges = tlapi.Privileges
+
+// InstallCheck is the result of CheckInstall.
+type InstallCheck struct {
+	// Installed is true if the traffic log server is installed and no system changes are necessary.
+	Installed bool
+
+	// Outdated is true if the installed binaries differ from those embedded in this package.
+	Outdated bool
+
+	// Output of the installation check. This describes any problems found.
+	Output string
+
+	// Privileges held by the traffic log process passed to CheckInstall, if any. If the process was
+	// started with Options.DropPrivileges, Privileges.Dropped will be true, unless dropping them was
+	// not possible, in which case Privileges.NotDropped says why.
+	Privileges *Privileges
+}
+
+// CheckInstall checks the installation of the traffic log server without making any changes or
+// prompting the user. As with Install, this is only supported on macOS. The parameters should
+// match those provided to Install. If p is not nil, the
+// privileges held by the running traffic log process are also reported.
+func CheckInstall(dir, user string, opts *InstallOptions, p *TrafficLogProcess) (*InstallCheck, error) {
+	if runtime.GOOS != "darwin" {
+		return nil, errors.New("unsupported platform")
+	}
+	if opts == nil {
+		opts = &InstallOptions{}
+	}
+	uninstallSentinel, err := opts.uninstallSentinel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get uninstall sentinel: %w", err)
+	}
+	resourcesPath, err := ioutil.TempDir("", "lantern-tmp-resources")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(resourcesPath)
+	tlconfig, err := prepareTlconfig(resourcesPath, dir, user, uninstallSentinel, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var exitErr *exec.ExitError
+	output, err := tlconfig.run("-test")
+	check := &InstallCheck{Output: string(bytes.TrimSpace(output))}
+	switch {
+	case err == nil:
+		check.Installed = true
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == exitcodes.Outdated:
+		check.Outdated = true
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == exitcodes.FailedCheck:
+	default:
+		if len(output) > 0 {
+			err = fmt.Errorf("%w: %s", err, string(lastLine(output)))
+		}
+		return nil, fmt.Errorf("failed to run tlconfig -test: %w", err)
+	}
+
+	if p != nil {
+		status, err := p.Status()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get process status: %w", err)
+		}
+		check.Privileges = &status.Privileges
+	}
+	return check, nil
+}
+
 func isPermissionError(elevateErr error) bool {
 	if runtime.GOOS != "darwin" {
 		log.Debugf("unable to decode elevate errors on %s", runtime.GOOS)
@@ -0,0 +1,116 @@
+package tlproc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Sockets are created in a private runtime directory. On Linux, this is a subdirectory of
+	// XDG_RUNTIME_DIR if set. Otherwise, it is a subdirectory of the install directory.
+	runtimeDirName    = "run"
+	xdgRuntimeDirName = "trafficlog-flashlight"
+
+	socketSuffix = ".sock"
+
+	// Unix socket paths are limited to 104 bytes (including the terminator) on macOS, 108 on Linux.
+	maxSocketPathLen = 103
+)
+
+// Returns the private runtime directory in which sockets are created, creating it if necessary.
+// The directory must be owned by the current user and accessible only by that user.
+func runtimeDir(installDir string) (string, error) {
+	dir := filepath.Join(installDir, runtimeDirName)
+	if xdg := os.Getenv("XDG_RUNTIME_DIR"); xdg != "" && runtime.GOOS == "linux" {
+		dir = filepath.Join(xdg, xdgRuntimeDirName)
+	}
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", fmt.Errorf("failed to create runtime directory: %w", err)
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat runtime directory: %w", err)
+	}
+	statT, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", errors.New("failed to obtain detailed stat info for runtime directory")
+	}
+	if !info.IsDir() || int(statT.Uid) != os.Getuid() {
+		return "", fmt.Errorf("%s is not a directory owned by the current user", dir)
+	}
+	if info.Mode().Perm() != 0700 {
+		if err := os.Chmod(dir, 0700); err != nil {
+			return "", fmt.Errorf("failed to restrict permissions on runtime directory: %w", err)
+		}
+	}
+	return dir, nil
+}
+
+// Returns a new, unused socket address. Socket files are named for the current process so that
+// stale sockets can be identified. If abstract is true (Linux only), the address is in the
+// abstract namespace and no file is created.
+func newSocketFile(installDir string, abstract bool) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate socket name: %w", err)
+	}
+	name := fmt.Sprintf("%d-%s%s", os.Getpid(), hex.EncodeToString(b), socketSuffix)
+	if abstract && runtime.GOOS == "linux" {
+		return "@trafficlog-flashlight-" + name, nil
+	}
+
+	dir, err := runtimeDir(installDir)
+	if err != nil {
+		return "", err
+	}
+	removeStaleSockets(dir)
+	path := filepath.Join(dir, name)
+	if len(path) > maxSocketPathLen {
+		return "", fmt.Errorf("socket path %s exceeds maximum length of %d", path, maxSocketPathLen)
+	}
+	return path, nil
+}
+
+// Removes sockets left behind by processes which are no longer running. Errors are logged.
+func removeStaleSockets(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Debugf("failed to read runtime directory: %v", err)
+		return
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), socketSuffix) {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.SplitN(f.Name(), "-", 2)[0])
+		if err != nil || processAlive(pid) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+			log.Debugf("failed to remove stale socket: %v", err)
+		}
+	}
+}
+
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) != syscall.ESRCH
+}
+
+// Removes the socket file, if there is one.
+func removeSocket(socket string) {
+	if strings.HasPrefix(socket, "@") {
+		return
+	}
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		log.Debugf("failed to remove socket: %v", err)
+	}
+}
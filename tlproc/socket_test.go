@@ -0,0 +1,42 @@
+package tlproc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSocketFile(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	installDir, err := ioutil.TempDir("", "tlproc-socket-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(installDir)
+
+	// Create a socket file belonging to a process which has exited.
+	cmd := exec.Command("true")
+	require.NoError(t, cmd.Run())
+	dir, err := runtimeDir(installDir)
+	require.NoError(t, err)
+	stale := filepath.Join(dir, fmt.Sprintf("%d-0123456789abcdef.sock", cmd.Process.Pid))
+	require.NoError(t, ioutil.WriteFile(stale, nil, 0600))
+	ours := filepath.Join(dir, fmt.Sprintf("%d-0123456789abcdef.sock", os.Getpid()))
+	require.NoError(t, ioutil.WriteFile(ours, nil, 0600))
+
+	socket, err := newSocketFile(installDir, false)
+	require.NoError(t, err)
+	require.Equal(t, dir, filepath.Dir(socket))
+
+	info, err := os.Stat(dir)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	_, err = os.Stat(stale)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(ours)
+	require.NoError(t, err)
+}
@@ -5,6 +5,9 @@
 // Specifically, the certificate's subject common name must match that of the Innovate Labs
 // Developer ID Application certificate. Further, the certificate must be issued by Apple. Build
 // with the tag 'debug' to create traffic log processes which skip peer verification.
+//
+// On Linux, Install and CheckInstall are unsupported, but traffic log processes may be started with
+// New once tlserver has been installed by running tlconfig directly. See Install.
 package tlproc
 
 import (
@@ -21,7 +24,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,6 +31,8 @@ import (
 	"github.com/getlantern/byteexec"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/trafficlog"
+	"github.com/getlantern/trafficlog-flashlight/internal/mutators"
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
 	"github.com/getlantern/trafficlog/tlhttp"
 )
 
@@ -58,8 +62,80 @@ type Options struct {
 	// RequestTimeout is applied to every request made of the traffic log process. If unspecified,
 	// DefaultRequestTimeout will be used.
 	RequestTimeout time.Duration
+
+	// Mutator names a mutator compiled into the traffic log process. See the Mutator* constants. If
+	// set, this takes precedence over MutatorFactory, which may otherwise only be a
+	// trafficlog.AppStripperFactory or trafficlog.NoOpFactory.
+	Mutator string
+
+	// MutatorParams configure the mutator named by Mutator.
+	MutatorParams map[string]string
+
+	// IdleTimeout, if set, causes the traffic log process to exit if no requests are made of it for
+	// this long. Regardless of this setting, the process exits if the current process does.
+	IdleTimeout time.Duration
+
+	// AbstractSocket specifies the use of an abstract-namespace socket, rather than a socket file,
+	// for communication with the traffic log process. Abstract sockets leave nothing on disk, but
+	// are visible to all processes on the machine; peers are still authenticated. This is only
+	// supported on Linux and is otherwise ignored.
+	AbstractSocket bool
+
+	// Addresses, if set, are captured from start-up, as if passed to UpdateAddresses. Capture
+	// handles for these addresses are opened before the traffic log process begins serving requests.
+	Addresses []string
+
+	// DropPrivileges causes the traffic log process to give up its group privileges once capture has
+	// begun for Addresses, which must be set. A compromised process is then unable to open new
+	// capture devices, but neither can the process itself: capture cannot start for addresses added
+	// by later calls to UpdateAddresses, nor resume for addresses which are removed or whose route
+	// changes. The drop is verified and reported by CheckInstall and Status; New fails if it cannot
+	// be verified. If the user is a member of the privileged group, as users of Wireshark are once
+	// the traffic log has adopted its group, dropping privileges is not possible: New succeeds and
+	// Privileges.NotDropped says why. DropPrivileges is not supported on Linux, where New fails.
+	DropPrivileges bool
+
+	// CompressSaves causes the traffic log process to hold saved packets compressed, so that the
+	// save buffer retains more of them. The save buffer size then bounds the compressed size. Saved
+	// packets are staged uncompressed, so the process may use up to twice the save buffer size for
+	// saves. Sizes, including the total memory used, are reported in StatsRecord.SaveBuffer and
+	// Status.
+	CompressSaves bool
+
+	// PersistBytes, if positive, causes saved packets to be written to disk as they are saved, so
+	// that they survive if either process is killed. Files are written under the install directory,
+	// accessible only to the current user, and are capped at this many bytes in total. Packets
+	// persisted by previous traffic log processes are included by WritePcapng and
+	// WriteAnonymizedPcapng, in sections of their own, until they expire after PersistTTL.
+	PersistBytes int
+
+	// PersistTTL is the age at which persisted packets are deleted. If unspecified,
+	// DefaultPersistTTL is used.
+	PersistTTL time.Duration
 }
 
+// DefaultPersistTTL is the default for Options.PersistTTL.
+const DefaultPersistTTL = tlapi.DefaultPersistTTL
+
+// Names of the mutators which may be specified in Options.Mutator.
+const (
+	// MutatorNone performs no mutations.
+	MutatorNone = mutators.None
+
+	// MutatorStripAppLayer strips all application-layer data.
+	MutatorStripAppLayer = mutators.StripAppLayer
+
+	// MutatorTLSHandshakeOnly retains TLS handshake records, but strips all other application-layer
+	// data.
+	MutatorTLSHandshakeOnly = mutators.TLSHandshakeOnly
+
+	// MutatorTruncate truncates each packet to a length specified by MutatorParamBytes.
+	MutatorTruncate = mutators.Truncate
+)
+
+// MutatorParamBytes is the parameter used to specify the packet length for MutatorTruncate.
+const MutatorParamBytes = mutators.ParamBytes
+
 func (opts Options) startTimeout() time.Duration {
 	if opts.StartTimeout == 0 {
 		return time.Duration(math.MaxInt64)
@@ -74,11 +150,20 @@ func (opts Options) requestTimeout() time.Duration {
 	return opts.RequestTimeout
 }
 
-func (opts Options) mutatorFactory() trafficlog.MutatorFactory {
+// Returns the name and parameters of the mutator to be used by the traffic log process.
+func (opts Options) mutator() (string, map[string]string, error) {
+	if opts.Mutator != "" {
+		// Validate here so that bad options are caught before the process is started.
+		if _, err := mutators.New(opts.Mutator, opts.MutatorParams); err != nil {
+			return "", nil, err
+		}
+		return opts.Mutator, opts.MutatorParams, nil
+	}
 	if opts.MutatorFactory == nil {
-		return new(trafficlog.NoOpFactory)
+		return MutatorNone, nil, nil
 	}
-	return opts.MutatorFactory
+	name, err := mutatorName(opts.MutatorFactory)
+	return name, nil, err
 }
 
 func (opts Options) statsInterval() time.Duration {
@@ -96,10 +181,14 @@ type TrafficLogProcess struct {
 	tlhttp.Client
 
 	proc     *os.Process
+	socket   string
 	errC     chan error
 	statsC   chan trafficlog.CaptureStats
 	closed   chan struct{}
 	closedMx sync.Mutex
+	recent   *recent
+	triggers *triggers
+	triggerC chan TriggerEvent
 }
 
 // New traffic log process. The current process must be running code signed by Lantern (see the
@@ -123,25 +212,25 @@ func New(captureBytes, saveBytes int, installDir string, opts *Options) (*Traffi
 	if err != nil {
 		return nil, fmt.Errorf("failed to create executable: %w", err)
 	}
-	stripAppLayer, err := shouldStripAppLayer(opts.mutatorFactory())
+	mutator, mutatorParams, err := opts.mutator()
 	if err != nil {
 		return nil, err
 	}
-	socket, err := newSocketFile()
+	socket, err := newSocketFile(installDir, opts.AbstractSocket)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create Unix socket file: %w", err)
 	}
 
-	cmd := tlserver.Command(
-		"-socket-file", socket,
-		"-capture-bytes", strconv.Itoa(captureBytes),
-		"-save-bytes", strconv.Itoa(saveBytes),
-		"-stats-interval", opts.statsInterval().String(),
-		"-error-prefix", errorPrefix,
-		"-stats-prefix", statsPrefix,
-		fmt.Sprintf("-strip-app-layer=%t", stripAppLayer),
-	)
+	cmd := tlserver.Command()
 	client := newClient(socket, opts.requestTimeout())
+	cmdStdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to process stdin: %w", err)
+	}
+	cmdStdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to process stdout: %w", err)
+	}
 	cmdStderr, err := cmd.StderrPipe()
 	if err != nil {
 		return nil, fmt.Errorf("failed to attach to process stderr: %w", err)
@@ -150,15 +239,44 @@ func New(captureBytes, saveBytes int, installDir string, opts *Options) (*Traffi
 		return nil, fmt.Errorf("failed to start traffic log process: %w", err)
 	}
 
+	// The process is configured via stdin. See the tlserver command doc.
+	cfg := tlapi.Config{
+		Version:        tlapi.ConfigVersion,
+		SocketFile:     socket,
+		CaptureBytes:   captureBytes,
+		SaveBytes:      saveBytes,
+		StatsInterval:  tlapi.Duration(opts.statsInterval()),
+		Mutator:        mutator,
+		MutatorParams:  mutatorParams,
+		ErrorPrefix:    errorPrefix,
+		StatsPrefix:    statsPrefix,
+		ParentPID:      os.Getpid(),
+		IdleTimeout:    tlapi.Duration(opts.IdleTimeout),
+		Addresses:      opts.Addresses,
+		DropPrivileges: opts.DropPrivileges,
+		CompressSaves:  opts.CompressSaves,
+		PersistBytes:   opts.PersistBytes,
+		PersistTTL:     tlapi.Duration(opts.PersistTTL),
+	}
+	if err := tlapi.WriteConfig(cmdStdin, cfg); err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+	cmdStdin.Close()
+
 	var (
 		errC         = make(chan error, channelBufferSize)
 		statsC       = make(chan trafficlog.CaptureStats, channelBufferSize)
+		triggerC     = make(chan TriggerEvent, channelBufferSize)
 		serverUp     = make(chan struct{})
 		closed       = make(chan struct{})
 		stderrBuf    = new(syncBuf)
 		stderrCopier = newCopier(cmdStderr, stderrBuf)
-		p            = TrafficLogProcess{client, cmd.Process, errC, statsC, closed, sync.Mutex{}}
+		p            = TrafficLogProcess{
+			client, cmd.Process, socket, errC, statsC, closed, sync.Mutex{}, new(recent), nil, triggerC,
+		}
 	)
+	p.triggers = newTriggers(p.SaveCapturesWindow, p.currentAddresses, p.sendTrigger)
 	go func() {
 		err := cmd.Wait()
 		if err == nil {
@@ -171,6 +289,20 @@ func New(captureBytes, saveBytes int, installDir string, opts *Options) (*Traffi
 			p.sendError(fmt.Errorf("error reading stderr: %w", err))
 		}
 	}()
+	go func() {
+		stdout := bufio.NewReader(cmdStdout)
+		resp, err := tlapi.ReadConfigResponse(stdout)
+		switch {
+		case err != nil:
+			p.sendError(fmt.Errorf("failed to read config response: %w", err))
+		case !resp.Accepted && len(resp.UnknownFields) > 0:
+			p.sendError(fmt.Errorf("config rejected: %s: %s", resp.Error, strings.Join(resp.UnknownFields, ", ")))
+		case !resp.Accepted:
+			p.sendError(fmt.Errorf("config rejected: %s", resp.Error))
+		}
+		// Nothing else on stdout is of interest, but we must keep reading or the process may block.
+		io.Copy(ioutil.Discard, stdout)
+	}()
 	go func() {
 		for {
 			time.Sleep(pollWaitTime)
@@ -184,10 +316,12 @@ func New(captureBytes, saveBytes int, installDir string, opts *Options) (*Traffi
 	select {
 	case err := <-errC:
 		cmd.Process.Kill()
+		removeSocket(socket)
 		stderrCopier.stop()
 		return nil, fmt.Errorf("error starting process: %w; stderr: %s", err, stderrBuf.String())
 	case <-time.After(opts.startTimeout()):
 		cmd.Process.Kill()
+		removeSocket(socket)
 		stderrCopier.stop()
 		return nil, fmt.Errorf("timed out waiting for process to start; stderr: %s", stderrBuf.String())
 	case <-serverUp:
@@ -215,12 +349,16 @@ func (p *TrafficLogProcess) Close() error {
 	defer p.closedMx.Unlock()
 	select {
 	case <-p.closed:
+		return nil
+	default:
 		close(p.closed)
 		close(p.errC)
 		close(p.statsC)
-		return p.proc.Kill()
-	default:
-		return nil
+		close(p.triggerC)
+		err := p.proc.Kill()
+		// The process cannot clean up after itself when killed.
+		removeSocket(p.socket)
+		return err
 	}
 }
 
@@ -228,17 +366,19 @@ func (p *TrafficLogProcess) watchStderr(stderr io.Reader) {
 	scanner := bufio.NewScanner(stderr)
 	for scanner.Scan() {
 		line := scanner.Text()
+		p.recent.addStderr(line)
 		switch {
 		case strings.HasPrefix(line, errorPrefix):
 			p.sendError(errors.New(strings.TrimPrefix(line, errorPrefix)))
 		case strings.HasPrefix(line, statsPrefix):
 			line = strings.TrimPrefix(line, statsPrefix)
-			stats := new(trafficlog.CaptureStats)
+			stats := new(tlapi.Stats)
 			if err := json.Unmarshal([]byte(line), stats); err != nil {
 				p.sendError(fmt.Errorf("failed to unmarshal stats: %w", err))
 				continue
 			}
-			p.sendStats(*stats)
+			p.triggers.stats(p.recent.addStats(*stats))
+			p.sendStats(trafficlog.CaptureStats{Received: stats.Received, Dropped: stats.Dropped})
 		default:
 			// Other messages are sometimes printed, but we don't care about these.
 		}
@@ -271,26 +411,17 @@ func (p *TrafficLogProcess) sendStats(stats trafficlog.CaptureStats) {
 	}
 }
 
-func shouldStripAppLayer(mutator trafficlog.MutatorFactory) (bool, error) {
+// Maps the factory to the name of the corresponding mutator in tlserver.
+func mutatorName(mutator trafficlog.MutatorFactory) (string, error) {
 	switch mutator.(type) {
 	case trafficlog.AppStripperFactory, *trafficlog.AppStripperFactory:
-		return true, nil
+		return MutatorStripAppLayer, nil
 	case trafficlog.NoOpFactory, *trafficlog.NoOpFactory:
-		return false, nil
+		return MutatorNone, nil
 	default:
-		return false, errors.New(
-			"only trafficlog.AppStripperFactory or trafficlog.NoOpFactory are allowed")
-	}
-}
-
-func newSocketFile() (string, error) {
-	f, err := ioutil.TempFile("", "tlproc-*.sock")
-	if err != nil {
-		return "", fmt.Errorf("failed to create temp file: %w", err)
+		return "", errors.New(
+			"only trafficlog.AppStripperFactory or trafficlog.NoOpFactory are allowed; use Options.Mutator for other mutators")
 	}
-	f.Close()
-	os.Remove(f.Name())
-	return f.Name(), nil
 }
 
 func newClient(socketFile string, timeout time.Duration) tlhttp.Client {
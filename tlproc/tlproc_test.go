@@ -3,10 +3,13 @@
 package tlproc
 
 import (
+	"bytes"
+	"context"
 	"os"
 	"os/user"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/getlantern/trafficlog/tltest"
 	"github.com/stretchr/testify/require"
@@ -36,5 +39,43 @@ func TestTrafficLogProcess(t *testing.T) {
 
 	tl, err := New(captureBufferSize, saveBufferSize, path, nil)
 	require.NoError(t, err)
+
+	status, err := tl.Status()
+	require.NoError(t, err)
+	require.True(t, status.DebugBuild)
+	require.Equal(t, captureBufferSize, status.CaptureBytes)
+	require.Equal(t, saveBufferSize, status.SaveBytes)
+
+	metrics := new(bytes.Buffer)
+	require.NoError(t, tl.WriteMetrics(metrics))
+	require.Contains(t, metrics.String(), "tlserver_packets_received_total")
+
+	require.NoError(t, tl.Reconfigure(Reconfiguration{Mutator: MutatorStripAppLayer}))
+	require.NoError(t, tl.Reconfigure(Reconfiguration{StatsInterval: 2 * time.Second}))
+	status, err = tl.Status()
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, time.Duration(status.StatsInterval))
+	require.Equal(t, MutatorStripAppLayer, status.Mutator)
+	// The mutator applies to open handles, and TestTrafficLog checks for application-layer data.
+	require.NoError(t, tl.Reconfigure(Reconfiguration{Mutator: MutatorNone}))
+
+	require.NoError(t, tl.UpdateFilters([]Filter{{Name: "dns", Expression: "udp port 53"}}))
+	require.Error(t, tl.UpdateFilters([]Filter{{Name: "bad", Expression: "not a filter"}}))
+	status, err = tl.Status()
+	require.NoError(t, err)
+	require.Len(t, status.Filters, 1)
+	require.Equal(t, "dns", status.Filters[0].Name)
+	require.NoError(t, tl.UpdateFilters(nil))
+
+	require.NoError(t, tl.Annotate("127.0.0.1:443", time.Now(), "dial failed"))
+	require.Error(t, tl.Annotate("", time.Time{}, "no time"))
+
+	require.NoError(t, tl.SaveCapturesWindow([]string{"127.0.0.1:443"}, time.Now().Add(-time.Minute), time.Now(), "issue-1"))
+	require.Error(t, tl.SaveCapturesWindow([]string{"127.0.0.1:443"}, time.Now(), time.Now().Add(-time.Minute), ""))
+
+	bundle := new(bytes.Buffer)
+	require.NoError(t, tl.ExportBundle(context.Background(), bundle, &BundleOptions{InstallDir: path, User: u.Username}))
+	require.NotZero(t, bundle.Len())
+
 	tltest.TestTrafficLog(t, tl)
 }
@@ -0,0 +1,352 @@
+package tlproc
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/getlantern/trafficlog-flashlight/internal/tlapi"
+)
+
+// DefaultTriggerLookback is the default for the Lookback field of each Rule type.
+const DefaultTriggerLookback = 30 * time.Second
+
+// Bounds the dial errors remembered for each address.
+const maxDialErrorsPerAddress = 1000
+
+// A Rule describes a condition under which captures are saved automatically. See AddRule.
+type Rule interface {
+	ruleName() string
+	validate() error
+}
+
+// DialErrorRule fires when Count dial errors to a single address are reported, via
+// ReportDialError, within Period. Packets to and from the address are saved, beginning Lookback
+// before the first of these errors.
+type DialErrorRule struct {
+	Name   string
+	Count  int
+	Period time.Duration
+
+	// Lookback defaults to DefaultTriggerLookback.
+	Lookback time.Duration
+
+	// Cooldown is the minimum time between firings for a given address. Defaults to Period.
+	Cooldown time.Duration
+}
+
+func (r DialErrorRule) ruleName() string { return r.Name }
+
+func (r DialErrorRule) validate() error {
+	if r.Count < 1 {
+		return errors.New("count must be positive")
+	}
+	if r.Period <= 0 {
+		return errors.New("period must be positive")
+	}
+	if r.Lookback < 0 || r.Cooldown < 0 {
+		return errors.New("lookback and cooldown must not be negative")
+	}
+	return nil
+}
+
+func (r DialErrorRule) lookback() time.Duration { return lookbackOrDefault(r.Lookback) }
+
+func (r DialErrorRule) cooldown() time.Duration {
+	if r.Cooldown == 0 {
+		return r.Period
+	}
+	return r.Cooldown
+}
+
+// DropRateRule fires when the fraction of packets dropped by the traffic log, between consecutive
+// stats updates, exceeds Threshold. Updates covering fewer than MinPackets packets are ignored.
+// Packets to and from Addresses are saved, or if Addresses is empty, those to and from every
+// address captured at the time. The save begins Lookback before the earlier of the two updates.
+type DropRateRule struct {
+	Name       string
+	Threshold  float64
+	MinPackets uint64
+	Addresses  []string
+
+	// Lookback defaults to DefaultTriggerLookback.
+	Lookback time.Duration
+
+	// Cooldown is the minimum time between firings. Defaults to Lookback.
+	Cooldown time.Duration
+}
+
+func (r DropRateRule) ruleName() string { return r.Name }
+
+func (r DropRateRule) validate() error {
+	if r.Threshold < 0 || r.Threshold >= 1 {
+		return errors.New("threshold must be in [0, 1)")
+	}
+	if r.Lookback < 0 || r.Cooldown < 0 {
+		return errors.New("lookback and cooldown must not be negative")
+	}
+	return nil
+}
+
+func (r DropRateRule) lookback() time.Duration { return lookbackOrDefault(r.Lookback) }
+
+func (r DropRateRule) cooldown() time.Duration {
+	if r.Cooldown == 0 {
+		return r.lookback()
+	}
+	return r.Cooldown
+}
+
+func lookbackOrDefault(d time.Duration) time.Duration {
+	if d == 0 {
+		return DefaultTriggerLookback
+	}
+	return d
+}
+
+// TriggerEvent is sent on the channel returned by Triggers each time a rule fires.
+type TriggerEvent struct {
+	// Rule is the name of the rule which fired. This is also the label of the save.
+	Rule string
+
+	// Reason describes the condition which caused the rule to fire.
+	Reason string
+
+	// The saved window and the addresses for which packets were saved.
+	Addresses  []string
+	Start, End time.Time
+
+	// Err is non-nil if the save failed.
+	Err error
+}
+
+// AddRule registers a rule. When the rule fires, captures for the relevant addresses are saved over
+// a time window, as by SaveCapturesWindow, and an event is sent on the channel returned by
+// Triggers. Captures then exist for a failure even if the user only reports it later. Rule names
+// must be unique; a rule with the name of an existing rule replaces it.
+func (p *TrafficLogProcess) AddRule(r Rule) error {
+	return p.triggers.addRule(r)
+}
+
+// RemoveRule removes the rule with the input name, if any.
+func (p *TrafficLogProcess) RemoveRule(name string) {
+	p.triggers.removeRule(name)
+}
+
+// ReportDialError records a failed dial to the input address, in the form host:port, for
+// evaluation against any DialErrorRules. The error is not recorded in captures; see Annotate.
+func (p *TrafficLogProcess) ReportDialError(addr string) {
+	p.triggers.dialError(addr, time.Now())
+}
+
+// Triggers returns a channel on which an event is sent each time a rule fires. Events are dropped if
+// the channel is not read.
+func (p *TrafficLogProcess) Triggers() <-chan TriggerEvent {
+	return p.triggerC
+}
+
+func (p *TrafficLogProcess) sendTrigger(e TriggerEvent) {
+	p.closedMx.Lock()
+	defer p.closedMx.Unlock()
+	select {
+	case <-p.closed:
+	default:
+		select {
+		case p.triggerC <- e:
+		default:
+		}
+	}
+}
+
+// Returns the addresses currently captured by the traffic log process.
+func (p *TrafficLogProcess) currentAddresses() ([]string, error) {
+	status, err := p.Status()
+	if err != nil {
+		return nil, err
+	}
+	return status.Addresses, nil
+}
+
+// triggers evaluates rules against reported dial errors and stats updates.
+type triggers struct {
+	save      func(addresses []string, start, end time.Time, label string) error
+	addresses func() ([]string, error)
+	send      func(TriggerEvent)
+
+	mx         sync.Mutex
+	rules      map[string]Rule
+	dialErrors map[string][]time.Time
+
+	// The last firing of each rule, by address for dial error rules.
+	lastFired map[string]map[string]time.Time
+
+	lastStats     StatsRecord
+	haveLastStats bool
+}
+
+func newTriggers(
+	save func(addresses []string, start, end time.Time, label string) error,
+	addresses func() ([]string, error),
+	send func(TriggerEvent)) *triggers {
+
+	return &triggers{
+		save:       save,
+		addresses:  addresses,
+		send:       send,
+		rules:      map[string]Rule{},
+		dialErrors: map[string][]time.Time{},
+		lastFired:  map[string]map[string]time.Time{},
+	}
+}
+
+func (t *triggers) addRule(r Rule) error {
+	if r == nil {
+		return errors.New("nil rule")
+	}
+	if r.ruleName() == "" {
+		return errors.New("rules must be named")
+	}
+	if len(r.ruleName()) > tlapi.MaxSaveLabelLength {
+		return fmt.Errorf("rule names may be at most %d bytes", tlapi.MaxSaveLabelLength)
+	}
+	if err := r.validate(); err != nil {
+		return fmt.Errorf("bad rule '%s': %w", r.ruleName(), err)
+	}
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.rules[r.ruleName()] = r
+	delete(t.lastFired, r.ruleName())
+	return nil
+}
+
+func (t *triggers) removeRule(name string) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	delete(t.rules, name)
+	delete(t.lastFired, name)
+}
+
+// Rules sorted by name, so that they are evaluated in a consistent order.
+func (t *triggers) sortedRules() []Rule {
+	rules := []Rule{}
+	for _, r := range t.rules {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ruleName() < rules[j].ruleName() })
+	return rules
+}
+
+// Checks the cooldown of the rule for the key and, if it has passed, records a firing at now.
+func (t *triggers) tryFire(rule, key string, cooldown time.Duration, now time.Time) bool {
+	last, ok := t.lastFired[rule][key]
+	if ok && now.Sub(last) < cooldown {
+		return false
+	}
+	if t.lastFired[rule] == nil {
+		t.lastFired[rule] = map[string]time.Time{}
+	}
+	t.lastFired[rule][key] = now
+	return true
+}
+
+func (t *triggers) dialError(addr string, now time.Time) {
+	t.mx.Lock()
+	var (
+		events    = []TriggerEvent{}
+		maxPeriod time.Duration
+	)
+	for _, r := range t.rules {
+		if r, ok := r.(DialErrorRule); ok && r.Period > maxPeriod {
+			maxPeriod = r.Period
+		}
+	}
+	if maxPeriod == 0 {
+		t.mx.Unlock()
+		return
+	}
+	errs := append(t.dialErrors[addr], now)
+	for len(errs) > 0 && (now.Sub(errs[0]) > maxPeriod || len(errs) > maxDialErrorsPerAddress) {
+		errs = errs[1:]
+	}
+	t.dialErrors[addr] = errs
+	for other, otherErrs := range t.dialErrors {
+		if len(otherErrs) == 0 || now.Sub(otherErrs[len(otherErrs)-1]) > maxPeriod {
+			delete(t.dialErrors, other)
+		}
+	}
+
+	for _, r := range t.sortedRules() {
+		r, ok := r.(DialErrorRule)
+		if !ok || len(errs) < r.Count {
+			continue
+		}
+		first := errs[len(errs)-r.Count]
+		if now.Sub(first) > r.Period || !t.tryFire(r.Name, addr, r.cooldown(), now) {
+			continue
+		}
+		events = append(events, TriggerEvent{
+			Rule:      r.Name,
+			Reason:    fmt.Sprintf("%d dial errors to %s within %v", r.Count, addr, now.Sub(first)),
+			Addresses: []string{addr},
+			Start:     first.Add(-r.lookback()),
+			End:       now,
+		})
+	}
+	t.mx.Unlock()
+	t.fire(events)
+}
+
+func (t *triggers) stats(stats StatsRecord) {
+	t.mx.Lock()
+	last, haveLast := t.lastStats, t.haveLastStats
+	t.lastStats, t.haveLastStats = stats, true
+	// Totals reset if the traffic log process restarts its captures.
+	if !haveLast || stats.Received < last.Received || stats.Dropped < last.Dropped {
+		t.mx.Unlock()
+		return
+	}
+	var (
+		received = stats.Received - last.Received
+		dropped  = stats.Dropped - last.Dropped
+		events   = []TriggerEvent{}
+	)
+	for _, r := range t.sortedRules() {
+		r, ok := r.(DropRateRule)
+		if !ok || received+dropped == 0 || received+dropped < r.MinPackets {
+			continue
+		}
+		rate := float64(dropped) / float64(received+dropped)
+		if rate <= r.Threshold || !t.tryFire(r.Name, "", r.cooldown(), stats.Time) {
+			continue
+		}
+		events = append(events, TriggerEvent{
+			Rule:      r.Name,
+			Reason:    fmt.Sprintf("dropped %d of %d packets (%.1f%%)", dropped, received+dropped, rate*100),
+			Addresses: r.Addresses,
+			Start:     last.Time.Add(-r.lookback()),
+			End:       stats.Time,
+		})
+	}
+	t.mx.Unlock()
+	t.fire(events)
+}
+
+// Saves and sends each event. This happens in the background, so as not to hold up the caller.
+func (t *triggers) fire(events []TriggerEvent) {
+	for _, e := range events {
+		go func(e TriggerEvent) {
+			if len(e.Addresses) == 0 {
+				e.Addresses, e.Err = t.addresses()
+				if e.Err != nil {
+					e.Err = fmt.Errorf("failed to obtain captured addresses: %w", e.Err)
+				}
+			}
+			if e.Err == nil && len(e.Addresses) > 0 {
+				e.Err = t.save(e.Addresses, e.Start, e.End, e.Rule)
+			}
+			t.send(e)
+		}(e)
+	}
+}
@@ -0,0 +1,76 @@
+package tlproc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/getlantern/trafficlog"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTriggers(t *testing.T) {
+	var (
+		start  = time.Date(2022, 9, 3, 14, 30, 0, 0, time.UTC)
+		at     = func(seconds int) time.Time { return start.Add(time.Duration(seconds) * time.Second) }
+		proxy  = "203.0.113.7:443"
+		events = make(chan TriggerEvent, 10)
+		saves  = make(chan string, 10)
+	)
+	tr := newTriggers(
+		func(addresses []string, start, end time.Time, label string) error {
+			saves <- label
+			return nil
+		},
+		func() ([]string, error) { return []string{proxy, "203.0.113.8:443"}, nil },
+		func(e TriggerEvent) { events <- e },
+	)
+	require.Error(t, tr.addRule(DialErrorRule{Name: "bad", Period: time.Second}))
+	require.Error(t, tr.addRule(DropRateRule{Threshold: 0.1}))
+	require.NoError(t, tr.addRule(DialErrorRule{Name: "dial-errors", Count: 3, Period: 10 * time.Second}))
+	require.NoError(t, tr.addRule(DropRateRule{Name: "drops", Threshold: 0.1, MinPackets: 100}))
+
+	// Errors spread over more than the period should not fire the rule.
+	tr.dialError(proxy, at(0))
+	tr.dialError(proxy, at(8))
+	tr.dialError("203.0.113.8:443", at(9))
+	tr.dialError(proxy, at(12))
+	require.Empty(t, events)
+
+	tr.dialError(proxy, at(13))
+	e := <-events
+	require.NoError(t, e.Err)
+	require.Equal(t, "dial-errors", e.Rule)
+	require.Equal(t, []string{proxy}, e.Addresses)
+	require.Equal(t, at(8).Add(-DefaultTriggerLookback), e.Start)
+	require.Equal(t, at(13), e.End)
+	require.Equal(t, "dial-errors", <-saves)
+
+	// The rule should not fire again until the cooldown has passed.
+	tr.dialError(proxy, at(14))
+	tr.dialError(proxy, at(20))
+	require.Empty(t, events)
+	tr.dialError(proxy, at(23))
+	require.Equal(t, at(23), (<-events).End)
+	<-saves
+
+	stats := func(seconds int, received, dropped uint64) {
+		tr.stats(StatsRecord{Time: at(seconds), CaptureStats: trafficlog.CaptureStats{Received: received, Dropped: dropped}})
+	}
+	stats(0, 1000, 0)
+	stats(10, 1040, 50) // too few packets
+	stats(20, 2000, 60)
+	stats(30, 2000, 0) // reset
+	require.Empty(t, events)
+	stats(40, 2500, 100)
+	e = <-events
+	require.NoError(t, e.Err)
+	require.Equal(t, "drops", e.Rule)
+	require.Equal(t, []string{proxy, "203.0.113.8:443"}, e.Addresses)
+	require.Equal(t, at(30).Add(-DefaultTriggerLookback), e.Start)
+	require.Equal(t, "drops", <-saves)
+
+	tr.removeRule("drops")
+	stats(50, 3000, 1000)
+	time.Sleep(10 * time.Millisecond)
+	require.Empty(t, events)
+}